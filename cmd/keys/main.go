@@ -8,6 +8,7 @@ import (
 	"github.com/fxamacker/cbor/v2"
 	"github.com/ldclabs/cose/iana"
 	"github.com/ldclabs/cose/key"
+	"github.com/ldclabs/cose/key/aesgcm"
 	"github.com/ldclabs/cose/key/hmac"
 )
 
@@ -24,6 +25,8 @@ func main() {
 	switch *kind {
 	case "state":
 		k, err = hmac.GenerateKey(iana.AlgorithmHMAC_256_64)
+	case "kek":
+		k, err = aesgcm.GenerateKey(iana.AlgorithmA256GCM)
 	default:
 		panic("unsupported kind")
 	}
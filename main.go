@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"github.com/yiwen-ai/auth-api/src/api"
 	"github.com/yiwen-ai/auth-api/src/conf"
 	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
 )
 
 var help = flag.Bool("help", false, "show help info")
@@ -23,10 +25,36 @@ func main() {
 		os.Exit(0)
 	}
 
+	cfg := conf.Config.Tracing
+	shutdownTracing, err := util.InitTracing(conf.Config.GlobalSignal, conf.AppName, conf.AppVersion,
+		cfg.Exporter, cfg.Endpoint, cfg.Insecure, cfg.SampleRatio)
+	if err != nil {
+		logging.Panicf("InitTracing error: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logging.Warningf("shutdown tracing: %v", err)
+		}
+	}()
+
+	if err = util.AllowOutboundCIDRs(conf.Config.Outbound.AllowCIDRs); err != nil {
+		logging.Panicf("AllowOutboundCIDRs error: %v", err)
+	}
+
+	if addr := conf.Config.Server.MetricsAddr; addr != "" {
+		go func() {
+			logging.Infof("%s@%s metrics start on http://%s", conf.AppName, conf.AppVersion, addr)
+			err := api.NewMetricsApp().ListenWithContext(conf.Config.ListenContext, addr)
+			logging.Warningf("%s@%s metrics server closed: %v", conf.AppName, conf.AppVersion, err)
+		}()
+	}
+
 	app := api.NewApp()
 	host := "http://" + conf.Config.Server.Addr
 	logging.Infof("%s@%s start on %s %s", conf.AppName, conf.AppVersion, conf.Config.Env, host)
-	err := app.ListenWithContext(conf.Config.GlobalSignal, conf.Config.Server.Addr)
+	err = app.ListenWithContext(conf.Config.ListenContext, conf.Config.Server.Addr)
 	logging.Warningf("%s@%s http server closed: %v", conf.AppName, conf.AppVersion, err)
 
 	ctx := conf.Config.GlobalShutdown
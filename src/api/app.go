@@ -2,6 +2,7 @@ package api
 
 import (
 	"log"
+	"net/url"
 	"strings"
 	"time"
 
@@ -34,6 +35,7 @@ func NewApp() *gear.App {
 	// })
 
 	app.UseHandler(logging.AccessLogger)
+	app.Use(tracing)
 	err := util.DigInvoke(func(routers []*gear.Router) error {
 		for _, router := range routers {
 			app.UseHandler(router)
@@ -48,6 +50,22 @@ func NewApp() *gear.App {
 	return app
 }
 
+// NewMetricsApp serves the Prometheus metrics on the internal address (server.metrics_addr),
+// they are not exposed on the public routes.
+func NewMetricsApp() *gear.App {
+	app := gear.New()
+
+	app.Set(gear.SetLogger, log.New(gear.DefaultFilterWriter(), "", 0))
+	app.Set(gear.SetCompress, gear.ThresholdCompress(128))
+	app.Set(gear.SetGraceTimeout, time.Duration(conf.Config.Server.GracefulShutdown)*time.Second)
+	app.Set(gear.SetEnv, conf.Config.Env)
+
+	router := gear.NewRouter()
+	router.Get("/metrics", (&Healthz{}).Metrics)
+	app.UseHandler(router)
+	return app
+}
+
 type bodyParser struct {
 	inner gear.BodyParser
 }
@@ -65,6 +83,14 @@ func (d *bodyParser) Parse(buf []byte, body any, mediaType, charset string) erro
 		return cbor.Unmarshal(buf, body)
 	}
 
+	if strings.HasPrefix(mediaType, gear.MIMEApplicationForm) {
+		values, err := url.ParseQuery(string(buf))
+		if err != nil {
+			return err
+		}
+		return gear.ValuesToStruct(values, body, "form")
+	}
+
 	return d.inner.Parse(buf, body, mediaType, charset)
 }
 
@@ -2,16 +2,21 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/fxamacker/cbor/v2"
 	"github.com/ldclabs/cose/cose"
 	"github.com/ldclabs/cose/key"
+	_ "github.com/ldclabs/cose/key/aesgcm"
 	_ "github.com/ldclabs/cose/key/hmac"
 	"github.com/mssola/useragent"
 	"github.com/teambition/gear"
@@ -21,6 +26,7 @@ import (
 	"github.com/yiwen-ai/auth-api/src/bll"
 	"github.com/yiwen-ai/auth-api/src/conf"
 	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/service"
 	"github.com/yiwen-ai/auth-api/src/util"
 )
 
@@ -28,13 +34,23 @@ const Wechat_UA = "MicroMessenger/"
 
 type AuthN struct {
 	blls       *bll.Blls
+	nonces     service.NonceStore
+	mailer     service.Mailer
+	smsSender  service.SMSSender
 	providers  map[string]*oauth2.Config
+	oidcs      map[string]*oidcProvider
+	apple      *appleClient
 	stateMACer key.MACer
+	kek        key.Encryptor
+	mfa        conf.MFA
+	stepUp     conf.StepUp
+	email      conf.Email
+	sms        conf.SMS
 	cookie     conf.Cookie
 	authURL    *conf.AuthURL
 }
 
-func NewAuth(blls *bll.Blls, cfg *conf.ConfigTpl) *AuthN {
+func NewAuth(blls *bll.Blls, nonces service.NonceStore, mailer service.Mailer, smsSender service.SMSSender, cfg *conf.ConfigTpl) *AuthN {
 	macer, err := cfg.COSEKeys.Oauth2State.MACer()
 	if err != nil {
 		panic(err)
@@ -42,12 +58,26 @@ func NewAuth(blls *bll.Blls, cfg *conf.ConfigTpl) *AuthN {
 
 	authn := &AuthN{
 		blls:       blls,
+		nonces:     nonces,
+		mailer:     mailer,
+		smsSender:  smsSender,
 		providers:  make(map[string]*oauth2.Config),
+		oidcs:      make(map[string]*oidcProvider),
 		stateMACer: macer,
+		mfa:        cfg.MFA,
+		stepUp:     cfg.StepUp,
+		email:      cfg.Email,
+		sms:        cfg.SMS,
 		cookie:     cfg.Cookie,
 		authURL:    &cfg.AuthURL,
 	}
 
+	if cfg.COSEKeys.TOTPKEK != nil {
+		if authn.kek, err = cfg.COSEKeys.TOTPKEK.Encryptor(); err != nil {
+			panic(err)
+		}
+	}
+
 	for k, v := range cfg.Providers {
 		var endpoint oauth2.Endpoint
 		switch k {
@@ -66,7 +96,23 @@ func NewAuth(blls *bll.Blls, cfg *conf.ConfigTpl) *AuthN {
 		case "google":
 			endpoint = endpoints.Google
 		default:
-			panic(fmt.Sprintf("unknown provider %q\n", k))
+			if v.Kind != "oidc" {
+				panic(fmt.Sprintf("unknown provider %q\n", k))
+			}
+		}
+
+		if v.Kind == "oidc" {
+			// the endpoint will be discovered from the issuer
+			authn.oidcs[k] = &oidcProvider{
+				issuer: v.Issuer,
+				claims: v.Claims,
+			}
+		}
+
+		if k == "apple" {
+			if authn.apple, err = newAppleClient(v); err != nil {
+				panic(err)
+			}
 		}
 
 		authn.providers[k] = &oauth2.Config{
@@ -125,14 +171,48 @@ func (a *AuthN) Login(ctx *gear.Context) error {
 		nextURL.RawQuery = qs.Encode()
 	}
 
-	state, err := a.createState(idp, nextURL.String())
+	if _, ok := a.providers[idp]; !ok {
+		next := a.authURL.GenNextUrl(&nextURL, 400, xid)
+		logging.SetTo(ctx, "error", fmt.Sprintf("unknown provider %q", idp))
+		return ctx.Redirect(next)
+	}
+
+	if _, err := a.discoverOIDC(ctx, idp); err != nil {
+		next := a.authURL.GenNextUrl(&nextURL, 502, xid)
+		logging.SetTo(ctx, "error", err.Error())
+		return ctx.Redirect(next)
+	}
+
+	// link mode, the identity will be linked to the logined user
+	var linkUID *util.ID
+	if ctx.Query("link") == "1" {
+		sess := gear.CtxValue[bll.SessionOutput](ctx)
+		if sess == nil || sess.UID == nil || sess.SID == nil {
+			next := a.authURL.GenNextUrl(&nextURL, 401, xid)
+			logging.SetTo(ctx, "error", "missing session for link")
+			return ctx.Redirect(next)
+		}
+		// linking a login method is as sensitive as unlinking one
+		if err := a.checkStepUp(ctx, *sess.SID); err != nil {
+			next := a.authURL.GenNextUrl(&nextURL, 403, xid)
+			logging.SetTo(ctx, "error", fmt.Sprintf("step-up required for link: %v", err))
+			return ctx.Redirect(next)
+		}
+		linkUID = sess.UID
+	}
+
+	binding := newLoginBinding()
+	state, err := a.createState(idp, nextURL.String(), binding.id, linkUID)
+	if err == nil {
+		err = a.setBindingCookie(ctx, idp, binding)
+	}
 	if err != nil {
 		next := a.authURL.GenNextUrl(&nextURL, 500, xid)
 		logging.SetTo(ctx, "error", fmt.Sprintf("failed to create state: %v", err))
 		return ctx.Redirect(next)
 	}
 
-	url := a.getAuthCodeURL(idp, state)
+	url := a.getAuthCodeURL(idp, state, binding)
 	if a.cookie.WeChatDomain != "" && strings.HasSuffix(ctx.Host, a.cookie.WeChatDomain) {
 		url = strings.Replace(url, a.cookie.Domain, a.cookie.WeChatDomain, 1)
 	}
@@ -151,15 +231,36 @@ func (a *AuthN) Callback(ctx *gear.Context) error {
 		return ctx.Redirect(next)
 	}
 
-	code := ctx.Query("code")
-	state := ctx.Query("state")
-	nextURL, err := a.verifyState(idp, state)
+	// Apple uses response_mode=form_post, the params are in the body
+	code := ctx.Req.FormValue("code")
+	state := ctx.Req.FormValue("state")
+	nextURL, bid, linkUID, err := a.verifyState(idp, state)
 	if err != nil {
+		util.MetricStateFailures.WithLabelValues(idp, "invalid").Inc()
+		failAttempt(ctx)
+		next := a.authURL.GenNextUrl(nil, 403, xid)
+		logging.SetTo(ctx, "error", fmt.Sprintf("invalid state: %v", err))
+		return ctx.Redirect(next)
+	}
+
+	if err = consumeToken(ctx, a.blls, a.nonces, "state", state, loginStateExpiresIn); err != nil {
+		util.MetricStateFailures.WithLabelValues(idp, "replay").Inc()
+		failAttempt(ctx)
 		next := a.authURL.GenNextUrl(nil, 403, xid)
 		logging.SetTo(ctx, "error", fmt.Sprintf("invalid state: %v", err))
 		return ctx.Redirect(next)
 	}
 
+	// the state must be used by the same browser that started the login
+	binding, err := a.takeBindingCookie(ctx, idp, bid)
+	if err != nil {
+		util.MetricStateFailures.WithLabelValues(idp, "binding").Inc()
+		failAttempt(ctx)
+		next := a.authURL.GenNextUrl(nil, 403, xid)
+		logging.SetTo(ctx, "error", fmt.Sprintf("invalid login binding: %v", err))
+		return ctx.Redirect(next)
+	}
+
 	if nextURL.Host == "" {
 		nextURL.Scheme = "https"
 		nextURL.Host = "www.yiwen.pub"
@@ -168,21 +269,121 @@ func (a *AuthN) Callback(ctx *gear.Context) error {
 		}
 	}
 
-	input, err := a.exchange(ctx, idp, code)
+	if _, err := a.discoverOIDC(ctx, idp); err != nil {
+		next := a.authURL.GenNextUrl(nextURL, 502, xid)
+		logging.SetTo(ctx, "error", err.Error())
+		return ctx.Redirect(next)
+	}
+
+	input, err := a.exchange(ctx, idp, code, binding)
 	if err != nil {
+		util.MetricLogins.WithLabelValues(idp, "failure").Inc()
+		if !idpUnavailable(err) {
+			failAttempt(ctx)
+		}
 		next := a.authURL.GenNextUrl(nextURL, 403, xid)
 		logging.SetTo(ctx, "error", err.Error())
 		return ctx.Redirect(next)
 	}
 
-	if input.User.Name == "" {
-		input.User.Name = input.Sub
+	// Apple sends the name only on the first authorization
+	if idp == "apple" {
+		if name := appleUserName(ctx.Req.FormValue("user")); name != "" {
+			input.User.Name = name
+		}
 	}
 
 	input.Idp = idp
 	input.Aud = provider.ClientID
-	input.ExpiresIn = a.cookie.ExpiresIn
 	input.Scope = provider.Scopes
+	a.fillDevice(ctx, input)
+
+	switch idp {
+	case "wechat":
+		if coIdp, ok := a.providers["wechat_h5"]; ok {
+			input.CoAuthN = &bll.AuthNPK{
+				Idp: "wechat_h5",
+				Aud: coIdp.ClientID,
+				Sub: input.Sub,
+			}
+		}
+	case "wechat_h5":
+		if coIdp, ok := a.providers["wechat"]; ok {
+			input.CoAuthN = &bll.AuthNPK{
+				Idp: "wechat",
+				Aud: coIdp.ClientID,
+				Sub: input.Sub,
+			}
+		}
+	}
+
+	if linkUID != nil {
+		return a.link(ctx, *linkUID, input, nextURL)
+	}
+
+	res, err := a.blls.AuthN.LoginOrNew(ctx, input)
+	if err != nil {
+		util.MetricLogins.WithLabelValues(idp, "failure").Inc()
+		next := a.authURL.GenNextUrl(nextURL, 500, xid)
+		logging.SetTo(ctx, "error", fmt.Sprintf("AuthN.LoginOrNew failed: %v", err))
+		return ctx.Redirect(next)
+	}
+
+	a.logLogin(ctx, input, res)
+
+	// the login is pending until the second factor is verified
+	pending, err := a.startMFA(ctx, *res.UID, res.SID.String(), res.Session, a.authURL.GenNextUrl(nextURL, 200, ""))
+	if err != nil {
+		next := a.authURL.GenNextUrl(nextURL, 500, xid)
+		logging.SetTo(ctx, "error", fmt.Sprintf("startMFA failed: %v", err))
+		return ctx.Redirect(next)
+	}
+	if pending {
+		next := a.mfaVerifyURL(a.authURL.GenNextUrl(nextURL, 200, ""))
+		logging.SetTo(ctx, "redirect_url", next)
+		return ctx.Redirect(next)
+	}
+
+	isInWechat := a.isInWechat(ctx)
+	domain := a.cookie.Domain
+	if isInWechat {
+		domain = a.cookie.WeChatDomain
+	}
+
+	a.setSessionCookies(ctx, domain, res.SID, res.Session, AALSingleFactor, "idp")
+	next := a.authURL.GenNextUrl(nextURL, 200, "")
+	// if isInWechat {
+	// 	next = strings.Replace(next, a.cookie.Domain, a.cookie.WeChatDomain, 2)
+	// 	obj := &cose.Mac0Message[key.IntMap]{
+	// 		Unprotected: cose.Headers{},
+	// 		Payload: key.IntMap{
+	// 			0: time.Now().Add(20 * time.Second).Unix(),
+	// 			1: res.SID.String(),
+	// 			2: res.Session,
+	// 			3: next,
+	// 		},
+	// 	}
+	//  被微信拦截了
+	// 	if err := obj.Compute(a.stateMACer, []byte(statePurposeSyncSession)); err == nil {
+	// 		if data, err := cbor.Marshal(obj); err == nil {
+	// 			reqUrl := &url.URL{
+	// 				Scheme:   "https",
+	// 				Host:     strings.Replace(ctx.Host, a.cookie.WeChatDomain, a.cookie.Domain, 1),
+	// 				Path:     "/sync_session",
+	// 				RawQuery: "sess=" + base64.RawURLEncoding.EncodeToString(data),
+	// 			}
+	// 			next = reqUrl.String()
+	// 		}
+	// 	}
+	// }
+
+	logging.SetTo(ctx, "redirect_url", next)
+	return ctx.Redirect(next)
+}
+
+// fillDevice fills the request information of the login.
+func (a *AuthN) fillDevice(ctx *gear.Context, input *bll.AuthNInput) {
+	input.ExpiresIn = a.cookie.ExpiresIn
 	input.Ip = ctx.IP().String()
 	locale := ctx.AcceptLanguage()
 	if i := strings.IndexAny(locale, "-_"); i > 0 {
@@ -190,9 +391,8 @@ func (a *AuthN) Callback(ctx *gear.Context) error {
 	}
 	input.User.Locale = locale
 	input.DeviceID = ctx.GetHeader("X-Device-Id")
-	didCookieName := a.cookie.NamePrefix + "_DID"
 	if input.DeviceID == "" {
-		if cookie, _ := ctx.Req.Cookie(didCookieName); cookie != nil {
+		if cookie, _ := ctx.Req.Cookie(a.cookie.NamePrefix + "_DID"); cookie != nil {
 			input.DeviceID = cookie.Value
 		}
 	}
@@ -212,67 +412,43 @@ func (a *AuthN) Callback(ctx *gear.Context) error {
 		desc = append(desc, n, v)
 	}
 	input.DeviceDesc = strings.Join(desc, ", ")
+}
 
-	switch idp {
-	case "wechat":
-		if coIdp, ok := a.providers["wechat_h5"]; ok {
-			input.CoAuthN = &bll.AuthNPK{
-				Idp: "wechat_h5",
-				Aud: coIdp.ClientID,
-				Sub: input.Sub,
-			}
-		}
-	case "wechat_h5":
-		if coIdp, ok := a.providers["wechat"]; ok {
-			input.CoAuthN = &bll.AuthNPK{
-				Idp: "wechat",
-				Aud: coIdp.ClientID,
-				Sub: input.Sub,
-			}
-		}
-	}
-
-	res, err := a.blls.AuthN.LoginOrNew(ctx, input)
-	if err != nil {
-		next := a.authURL.GenNextUrl(nextURL, 500, xid)
-		logging.SetTo(ctx, "error", fmt.Sprintf("AuthN.LoginOrNew failed: %v", err))
-		return ctx.Redirect(next)
-	}
-
+// logLogin logs the login, and gives award for registration.
+func (a *AuthN) logLogin(ctx *gear.Context, input *bll.AuthNInput, res *bll.AuthNSessionOutput) {
+	util.MetricLogins.WithLabelValues(input.Idp, "success").Inc()
 	// give award for registration
 	if res.UserCreatedAt > 0 {
+		util.MetricRegistrations.WithLabelValues(input.Idp).Inc()
 		referrer := ""
 		if c, _ := ctx.Req.Cookie("by"); c != nil {
 			referrer = c.Value
 		}
 		go a.giveAward(conf.WithGlobalCtx(ctx), *res.UID, referrer)
 		a.blls.Logbase.Log(ctx, bll.LogActionSysCreateUser, 1, *res.UID, *res.UID, &bll.LogPayload{
-			Idp: util.Ptr(idp),
+			Idp: util.Ptr(input.Idp),
 			Sub: util.Ptr(input.Sub),
 		})
 
 		// disable user registration in yiwen.ltd
 		if conf.Config.Env != "prod" {
-			if _, err = a.blls.Session.DisabledUser(ctx, *res.UID); err != nil {
+			if _, err := a.blls.Session.DisabledUser(ctx, *res.UID); err != nil {
 				logging.SetTo(ctx, "error", fmt.Sprintf("DisabledUser failed: %v", err))
 			}
 		}
 	} else {
 		a.blls.Logbase.Log(ctx, bll.LogActionUserLogin, 1, *res.UID, *res.UID, &bll.LogPayload{
-			Idp: util.Ptr(idp),
+			Idp: util.Ptr(input.Idp),
 			Sub: util.Ptr(input.Sub),
 		})
 	}
+}
 
-	isInWechat := a.isInWechat(ctx)
-	domain := a.cookie.Domain
-	if isInWechat {
-		domain = a.cookie.WeChatDomain
-	}
-
+// setSessionCookies sets the session cookies and the authentication context.
+func (a *AuthN) setSessionCookies(ctx *gear.Context, domain string, sid util.ID, session string, level int, method string) {
 	didCookie := &http.Cookie{
-		Name:     didCookieName,
-		Value:    res.SID.String(),
+		Name:     a.cookie.NamePrefix + "_DID",
+		Value:    sid.String(),
 		HttpOnly: true,
 		Secure:   a.cookie.Secure,
 		MaxAge:   3600 * 24 * 366,
@@ -284,7 +460,7 @@ func (a *AuthN) Callback(ctx *gear.Context) error {
 
 	sessCookie := &http.Cookie{
 		Name:     a.cookie.NamePrefix + "_SESS",
-		Value:    res.Session,
+		Value:    session,
 		HttpOnly: true,
 		Secure:   a.cookie.Secure,
 		MaxAge:   int(a.cookie.ExpiresIn),
@@ -294,55 +470,47 @@ func (a *AuthN) Callback(ctx *gear.Context) error {
 	}
 
 	http.SetCookie(ctx.Res, sessCookie)
-	next := a.authURL.GenNextUrl(nextURL, 200, "")
-	// if isInWechat {
-	// 	next = strings.Replace(next, a.cookie.Domain, a.cookie.WeChatDomain, 2)
-	// 	obj := &cose.Mac0Message[key.IntMap]{
-	// 		Unprotected: cose.Headers{},
-	// 		Payload: key.IntMap{
-	// 			0: time.Now().Add(20 * time.Second).Unix(),
-	// 			1: res.SID.String(),
-	// 			2: res.Session,
-	// 			3: next,
-	// 		},
-	// 	}
-	//  被微信拦截了
-	// 	if err := obj.Compute(a.stateMACer, nil); err == nil {
-	// 		if data, err := cbor.Marshal(obj); err == nil {
-	// 			reqUrl := &url.URL{
-	// 				Scheme:   "https",
-	// 				Host:     strings.Replace(ctx.Host, a.cookie.WeChatDomain, a.cookie.Domain, 1),
-	// 				Path:     "/sync_session",
-	// 				RawQuery: "sess=" + base64.RawURLEncoding.EncodeToString(data),
-	// 			}
-	// 			next = reqUrl.String()
-	// 		}
-	// 	}
-	// }
+	if err := a.setAuthnContext(ctx, sid, level, method); err != nil {
+		logging.SetTo(ctx, "error", fmt.Sprintf("setAuthnContext failed: %v", err))
+	}
+}
+
+// link links the identity to the user, it does not change the session.
+func (a *AuthN) link(ctx *gear.Context, uid util.ID, input *bll.AuthNInput, nextURL *url.URL) error {
+	xid := ctx.GetHeader(gear.HeaderXRequestID)
+	res, err := a.blls.AuthN.Link(ctx, uid, input)
+	if err != nil {
+		status := 500
+		if gear.ParseError(err).Status() == http.StatusConflict {
+			status = http.StatusConflict // linked to another user
+		}
+		next := a.authURL.GenNextUrl(nextURL, status, xid)
+		logging.SetTo(ctx, "error", fmt.Sprintf("AuthN.Link failed: %v", err))
+		return ctx.Redirect(next)
+	}
 
+	a.blls.Logbase.Log(ctx, bll.LogActionUserLinkAuthN, 1, uid, uid, &bll.LogPayload{
+		Idp: util.Ptr(res.Idp),
+		Sub: util.Ptr(res.Sub),
+	})
+
+	next := a.authURL.GenNextUrl(nextURL, 200, "")
 	logging.SetTo(ctx, "redirect_url", next)
 	return ctx.Redirect(next)
 }
 
 func (a *AuthN) SyncSession(ctx *gear.Context) error {
-	data, err := base64.RawURLEncoding.DecodeString(ctx.Query("sess"))
+	payload, err := openState(a.stateMACer, statePurposeSyncSession, ctx.Query("sess"))
 	if err != nil {
 		return gear.ErrBadRequest.WithMsgf("invalid sess: %v", err)
 	}
-
-	obj := &cose.Mac0Message[key.IntMap]{}
-	if err = cbor.Unmarshal(data, obj); err != nil {
-		return gear.ErrBadRequest.WithMsgf("invalid sess: %v", err)
-	}
-	if err = obj.Verify(a.stateMACer, nil); err != nil {
+	if err = consumeToken(ctx, a.blls, a.nonces, "sess", ctx.Query("sess"), time.Minute); err != nil {
 		return gear.ErrBadRequest.WithMsgf("invalid sess: %v", err)
 	}
-	if v, _ := obj.Payload.GetInt64(0); v < time.Now().Unix() {
-		return gear.ErrBadRequest.WithMsg("expired sess")
-	}
-	sid, _ := obj.Payload.GetString(1)
-	sess, _ := obj.Payload.GetString(2)
-	next, _ := obj.Payload.GetString(3)
+
+	sid, _ := payload.GetString(1)
+	sess, _ := payload.GetString(2)
+	next, _ := payload.GetString(3)
 
 	didCookie := &http.Cookie{
 		Name:     a.cookie.NamePrefix + "_DID",
@@ -375,6 +543,8 @@ func (a *AuthN) SyncSession(ctx *gear.Context) error {
 func (a *AuthN) giveAward(gctx context.Context, uid util.ID, referrer string) {
 	conf.Config.ObtainJob()
 	defer conf.Config.ReleaseJob()
+	gctx, span := util.StartBackgroundSpan(gctx, "giveAward")
+	defer span.End()
 
 	wallet, err := a.blls.Walletbase.Get(gctx, uid)
 	if wallet != nil && wallet.Sequence == 0 {
@@ -391,9 +561,20 @@ func (a *AuthN) giveAward(gctx context.Context, uid util.ID, referrer string) {
 	}
 }
 
-func (a *AuthN) getAuthCodeURL(idp, state string) string {
+func (a *AuthN) getAuthCodeURL(idp, state string, binding *loginBinding) string {
 	provider := a.providers[idp]
-	uri := provider.AuthCodeURL(state)
+	opts := make([]oauth2.AuthCodeOption, 0, 3)
+	if _, ok := a.oidcs[idp]; ok {
+		opts = append(opts, oidc.Nonce(binding.nonce))
+	}
+	if supportsPKCE(idp) {
+		opts = append(opts, oauth2.S256ChallengeOption(binding.verifier))
+	}
+	if idp == "apple" {
+		// Apple requires form_post when requesting the name or email scope
+		opts = append(opts, oauth2.SetAuthURLParam("response_mode", "form_post"))
+	}
+	uri := provider.AuthCodeURL(state, opts...)
 	switch idp {
 	case "wechat", "wechat_h5":
 		// https://developers.weixin.qq.com/doc/oplatform/Website_App/WeChat_Login/Wechat_Login.html
@@ -404,11 +585,22 @@ func (a *AuthN) getAuthCodeURL(idp, state string) string {
 	return uri
 }
 
-func (a *AuthN) exchange(ctx context.Context, idp, code string) (*bll.AuthNInput, error) {
+// idpUnavailable reports whether the IdP is unreachable or fails, rather than rejects the code or the ID token.
+func idpUnavailable(err error) bool {
+	var nerr net.Error
+	var gerr *gear.Error
+	return errors.As(err, &nerr) || (errors.As(err, &gerr) && gerr.Code >= 500)
+}
+
+func (a *AuthN) exchange(ctx context.Context, idp, code string, binding *loginBinding) (*bll.AuthNInput, error) {
 	cli := util.ExternalHTTPClient
 	cctx := context.WithValue(ctx, oauth2.HTTPClient, cli)
 	provider := a.providers[idp]
 	rt := &bll.AuthNInput{}
+	opts := make([]oauth2.AuthCodeOption, 0, 1)
+	if supportsPKCE(idp) {
+		opts = append(opts, oauth2.VerifierOption(binding.verifier))
+	}
 
 	switch idp {
 	case "wechat", "wechat_h5":
@@ -457,7 +649,7 @@ func (a *AuthN) exchange(ctx context.Context, idp, code string) (*bll.AuthNInput
 		rt.User.Picture = user.Picture
 
 	case "github":
-		token, err := provider.Exchange(cctx, code)
+		token, err := provider.Exchange(cctx, code, opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -481,7 +673,7 @@ func (a *AuthN) exchange(ctx context.Context, idp, code string) (*bll.AuthNInput
 		rt.User.Picture = user.Picture
 
 	case "google":
-		token, err := provider.Exchange(cctx, code)
+		token, err := provider.Exchange(cctx, code, opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -505,23 +697,120 @@ func (a *AuthN) exchange(ctx context.Context, idp, code string) (*bll.AuthNInput
 		rt.User.Picture = user.Picture
 
 	default:
-		return nil, fmt.Errorf("unknown provider %q", idp)
+		p, ok := a.oidcs[idp]
+		if !ok {
+			return nil, fmt.Errorf("unknown provider %q", idp)
+		}
+
+		if idp == "apple" {
+			secret, err := a.apple.clientSecret()
+			if err != nil {
+				return nil, err
+			}
+			cfg := *provider
+			cfg.ClientSecret = secret
+			cfg.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+			provider = &cfg
+		}
+
+		token, err := provider.Exchange(cctx, code, opts...)
+		if err != nil {
+			return nil, err
+		}
+		rt.Payload, _ = cbor.Marshal(token)
+
+		if err = p.exchange(cctx, token, binding.nonce, rt); err != nil {
+			return nil, err
+		}
 	}
 
 	return rt, nil
 }
 
-func (a *AuthN) createState(idp, next_url string) (string, error) {
+func (a *AuthN) createState(idp, next_url string, bid []byte, linkUID *util.ID) (string, error) {
+	payload := key.IntMap{
+		0: time.Now().Add(loginStateExpiresIn).Unix(),
+		1: idp,
+		2: next_url,
+		3: bid,
+	}
+	if linkUID != nil {
+		payload[4] = linkUID.Bytes()
+	}
+	return sealState(a.stateMACer, statePurposeLogin, payload)
+}
+
+func (a *AuthN) verifyState(idp, state string) (*url.URL, []byte, *util.ID, error) {
+	payload, err := openState(a.stateMACer, statePurposeLogin, state)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if v, _ := payload.GetString(1); v != idp {
+		return nil, nil, nil, fmt.Errorf("invalid state for provider %q", idp)
+	}
+
+	var linkUID *util.ID
+	if v, _ := payload.GetBytes(4); len(v) > 0 {
+		id, err := util.IDFromBytes(v)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		linkUID = &id
+	}
+
+	bid, _ := payload.GetBytes(3)
+	next_url, _ := payload.GetString(2)
+	u, err := url.Parse(next_url)
+	return u, bid, linkUID, err
+}
+
+// tokenKey is the key of the single-use token in the nonce store.
+func tokenKey(kind, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return kind + ":" + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// consumeToken marks the single-use token as used, the replay is rejected and logged.
+func consumeToken(ctx *gear.Context, blls *bll.Blls, nonces service.NonceStore, kind, token string, ttl time.Duration) error {
+	ok, err := nonces.Consume(ctx, tokenKey(kind, token), ttl)
+	if err != nil {
+		return fmt.Errorf("consume %s failed: %v", kind, err)
+	}
+	if !ok {
+		blls.Logbase.Log(ctx, bll.LogActionSysReplayToken, -1, util.ANON, util.ANON, &bll.LogPayload{
+			Kind: util.Ptr(kind),
+		})
+		return fmt.Errorf("%s has been used", kind)
+	}
+	return nil
+}
+
+// The purposes of the sealed states, a state sealed for one purpose can not be opened for another.
+// The KEK state of COSERenewKEK is kept with the empty external AAD, so the issued ones remain valid.
+const (
+	statePurposeLogin          = "login"
+	statePurposeBinding        = "login_binding"
+	statePurposeEmailLink      = emailLinkStateKind
+	statePurposeEmailChallenge = emailChallengeKind
+	statePurposeSMSChallenge   = smsChallengeKind
+	statePurposeConsent        = "oauth2_consent"
+	statePurposeCode           = "oauth2_code"
+	statePurposeSyncSession    = "sync_session"
+)
+
+// sealState computes a COSE Mac0 message for the payload and returns it in base64url encoding.
+// The payload should carry the expiry time (unix seconds) at key 0,
+// the purpose is bound as the external AAD of the MAC.
+func sealState(macer key.MACer, purpose string, payload key.IntMap) (string, error) {
+	if purpose == "" {
+		return "", fmt.Errorf("missing state purpose")
+	}
+
 	obj := &cose.Mac0Message[key.IntMap]{
 		Unprotected: cose.Headers{},
-		Payload: key.IntMap{
-			0: time.Now().Add(5 * time.Minute).Unix(),
-			1: idp,
-			2: next_url,
-		},
+		Payload:     payload,
 	}
-	err := obj.Compute(a.stateMACer, nil)
-	if err != nil {
+	if err := obj.Compute(macer, []byte(purpose)); err != nil {
 		return "", err
 	}
 
@@ -532,7 +821,12 @@ func (a *AuthN) createState(idp, next_url string) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(data), nil
 }
 
-func (a *AuthN) verifyState(idp, state string) (*url.URL, error) {
+// openState verifies the state sealed by sealState for the purpose and returns the unexpired payload.
+func openState(macer key.MACer, purpose string, state string) (key.IntMap, error) {
+	if purpose == "" {
+		return nil, fmt.Errorf("missing state purpose")
+	}
+
 	data, err := base64.RawURLEncoding.DecodeString(state)
 	if err != nil {
 		return nil, err
@@ -542,16 +836,11 @@ func (a *AuthN) verifyState(idp, state string) (*url.URL, error) {
 	if err = cbor.Unmarshal(data, obj); err != nil {
 		return nil, err
 	}
-	if err = obj.Verify(a.stateMACer, nil); err != nil {
+	if err = obj.Verify(macer, []byte(purpose)); err != nil {
 		return nil, err
 	}
 	if v, _ := obj.Payload.GetInt64(0); v < time.Now().Unix() {
 		return nil, fmt.Errorf("expired state")
 	}
-	if v, _ := obj.Payload.GetString(1); v != idp {
-		return nil, fmt.Errorf("invalid state for provider %q", idp)
-	}
-
-	next_url, _ := obj.Payload.GetString(2)
-	return url.Parse(next_url)
+	return obj.Payload, nil
 }
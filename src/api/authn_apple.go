@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+// appleClient generates the client secret for Sign in with Apple.
+// https://developer.apple.com/documentation/accountorganizationaldatasharing/creating-a-client-secret
+type appleClient struct {
+	clientID string
+	teamID   string
+	signer   jose.Signer
+}
+
+func newAppleClient(cfg conf.Provider) (*appleClient, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: cfg.PrivateKey},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", cfg.KeyID),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appleClient{clientID: cfg.ClientID, teamID: cfg.TeamID, signer: signer}, nil
+}
+
+// clientSecret returns a short-lived ES256 JWT, it is used as the client_secret when exchanging the code.
+func (c *appleClient) clientSecret() (string, error) {
+	now := time.Now()
+	return jwt.Signed(c.signer).Claims(jwt.Claims{
+		Issuer:   c.teamID,
+		Subject:  c.clientID,
+		Audience: jwt.Audience{"https://appleid.apple.com"},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(5 * time.Minute)),
+	}).Serialize()
+}
+
+// appleUserName returns the user's name from the "user" form field.
+// Apple sends it only on the first authorization, it is not in the id_token.
+func appleUserName(user string) string {
+	if user == "" {
+		return ""
+	}
+
+	var u struct {
+		Name struct {
+			FirstName string `json:"firstName"`
+			LastName  string `json:"lastName"`
+		} `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(user), &u); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(u.Name.FirstName + " " + u.Name.LastName)
+}
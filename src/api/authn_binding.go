@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ldclabs/cose/key"
+	"github.com/teambition/gear"
+	"golang.org/x/oauth2"
+)
+
+const loginStateExpiresIn = 5 * time.Minute
+
+// loginBinding binds the login state to the browser that started the login.
+// The PKCE verifier prevents authorization code injection, the nonce binds the id_token to the login.
+type loginBinding struct {
+	id       []byte
+	verifier string
+	nonce    string
+}
+
+func newLoginBinding() *loginBinding {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return &loginBinding{
+		id:       id,
+		verifier: oauth2.GenerateVerifier(),
+		nonce:    oauth2.GenerateVerifier(),
+	}
+}
+
+// supportsPKCE reports whether the provider accepts the PKCE parameters.
+// WeChat has its own token API, Apple does not document the code_verifier for its token endpoint.
+func supportsPKCE(idp string) bool {
+	switch idp {
+	case "wechat", "wechat_h5", "apple":
+		return false
+	}
+	return true
+}
+
+func (a *AuthN) bindingCookieName() string {
+	return a.cookie.NamePrefix + "_OAUTH"
+}
+
+// setBindingCookie stores the binding in a short-lived HttpOnly cookie, sealed with the state key.
+func (a *AuthN) setBindingCookie(ctx *gear.Context, idp string, binding *loginBinding) error {
+	value, err := sealState(a.stateMACer, statePurposeBinding, key.IntMap{
+		0: time.Now().Add(loginStateExpiresIn).Unix(),
+		1: idp,
+		2: binding.id,
+		3: binding.verifier,
+		4: binding.nonce,
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(ctx.Res, a.bindingCookie(ctx, value, int(loginStateExpiresIn/time.Second)))
+	return nil
+}
+
+// takeBindingCookie reads the binding for the state and clears the cookie, it can be used only once.
+func (a *AuthN) takeBindingCookie(ctx *gear.Context, idp string, bid []byte) (*loginBinding, error) {
+	cookie, _ := ctx.Req.Cookie(a.bindingCookieName())
+	if cookie == nil {
+		return nil, fmt.Errorf("missing binding cookie")
+	}
+	http.SetCookie(ctx.Res, a.bindingCookie(ctx, "", -1))
+
+	payload, err := openState(a.stateMACer, statePurposeBinding, cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	if v, _ := payload.GetString(1); v != idp {
+		return nil, fmt.Errorf("binding for provider %q, expected %q", v, idp)
+	}
+	if v, _ := payload.GetBytes(2); len(bid) == 0 || !bytes.Equal(v, bid) {
+		return nil, fmt.Errorf("binding mismatch the state")
+	}
+
+	binding := &loginBinding{id: bid}
+	binding.verifier, _ = payload.GetString(3)
+	binding.nonce, _ = payload.GetString(4)
+	return binding, nil
+}
+
+func (a *AuthN) bindingCookie(ctx *gear.Context, value string, maxAge int) *http.Cookie {
+	domain := a.cookie.Domain
+	if a.cookie.WeChatDomain != "" && strings.HasSuffix(ctx.Host, a.cookie.WeChatDomain) {
+		domain = a.cookie.WeChatDomain
+	}
+
+	// the callback of form_post (Sign in with Apple) is a cross-site POST request
+	sameSite := http.SameSiteLaxMode
+	if a.cookie.Secure {
+		sameSite = http.SameSiteNoneMode
+	}
+
+	return &http.Cookie{
+		Name:     a.bindingCookieName(),
+		Value:    value,
+		HttpOnly: true,
+		Secure:   a.cookie.Secure,
+		MaxAge:   maxAge,
+		Path:     "/idp/",
+		Domain:   domain,
+		SameSite: sameSite,
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// oidcProvider is the generic OpenID Connect identity provider.
+// The metadata is discovered from the issuer lazily, so the IdP outage will not block the startup.
+type oidcProvider struct {
+	issuer   string
+	claims   conf.ProviderClaims
+	mu       sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+// discoverOIDC discovers the metadata of the OIDC provider and updates the endpoint of the oauth2 config.
+// It returns nil if the idp is not a generic OIDC provider.
+func (a *AuthN) discoverOIDC(ctx context.Context, idp string) (*oidcProvider, error) {
+	p, ok := a.oidcs[idp]
+	if !ok {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifier == nil {
+		util.RegisterUpstream(p.issuer, idp)
+		cctx := oidc.ClientContext(ctx, util.ExternalHTTPClient)
+		provider, err := oidc.NewProvider(cctx, p.issuer)
+		if err != nil {
+			return nil, fmt.Errorf("discover oidc provider %q failed: %v", idp, err)
+		}
+
+		cfg := a.providers[idp]
+		cfg.Endpoint = provider.Endpoint()
+		util.RegisterUpstream(cfg.Endpoint.TokenURL, idp)
+		util.RegisterUpstream(provider.UserInfoEndpoint(), idp)
+		p.provider = provider
+		p.verifier = provider.Verifier(&oidc.Config{ClientID: cfg.ClientID})
+	}
+
+	return p, nil
+}
+
+// exchange verifies the id_token (signature, aud, exp and nonce) and maps the claims to the user.
+func (p *oidcProvider) exchange(ctx context.Context, token *oauth2.Token, nonce string, rt *bll.AuthNInput) error {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return fmt.Errorf("missing id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return err
+	}
+	if idToken.Nonce != nonce {
+		return fmt.Errorf("invalid id_token nonce")
+	}
+
+	claims := make(map[string]json.RawMessage)
+	if err = idToken.Claims(&claims); err != nil {
+		return err
+	}
+
+	// some providers only return the profile claims from the userinfo endpoint
+	if (claimString(claims, p.claims.Name) == "" || claimString(claims, p.claims.Picture) == "") &&
+		p.provider.UserInfoEndpoint() != "" {
+		if info, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token)); err == nil && info.Subject == idToken.Subject {
+			extra := make(map[string]json.RawMessage)
+			if err = info.Claims(&extra); err == nil {
+				for k, v := range extra {
+					if _, ok := claims[k]; !ok {
+						claims[k] = v
+					}
+				}
+			}
+		}
+	}
+
+	rt.Sub = claimString(claims, p.claims.Sub)
+	if rt.Sub == "" {
+		return fmt.Errorf("missing %q claim", p.claims.Sub)
+	}
+	rt.User.Name = claimString(claims, p.claims.Name)
+	rt.User.Picture = claimString(claims, p.claims.Picture)
+	return nil
+}
+
+// claimString returns the string or number claim as a string.
+func claimString(claims map[string]json.RawMessage, name string) string {
+	v, ok := claims[name]
+	if !ok || len(v) == 0 {
+		return ""
+	}
+
+	if v[0] == '"' {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			return s
+		}
+		return ""
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(v, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
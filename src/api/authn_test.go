@@ -0,0 +1,721 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/ldclabs/cose/iana"
+	"github.com/ldclabs/cose/key"
+	"github.com/ldclabs/cose/key/hmac"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestSealState(t *testing.T) {
+	assert := assert.New(t)
+
+	k, err := hmac.GenerateKey(iana.AlgorithmHMAC_256_64)
+	assert.NoError(err)
+	macer, err := hmac.New(k)
+	assert.NoError(err)
+
+	state, err := sealState(macer, statePurposeConsent, key.IntMap{
+		0: time.Now().Add(time.Minute).Unix(),
+		1: "uid",
+	})
+	assert.NoError(err)
+
+	payload, err := openState(macer, statePurposeConsent, state)
+	assert.NoError(err)
+	v, _ := payload.GetString(1)
+	assert.Equal("uid", v)
+
+	_, err = openState(macer, statePurposeCode, state)
+	assert.Error(err, "consent can not be used as code")
+	_, err = openState(macer, "", state)
+	assert.Error(err)
+	_, err = sealState(macer, "", key.IntMap{0: time.Now().Unix()})
+	assert.Error(err)
+
+	state, err = sealState(macer, statePurposeCode, key.IntMap{
+		0: time.Now().Add(-time.Second).Unix(),
+	})
+	assert.NoError(err)
+	_, err = openState(macer, statePurposeCode, state)
+	assert.ErrorContains(err, "expired")
+}
+
+// testIdP is the OpenID Connect provider, its token endpoint checks the PKCE verifier of the code.
+type testIdP struct {
+	*httptest.Server
+	signer jose.Signer
+	jwks   jose.JSONWebKeySet
+
+	mu      sync.Mutex
+	codes   map[string]testIdPCode
+	profile map[string]any // the profile claims of the id_token
+	forms   []url.Values   // the token requests
+}
+
+type testIdPCode struct {
+	challenge string
+	nonce     string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: pk, KeyID: "test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{
+		signer:  signer,
+		jwks:    jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &pk.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}},
+		codes:   make(map[string]testIdPCode),
+		profile: map[string]any{"name": "Alice"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(idp.jwks)
+	})
+	mux.HandleFunc("/picture.png", func(w http.ResponseWriter, r *http.Request) {
+		img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+		for i := range img.Pix {
+			img.Pix[i] = byte(i)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		claims := map[string]any{
+			"iss": idp.URL,
+			"aud": "test-client",
+			"sub": "alice",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		idp.mu.Lock()
+		idp.forms = append(idp.forms, r.PostForm)
+		code, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		for k, v := range idp.profile {
+			claims[k] = v
+		}
+		idp.mu.Unlock()
+		claims["nonce"] = code.nonce
+
+		// the code without challenge is issued to the provider without PKCE, such as Apple
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || (code.challenge != "" && base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		idToken, _ := jwt.Signed(idp.signer).Claims(claims).Serialize()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access_token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	// the IdP is on the loopback address
+	if err = util.AllowOutboundCIDRs([]string{"127.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { util.AllowOutboundCIDRs(conf.Config.Outbound.AllowCIDRs) })
+
+	providers := conf.Config.Providers
+	conf.Config.Providers = map[string]conf.Provider{
+		"testidp": {
+			Kind:         "oidc",
+			Issuer:       idp.URL,
+			ClientID:     "test-client",
+			ClientSecret: "test-secret",
+			RedirectURL:  "https://auth.yiwen.ltd/idp/testidp/callback",
+			Scopes:       []string{"openid", "profile"},
+			Claims:       conf.ProviderClaims{Sub: "sub", Name: "name", Picture: "picture"},
+		},
+	}
+	t.Cleanup(func() { conf.Config.Providers = providers })
+	return idp
+}
+
+// setProfile sets the profile claims of the id_tokens.
+func (idp *testIdP) setProfile(profile map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.profile = profile
+}
+
+// login logs in through the IdP and returns the status of the callback.
+func (idp *testIdP) login(t *testing.T, srv *httptest.Server) string {
+	get := func(path string, cookies ...*http.Cookie) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res := get("/idp/testidp/authorize?next_url=" + url.QueryEscape("https://www.yiwen.ltd/home"))
+	u, err := url.Parse(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	q := u.Query()
+	res = get("/idp/testidp/callback?"+url.Values{
+		"code":  {idp.issueCode(q.Get("code_challenge"), q.Get("nonce"))},
+		"state": {q.Get("state")},
+	}.Encode(), testCookie(res, "_OAUTH"))
+	u, err = url.Parse(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	return u.Query().Get("status")
+}
+
+// issueCode issues the authorization code bound to the PKCE challenge and the id_token nonce.
+func (idp *testIdP) issueCode(challenge, nonce string) string {
+	code := util.NewID()
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.codes[code.String()] = testIdPCode{challenge: challenge, nonce: nonce}
+	return code.String()
+}
+
+func TestIdPLogin(t *testing.T) {
+	assert := assert.New(t)
+
+	idp := newTestIdP(t)
+	up := newTestUpstream(t)
+	uid := util.NewID()
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID: util.NewID(), UID: &uid, Session: "session",
+		}}
+	})
+	rl := conf.Config.RateLimit.Enabled
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.RateLimit.Enabled = rl })
+	srv, _ := newTestServer(t, up, nil, nil)
+
+	get := func(path string, cookies ...*http.Cookie) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	status := func(res *http.Response) string {
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		return u.Query().Get("status")
+	}
+
+	// authorize returns the redirect to the IdP with the PKCE challenge, the nonce and the binding cookie
+	authorize := func() (url.Values, *http.Cookie) {
+		res := get("/idp/testidp/authorize?next_url=" + url.QueryEscape("https://www.yiwen.ltd/home"))
+		assert.Equal(http.StatusFound, res.StatusCode)
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		assert.Equal(idp.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path, res.Header.Get("Location"))
+		cookie := testCookie(res, "_OAUTH")
+		assert.NotNil(cookie)
+		assert.True(cookie.HttpOnly)
+		assert.Equal("/idp/", cookie.Path)
+		return u.Query(), cookie
+	}
+	callback := func(q url.Values, code string, cookies ...*http.Cookie) *http.Response {
+		return get("/idp/testidp/callback?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), cookies...)
+	}
+
+	t.Run("login", func(t *testing.T) {
+		q, cookie := authorize()
+		assert.Equal("S256", q.Get("code_challenge_method"))
+		assert.NotEmpty(q.Get("code_challenge"))
+		assert.NotEmpty(q.Get("nonce"))
+
+		res := callback(q, idp.issueCode(q.Get("code_challenge"), q.Get("nonce")), cookie)
+		assert.Equal(http.StatusFound, res.StatusCode)
+		assert.Equal("200", status(res))
+		assert.NotNil(testCookie(res, "_SESS"))
+		assert.Equal(-1, testCookie(res, "_OAUTH").MaxAge, "the binding cookie is cleared")
+		assert.Equal(1, up.Calls("POST /v1/authn/login_or_new"))
+	})
+
+	t.Run("missing binding cookie", func(t *testing.T) {
+		q, _ := authorize()
+		res := callback(q, idp.issueCode(q.Get("code_challenge"), q.Get("nonce")))
+		assert.Equal("403", status(res))
+	})
+
+	t.Run("binding of another login", func(t *testing.T) {
+		q, _ := authorize()
+		_, other := authorize()
+		res := callback(q, idp.issueCode(q.Get("code_challenge"), q.Get("nonce")), other)
+		assert.Equal("403", status(res))
+	})
+
+	t.Run("injected code", func(t *testing.T) {
+		// the code was issued to another login, the verifier of this login does not match its challenge
+		q, cookie := authorize()
+		other, _ := authorize()
+		res := callback(q, idp.issueCode(other.Get("code_challenge"), q.Get("nonce")), cookie)
+		assert.Equal("403", status(res))
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		q, cookie := authorize()
+		res := callback(q, idp.issueCode(q.Get("code_challenge"), "other"), cookie)
+		assert.Equal("403", status(res))
+	})
+
+	t.Run("state of another provider", func(t *testing.T) {
+		q, cookie := authorize()
+		res := get("/idp/github/callback?"+url.Values{"code": {"code"}, "state": {q.Get("state")}}.Encode(), cookie)
+		assert.Equal("400", status(res), "github is not configured")
+		res = get("/idp/testidp/callback?"+url.Values{"code": {"code"}, "state": {"invalid"}}.Encode(), cookie)
+		assert.Equal("403", status(res))
+	})
+
+	assert.Equal(1, up.Calls("POST /v1/authn/login_or_new"))
+}
+
+func TestIdPLink(t *testing.T) {
+	assert := assert.New(t)
+
+	idp := newTestIdP(t)
+	up := newTestUpstream(t)
+	uid := util.NewID()
+	up.Handle("POST /v1/authn/link", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNOutput]{Result: bll.AuthNOutput{
+			Idp: "testidp", Sub: "alice", UID: &uid,
+		}}
+	})
+	rl := conf.Config.RateLimit.Enabled
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.RateLimit.Enabled = rl })
+	srv, apis := newTestServer(t, up, nil, nil)
+	cookie, sid := loginTestSession(up, uid)
+
+	get := func(path string, cookies ...*http.Cookie) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	location := func(res *http.Response) *url.URL {
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		return u
+	}
+	authorize := "/idp/testidp/authorize?link=1&next_url=" + url.QueryEscape("https://www.yiwen.ltd/home")
+
+	t.Run("without session", func(t *testing.T) {
+		res := get(authorize)
+		assert.Equal("401", location(res).Query().Get("status"))
+	})
+
+	t.Run("without step-up", func(t *testing.T) {
+		res := get(authorize, cookie)
+		assert.Equal("403", location(res).Query().Get("status"))
+		assert.Equal(0, up.Calls("POST /v1/authn/link"))
+	})
+
+	t.Run("after step-up", func(t *testing.T) {
+		stepUpTestSession(t, apis, sid, AALMultiFactor)
+		res := get(authorize, cookie)
+		u := location(res)
+		assert.Equal(idp.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+
+		q := u.Query()
+		res = get("/idp/testidp/callback?"+url.Values{
+			"code":  {idp.issueCode(q.Get("code_challenge"), q.Get("nonce"))},
+			"state": {q.Get("state")},
+		}.Encode(), testCookie(res, "_OAUTH"))
+		assert.Equal("200", location(res).Query().Get("status"))
+		assert.Equal(1, up.Calls("POST /v1/authn/link"))
+	})
+}
+
+func TestAppleLogin(t *testing.T) {
+	assert := assert.New(t)
+
+	idp := newTestIdP(t)
+	idp.setProfile(map[string]any{}) // the name is not in the id_token of Apple
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	conf.Config.Providers["apple"] = conf.Provider{
+		Kind:        "oidc",
+		Issuer:      idp.URL,
+		ClientID:    "test-client",
+		RedirectURL: "https://auth.yiwen.ltd/idp/apple/callback",
+		Scopes:      []string{"openid", "name"},
+		Claims:      conf.ProviderClaims{Sub: "sub"},
+		TeamID:      "TEAMID",
+		KeyID:       "KEYID",
+		PrivateKey:  pk,
+	}
+
+	up := newTestUpstream(t)
+	uid := util.NewID()
+	var mu sync.Mutex
+	var names []string
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		input := &bll.AuthNInput{}
+		cbor.Unmarshal(body, input)
+		mu.Lock()
+		names = append(names, input.User.Name)
+		mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID: util.NewID(), UID: &uid, Session: "session",
+		}}
+	})
+	rl := conf.Config.RateLimit.Enabled
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.RateLimit.Enabled = rl })
+	srv, _ := newTestServer(t, up, nil, nil)
+
+	// login posts the callback form as Apple does with response_mode=form_post
+	login := func(user string) *http.Response {
+		res, err := testClient.Get(srv.URL + "/idp/apple/authorize?next_url=" + url.QueryEscape("https://www.yiwen.ltd/home"))
+		assert.NoError(err)
+		res.Body.Close()
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		q := u.Query()
+		assert.Equal("form_post", q.Get("response_mode"))
+		assert.Equal("", q.Get("code_challenge"), "Apple does not support PKCE")
+		assert.NotEmpty(q.Get("nonce"))
+
+		form := url.Values{"code": {idp.issueCode("", q.Get("nonce"))}, "state": {q.Get("state")}}
+		if user != "" {
+			form.Set("user", user)
+		}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/idp/apple/callback", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(testCookie(res, "_OAUTH"))
+		res, err = testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	status := func(res *http.Response) string {
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		return u.Query().Get("status")
+	}
+
+	t.Run("first authorization", func(t *testing.T) {
+		res := login(`{"name":{"firstName":"Jane","lastName":"Doe"},"email":"jane@example.com"}`)
+		assert.Equal("200", status(res))
+		assert.NotNil(testCookie(res, "_SESS"))
+		assert.Equal([]string{"Jane Doe"}, names)
+
+		// the client secret is the ES256 JWT signed by the .p8 key
+		idp.mu.Lock()
+		form := idp.forms[len(idp.forms)-1]
+		idp.mu.Unlock()
+		assert.Equal("test-client", form.Get("client_id"))
+		token, err := jwt.ParseSigned(form.Get("client_secret"), []jose.SignatureAlgorithm{jose.ES256})
+		assert.NoError(err)
+		assert.Equal("KEYID", token.Headers[0].KeyID)
+		claims := jwt.Claims{}
+		assert.NoError(token.Claims(&pk.PublicKey, &claims))
+		assert.NoError(claims.Validate(jwt.Expected{
+			Issuer:      "TEAMID",
+			Subject:     "test-client",
+			AnyAudience: jwt.Audience{"https://appleid.apple.com"},
+		}))
+	})
+
+	t.Run("later authorization", func(t *testing.T) {
+		// Apple sends the name only on the first authorization, the name falls back to the sub
+		res := login("")
+		assert.Equal("200", status(res))
+		assert.Equal([]string{"Jane Doe", "alice"}, names)
+	})
+
+	t.Run("invalid state", func(t *testing.T) {
+		form := url.Values{"code": {"code"}, "state": {"invalid"}}
+		res, err := testClient.PostForm(srv.URL+"/idp/apple/callback", form)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal("403", status(res))
+		assert.Len(names, 2)
+	})
+}
+
+func TestTokenReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	idp := newTestIdP(t)
+	up := newTestUpstream(t)
+	uid := util.NewID()
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID: util.NewID(), UID: &uid, Session: "session",
+		}}
+	})
+	var mu sync.Mutex
+	replays := 0
+	up.Handle("POST /v1/log", func(body []byte) (int, any) {
+		if strings.Contains(string(body), bll.LogActionSysReplayToken) {
+			mu.Lock()
+			replays++
+			mu.Unlock()
+		}
+		return http.StatusOK, bll.SuccessResponse[bll.LogOutput]{}
+	})
+	rl := conf.Config.RateLimit.Enabled
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.RateLimit.Enabled = rl })
+	srv, apis := newTestServer(t, up, nil, nil)
+
+	get := func(path string, cookies ...*http.Cookie) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	status := func(res *http.Response) string {
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		return u.Query().Get("status")
+	}
+	replayed := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return replays
+	}
+
+	t.Run("login state", func(t *testing.T) {
+		res := get("/idp/testidp/authorize?next_url=" + url.QueryEscape("https://www.yiwen.ltd/home"))
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		q := u.Query()
+		cookie := testCookie(res, "_OAUTH")
+		callback := "/idp/testidp/callback?" + url.Values{
+			"code":  {idp.issueCode(q.Get("code_challenge"), q.Get("nonce"))},
+			"state": {q.Get("state")},
+		}.Encode()
+
+		res = get(callback, cookie)
+		assert.Equal("200", status(res))
+
+		// the binding cookie was copied with the state
+		res = get(callback, cookie)
+		assert.Equal("403", status(res))
+		assert.Nil(testCookie(res, "_SESS"))
+		assert.Equal(1, up.Calls("POST /v1/authn/login_or_new"))
+		assert.Equal(1, replayed())
+	})
+
+	t.Run("sync session", func(t *testing.T) {
+		mu.Lock()
+		replays = 0
+		mu.Unlock()
+
+		sid := util.NewID()
+		sess, err := sealState(apis.AuthN.stateMACer, statePurposeSyncSession, key.IntMap{
+			0: time.Now().Add(20 * time.Second).Unix(),
+			1: sid.String(),
+			2: "session",
+			3: "https://www.yiwen.ltd/home",
+		})
+		assert.NoError(err)
+
+		res := get("/sync_session?sess=" + url.QueryEscape(sess))
+		assert.Equal(http.StatusFound, res.StatusCode)
+		assert.Equal("session", testCookie(res, "_SESS").Value)
+
+		res = get("/sync_session?sess=" + url.QueryEscape(sess))
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+		assert.Nil(testCookie(res, "_SESS"))
+		assert.Equal(1, replayed())
+	})
+}
+
+func TestSessionState(t *testing.T) {
+	assert := assert.New(t)
+
+	newTestIdP(t)
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+
+	get := func(path string) *http.Response {
+		res, err := testClient.Get(srv.URL + path)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	seal := func(purpose string, exp time.Time, payload key.IntMap) string {
+		payload[0] = exp.Unix()
+		state, err := sealState(apis.AuthN.stateMACer, purpose, payload)
+		assert.NoError(err)
+		return state
+	}
+	sid := util.NewID()
+	sess := func(purpose string, exp time.Time) string {
+		return seal(purpose, exp, key.IntMap{1: sid.String(), 2: "session", 3: "https://www.yiwen.ltd/home"})
+	}
+
+	t.Run("sync session", func(t *testing.T) {
+		res := get("/sync_session?sess=" + url.QueryEscape(sess(statePurposeSyncSession, time.Now().Add(-time.Second))))
+		assert.Equal(http.StatusBadRequest, res.StatusCode, "expired")
+		assert.Nil(testCookie(res, "_SESS"))
+
+		res = get("/sync_session?sess=" + url.QueryEscape(sess(statePurposeLogin, time.Now().Add(time.Minute))))
+		assert.Equal(http.StatusBadRequest, res.StatusCode, "sealed for another purpose")
+		assert.Nil(testCookie(res, "_SESS"))
+
+		res = get("/sync_session?sess=" + url.QueryEscape(sess(statePurposeSyncSession, time.Now().Add(time.Minute))))
+		assert.Equal(http.StatusFound, res.StatusCode)
+		assert.Equal("session", testCookie(res, "_SESS").Value)
+	})
+
+	t.Run("login", func(t *testing.T) {
+		status := func(state string) string {
+			res := get("/idp/testidp/callback?" + url.Values{"code": {"code"}, "state": {state}}.Encode())
+			u, err := url.Parse(res.Header.Get("Location"))
+			assert.NoError(err)
+			return u.Query().Get("status")
+		}
+		login := func(purpose string, exp time.Time) string {
+			return seal(purpose, exp, key.IntMap{1: "testidp", 2: "https://www.yiwen.ltd/home", 3: []byte("binding")})
+		}
+
+		assert.Equal("403", status(login(statePurposeLogin, time.Now().Add(-time.Second))), "expired")
+		assert.Equal("403", status(login(statePurposeConsent, time.Now().Add(time.Minute))), "sealed for another purpose")
+		assert.Equal("403", status(login(statePurposeLogin, time.Now().Add(time.Minute))), "missing binding cookie")
+		assert.Equal(0, up.Calls("POST /v1/authn/login_or_new"))
+	})
+}
+
+func TestIdPProfileSync(t *testing.T) {
+	assert := assert.New(t)
+
+	idp := newTestIdP(t)
+	up := newTestUpstream(t)
+	uid := util.NewID()
+	var mu sync.Mutex
+	var logins []bll.AuthNInput
+	var calls []string
+	var users []bll.UpdateUserInput
+	failUser := false
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		input := bll.AuthNInput{}
+		cbor.Unmarshal(body, &input)
+		mu.Lock()
+		logins = append(logins, input)
+		mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID: util.NewID(), UID: &uid, Session: "session", Name: "bob", SyncProfile: util.Ptr(true),
+		}}
+	})
+	up.Handle("PATCH /v1/user", func(body []byte) (int, any) {
+		input := bll.UpdateUserInput{}
+		cbor.Unmarshal(body, &input)
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, "user")
+		users = append(users, input)
+		if failUser {
+			return http.StatusInternalServerError, map[string]string{"error": "failed"}
+		}
+		return http.StatusOK, bll.SuccessResponse[bll.UserInfo]{Result: bll.UserInfo{}}
+	})
+	up.Handle("PATCH /v1/group", func(body []byte) (int, any) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, "group")
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+	})
+	rl := conf.Config.RateLimit.Enabled
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.RateLimit.Enabled = rl })
+	srv, _ := newTestServer(t, up, nil, nil)
+
+	synced := func(n int) []string {
+		assert.Eventually(func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(calls) >= n
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Eventually(conf.Config.JobsIdle, time.Second, 10*time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+
+	// the IdP responds no name, the subject only names the new user
+	idp.setProfile(map[string]any{"picture": idp.URL + "/picture.png"})
+	assert.Equal("200", idp.login(t, srv))
+	assert.Equal([]string{"user", "group"}, synced(2), "the user is updated before the group logo")
+	mu.Lock()
+	assert.Equal("alice", logins[0].User.Name)
+	assert.Equal("", users[0].Name, "the user is not renamed to the subject")
+	assert.Contains(users[0].Picture, "http://localhost:8080/files/")
+	calls, users, failUser = nil, nil, true
+	mu.Unlock()
+
+	// the group logo is not updated if the user update fails
+	idp.setProfile(map[string]any{"name": "Alice", "picture": idp.URL + "/picture.png"})
+	assert.Equal("200", idp.login(t, srv))
+	assert.Equal([]string{"user"}, synced(1))
+	mu.Lock()
+	assert.Equal("Alice", users[0].Name)
+	mu.Unlock()
+}
@@ -48,6 +48,14 @@ func (a *AuthN) COSERenewKEK(ctx *gear.Context) error {
 		return err
 	}
 
+	ctx.OnEnd(func() {
+		outcome := "success"
+		if ctx.Res.Status() >= 400 {
+			outcome = "failure"
+		}
+		util.MetricKEKRenewals.WithLabelValues(outcome).Inc()
+	})
+
 	output := &RenewKEKOutput{}
 	if input.State != nil {
 		output.State = *input.State
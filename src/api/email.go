@@ -0,0 +1,352 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ldclabs/cose/key"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/service"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+const (
+	maxEmailSends        = 5 // per email address in emailSendWindow
+	emailSendWindow      = 10 * time.Minute
+	maxEmailCodeAttempts = 5
+	emailCodeDigits      = 6
+	emailLinkStateKind   = "email"
+	emailChallengeKind   = "email_code"
+)
+
+type EmailStartInput struct {
+	Email   string `json:"email" cbor:"email" form:"email" validate:"required,email,lte=254"`
+	NextURL string `json:"next_url" cbor:"next_url" form:"next_url"`
+}
+
+func (i *EmailStartInput) Validate() error {
+	i.Email = strings.ToLower(strings.TrimSpace(i.Email))
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+	return nil
+}
+
+type EmailStartOutput struct {
+	// The challenge should be sent back with the code to POST /email/verify.
+	Challenge string `json:"challenge"`
+	ExpiresIn uint   `json:"expires_in"`
+}
+
+type EmailVerifyInput struct {
+	Challenge string `json:"challenge" cbor:"challenge" form:"challenge"`
+	Code      string `json:"code" cbor:"code" form:"code"`
+}
+
+func (i *EmailVerifyInput) Validate() error {
+	if i.Challenge == "" || i.Code == "" {
+		return gear.ErrBadRequest.WithMsg("challenge and code required")
+	}
+	return nil
+}
+
+// emailLogin is the login started by EmailStart, the link and the code share the same id,
+// so only one of them can be used.
+type emailLogin struct {
+	email   string
+	id      []byte
+	nextURL string
+	codeMAC []byte
+}
+
+// EmailStart sends the mail with the login link and the one-time code.
+func (a *AuthN) EmailStart(ctx *gear.Context) error {
+	input := &EmailStartInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	nextURL, ok := a.authURL.CheckNextUrl(input.NextURL)
+	if !ok {
+		return gear.ErrBadRequest.WithMsgf("invalid next_url %q", input.NextURL)
+	}
+
+	if n, err := a.nonces.Incr(ctx, "email_send:"+input.Email, emailSendWindow); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if n > maxEmailSends {
+		return gear.ErrTooManyRequests.WithMsg("too many mails, please try again later")
+	}
+
+	code, err := randomDigits(emailCodeDigits)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	id := key.GetRandomBytes(16)
+	codeMAC, err := a.stateMACer.MACCreate(oneTimeCodeData(emailChallengeKind, id, code))
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	exp := time.Now().Add(a.emailTTL()).Unix()
+	token, err := sealState(a.stateMACer, statePurposeEmailLink, key.IntMap{
+		0: exp,
+		1: emailLinkStateKind,
+		2: input.Email,
+		3: id,
+		4: nextURL.String(),
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	challenge, err := sealState(a.stateMACer, statePurposeEmailChallenge, key.IntMap{
+		0: exp,
+		1: emailChallengeKind,
+		2: input.Email,
+		3: id,
+		4: nextURL.String(),
+		5: codeMAC,
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	minutes := a.email.ExpiresIn / 60
+	if err = a.mailer.Send(ctx, &service.Mail{
+		To:      input.Email,
+		Subject: fmt.Sprintf("%s: %s", a.email.Subject, code),
+		Text: fmt.Sprintf("Your sign-in code is %s.\n\nOr sign in with the link:\n%s\n\nThe code and the link expire in %d minutes and can be used only once. If you did not request this, please ignore this mail.\n",
+			code, a.email.VerifyURL+"?token="+url.QueryEscape(token), minutes),
+	}); err != nil {
+		logging.SetTo(ctx, "error", fmt.Sprintf("send mail failed: %v", err))
+		return gear.ErrBadGateway.WithMsg("failed to send mail")
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[EmailStartOutput]{Result: EmailStartOutput{
+		Challenge: challenge,
+		ExpiresIn: a.email.ExpiresIn,
+	}})
+}
+
+// emailConfirmPage asks the user to confirm the login, so the link prefetched by the mail scanners is not consumed.
+var emailConfirmPage = template.Must(template.New("email_confirm").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+</head>
+<body>
+<form method="post" action="/email/confirm">
+<p>Sign in as {{.Email}}?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+type EmailConfirmInput struct {
+	Token string `json:"token" cbor:"token" form:"token"`
+}
+
+func (i *EmailConfirmInput) Validate() error {
+	if i.Token == "" {
+		return gear.ErrBadRequest.WithMsg("token required")
+	}
+	return nil
+}
+
+// EmailVerify renders the page to confirm the login with the magic link in the mail.
+func (a *AuthN) EmailVerify(ctx *gear.Context) error {
+	token := ctx.Query("token")
+	login, err := a.openEmailLogin(token, emailLinkStateKind)
+	if err != nil {
+		next := a.authURL.GenNextUrl(nil, 403, ctx.GetHeader(gear.HeaderXRequestID))
+		logging.SetTo(ctx, "error", fmt.Sprintf("invalid token: %v", err))
+		return ctx.Redirect(next)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = emailConfirmPage.Execute(buf, map[string]string{"Email": login.email, "Token": token}); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	ctx.SetHeader(gear.HeaderCacheControl, "no-store")
+	ctx.SetHeader("Referrer-Policy", "no-referrer")
+	return ctx.HTML(http.StatusOK, buf.String())
+}
+
+// EmailConfirm logs in with the magic link confirmed on the EmailVerify page, and redirects to the next_url.
+func (a *AuthN) EmailConfirm(ctx *gear.Context) error {
+	xid := ctx.GetHeader(gear.HeaderXRequestID)
+	if origin := ctx.GetHeader(gear.HeaderOrigin); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != ctx.Host {
+			return gear.ErrForbidden.WithMsgf("invalid origin %q", origin)
+		}
+	}
+
+	input := &EmailConfirmInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	login, err := a.openEmailLogin(input.Token, emailLinkStateKind)
+	if err != nil {
+		failAttempt(ctx)
+		next := a.authURL.GenNextUrl(nil, 403, xid)
+		logging.SetTo(ctx, "error", fmt.Sprintf("invalid token: %v", err))
+		return ctx.Redirect(next)
+	}
+
+	nextURL, _ := a.authURL.CheckNextUrl(login.nextURL)
+	res, pending, err := a.loginWithCode(ctx, "email", login.id, a.emailTTL(), emailLoginInput(login.email), login.nextURL)
+	if err != nil {
+		next := a.authURL.GenNextUrl(&nextURL, gear.ParseError(err).Status(), xid)
+		logging.SetTo(ctx, "error", err.Error())
+		return ctx.Redirect(next)
+	}
+
+	next := a.authURL.GenNextUrl(&nextURL, 200, "")
+	if pending {
+		next = a.mfaVerifyURL(next)
+	} else {
+		a.setSessionCookies(ctx, a.cookieDomain(ctx), res.SID, res.Session, AALSingleFactor, "email")
+	}
+	logging.SetTo(ctx, "redirect_url", next)
+	ctx.Status(http.StatusSeeOther)
+	return ctx.Redirect(next)
+}
+
+// EmailVerifyCode logs in with the one-time code in the mail.
+func (a *AuthN) EmailVerifyCode(ctx *gear.Context) error {
+	input := &EmailVerifyInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	login, err := a.openEmailLogin(input.Challenge, emailChallengeKind)
+	if err != nil {
+		failAttempt(ctx)
+		logging.SetTo(ctx, "error", err.Error())
+		return gear.ErrUnauthorized.WithMsg("invalid or expired challenge, please try again")
+	}
+	if err = lockoutSubject(ctx, "email", login.email); err != nil {
+		return err
+	}
+
+	if n, err := a.nonces.Incr(ctx, "email_code:"+util.Bytes(login.id).String()+":attempts", a.emailTTL()); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if n > maxEmailCodeAttempts {
+		return gear.ErrTooManyRequests.WithMsg("too many attempts, please try again")
+	}
+	if err = a.stateMACer.MACVerify(oneTimeCodeData(emailChallengeKind, login.id, strings.TrimSpace(input.Code)), login.codeMAC); err != nil {
+		util.MetricLogins.WithLabelValues("email", "failure").Inc()
+		failAttempt(ctx)
+		return gear.ErrForbidden.WithMsg("invalid code")
+	}
+
+	output, pending, err := a.loginWithCode(ctx, "email", login.id, a.emailTTL(), emailLoginInput(login.email), login.nextURL)
+	if err != nil {
+		return err
+	}
+	return a.sendCodeLogin(ctx, output, pending, "email")
+}
+
+func (a *AuthN) openEmailLogin(state, kind string) (*emailLogin, error) {
+	payload, err := openState(a.stateMACer, kind, state)
+	if err != nil {
+		return nil, err
+	}
+	if v, _ := payload.GetString(1); v != kind {
+		return nil, fmt.Errorf("unexpected state kind %q", v)
+	}
+
+	login := &emailLogin{}
+	login.email, _ = payload.GetString(2)
+	login.id, _ = payload.GetBytes(3)
+	login.nextURL, _ = payload.GetString(4)
+	login.codeMAC, _ = payload.GetBytes(5)
+	if login.email == "" || len(login.id) == 0 {
+		return nil, fmt.Errorf("invalid email state")
+	}
+	return login, nil
+}
+
+func (a *AuthN) emailTTL() time.Duration {
+	return time.Duration(a.email.ExpiresIn) * time.Second
+}
+
+func emailLoginInput(email string) *bll.AuthNInput {
+	name, _, _ := strings.Cut(email, "@")
+	if len(name) < 2 {
+		name = email
+	}
+	return &bll.AuthNInput{
+		Idp:  "email",
+		Aud:  "email",
+		Sub:  email,
+		User: bll.UserInfo{Name: name},
+	}
+}
+
+// loginWithCode consumes the one-time login and creates the session, it returns true if the second factor is required.
+func (a *AuthN) loginWithCode(ctx *gear.Context, kind string, id []byte, ttl time.Duration, input *bll.AuthNInput, nextURL string) (*bll.AuthNSessionOutput, bool, error) {
+	if err := consumeToken(ctx, a.blls, a.nonces, kind, string(id), ttl); err != nil {
+		failAttempt(ctx)
+		return nil, false, gear.ErrForbidden.From(err)
+	}
+
+	a.fillDevice(ctx, input)
+	res, err := a.blls.AuthN.LoginOrNew(ctx, input)
+	if err != nil {
+		util.MetricLogins.WithLabelValues(input.Idp, "failure").Inc()
+		return nil, false, gear.ErrInternalServerError.WithMsgf("AuthN.LoginOrNew failed: %v", err)
+	}
+	a.logLogin(ctx, input, res)
+
+	// the login is pending until the second factor is verified
+	next, _ := a.authURL.CheckNextUrl(nextURL)
+	pending, err := a.startMFA(ctx, *res.UID, res.SID.String(), res.Session, a.authURL.GenNextUrl(&next, 200, ""))
+	if err != nil {
+		return nil, false, gear.ErrInternalServerError.WithMsgf("startMFA failed: %v", err)
+	}
+	return res, pending, nil
+}
+
+// sendCodeLogin responds the login like the passkey login, the session is kept in the cookies.
+func (a *AuthN) sendCodeLogin(ctx *gear.Context, output *bll.AuthNSessionOutput, pending bool, method string) error {
+	if pending {
+		output.SID = util.ZeroID
+		output.Session = ""
+		output.UID = nil
+		output.MFARequired = true
+		return ctx.OkSend(output)
+	}
+
+	a.setSessionCookies(ctx, a.cookieDomain(ctx), output.SID, output.Session, AALSingleFactor, method)
+	output.UID = nil
+	return ctx.OkSend(output)
+}
+
+// oneTimeCodeData binds the code to the login id, so the code can not be used for other logins.
+func oneTimeCodeData(kind string, id []byte, code string) []byte {
+	return []byte(kind + ":" + util.Bytes(id).String() + ":" + code)
+}
+
+func randomDigits(n int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", n, v), nil
+}
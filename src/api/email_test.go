@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/service"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+type testMailer struct {
+	mu    sync.Mutex
+	mails []*service.Mail
+}
+
+func (m *testMailer) Send(ctx context.Context, mail *service.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mails = append(m.mails, mail)
+	return nil
+}
+
+func TestEmailLink(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID:     util.NewID(),
+			UID:     util.Ptr(util.NewID()),
+			Session: "session",
+		}}
+	})
+	mailer := &testMailer{}
+	srv, _ := newTestServer(t, up, mailer, &service.LogSMS{})
+
+	res, err := http.Post(srv.URL+"/email/start", "application/json", strings.NewReader(`{"email":"Alice@Example.com"}`))
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Len(mailer.mails, 1)
+	mail := mailer.mails[0]
+	assert.Equal("alice@example.com", mail.To)
+	assert.Regexp(`^Yiwen sign-in code: \d{6}$`, mail.Subject)
+
+	m := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(mail.Text)
+	assert.Len(m, 2)
+	token, err := url.QueryUnescape(m[1])
+	assert.NoError(err)
+
+	// the page does not consume the token
+	for i := 0; i < 2; i++ {
+		res, err = testClient.Get(srv.URL + "/email/verify?token=" + url.QueryEscape(token))
+		assert.NoError(err)
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Contains(string(data), "alice@example.com")
+		assert.Contains(string(data), `action="/email/confirm"`)
+	}
+	assert.Equal(0, up.Calls("POST /v1/authn/login_or_new"))
+
+	res, err = testClient.Get(srv.URL + "/email/verify?token=invalid")
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusFound, res.StatusCode)
+	assert.Contains(res.Header.Get("Location"), "status=403")
+
+	form := url.Values{"token": {token}}.Encode()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/email/confirm", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.com")
+	res, err = testClient.Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusForbidden, res.StatusCode)
+
+	res, err = testClient.Post(srv.URL+"/email/confirm", "application/x-www-form-urlencoded", strings.NewReader(form))
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusSeeOther, res.StatusCode)
+	assert.Contains(res.Header.Get("Location"), "status=200")
+	assert.Equal("session", testCookie(res, "_SESS").Value)
+	assert.Equal(1, up.Calls("POST /v1/authn/login_or_new"))
+
+	// the link can be used only once
+	res, err = testClient.Post(srv.URL+"/email/confirm", "application/x-www-form-urlencoded", strings.NewReader(form))
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Contains(res.Header.Get("Location"), "status=403")
+	assert.Equal(1, up.Calls("POST /v1/authn/login_or_new"))
+}
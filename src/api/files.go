@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/teambition/gear"
+)
+
+// Files serves the objects of the local object store, it is for development.
+type Files struct {
+	dir http.Dir
+}
+
+// Get ..
+func (a *Files) Get(ctx *gear.Context) error {
+	name := "/" + ctx.Param("filepath")
+	f, err := a.dir.Open(name)
+	if err != nil {
+		return gear.ErrNotFound.WithMsgf("%q not found", name)
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil || st.IsDir() {
+		return gear.ErrNotFound.WithMsgf("%q not found", name)
+	}
+
+	ctx.SetHeader(gear.HeaderCacheControl, "public, max-age=3600")
+	http.ServeContent(ctx.Res, ctx.Req, name, st.ModTime(), f)
+	return nil
+}
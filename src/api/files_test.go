@@ -0,0 +1,45 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	dir := apis.Healthz.oss.LocalDir()
+	assert.NotEmpty(dir)
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "pic"), 0o700))
+	assert.NoError(os.WriteFile(filepath.Join(dir, "pic", "64.jpg"), []byte("jpeg"), 0o600))
+	assert.NoError(os.WriteFile(filepath.Join(filepath.Dir(dir), "secret"), []byte("the secret data"), 0o600))
+
+	get := func(path string) (int, string, http.Header) {
+		res, err := testClient.Get(srv.URL + path)
+		assert.NoError(err)
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(data), res.Header
+	}
+
+	code, body, header := get("/files/pic/64.jpg")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("jpeg", body)
+	assert.Equal("image/jpeg", header.Get("Content-Type"))
+	assert.Equal("public, max-age=3600", header.Get("Cache-Control"))
+
+	code, _, _ = get("/files/pic/32.jpg")
+	assert.Equal(http.StatusNotFound, code)
+	code, _, _ = get("/files/pic")
+	assert.Equal(http.StatusNotFound, code, "directories are not listed")
+	code, body, _ = get("/files/%2e%2e/secret")
+	assert.Equal(http.StatusNotFound, code, "the files outside the directory")
+	assert.NotContains(body, "the secret data")
+}
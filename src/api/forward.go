@@ -0,0 +1,98 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+)
+
+// ForwardAuth verifies the session for the gateway, such as nginx auth_request and Traefik ForwardAuth.
+// https://nginx.org/en/docs/http/ngx_http_auth_request_module.html
+// https://doc.traefik.io/traefik/middlewares/http/forwardauth/
+type ForwardAuth struct {
+	session *Session
+	authURL *conf.AuthURL
+	idp     string
+	base    string
+}
+
+func NewForwardAuth(session *Session, cfg *conf.ConfigTpl) *ForwardAuth {
+	return &ForwardAuth{
+		session: session,
+		authURL: &cfg.AuthURL,
+		idp:     cfg.ForwardAuth.Idp,
+		base:    cfg.OAuth2.Issuer,
+	}
+}
+
+// Verify responds 200 with the user headers if the session is valid.
+// Otherwise, it responds 302 to the IdP login for browser navigation, or 401.
+func (a *ForwardAuth) Verify(ctx *gear.Context) error {
+	output, err := a.session.verify(ctx)
+	if err == nil {
+		ctx.SetHeader("X-Auth-User", output.UID.String())
+		ctx.SetHeader("X-Auth-Sub", output.Sub.String())
+		ctx.SetHeader("X-Session-Id", output.SID.String())
+		return ctx.End(http.StatusOK)
+	}
+
+	logging.SetTo(ctx, "error", err.Error())
+	idp := ctx.Query("idp")
+	if idp == "" {
+		idp = a.idp
+	}
+
+	method := ctx.GetHeader("X-Forwarded-Method")
+	if idp == "" || (method != "" && method != http.MethodGet) ||
+		!strings.Contains(ctx.GetHeader(gear.HeaderAccept), gear.MIMETextHTML) {
+		return gear.ErrUnauthorized.WithMsg("invalid session")
+	}
+
+	next := forwardedURL(ctx)
+	if next == "" {
+		return gear.ErrUnauthorized.WithMsg("invalid session")
+	}
+
+	nextURL, ok := a.authURL.CheckNextUrl(next)
+	if !ok {
+		logging.SetTo(ctx, "error", fmt.Sprintf("invalid forwarded url %q", next))
+		return gear.ErrUnauthorized.WithMsg("invalid session")
+	}
+
+	loginURL := fmt.Sprintf("%s/idp/%s/authorize?next_url=%s", a.base, url.PathEscape(idp), url.QueryEscape(nextURL.String()))
+	logging.SetTo(ctx, "redirect_url", loginURL)
+	return ctx.Redirect(loginURL)
+}
+
+// forwardedURL rebuilds the original request URL from the headers set by the gateway.
+func forwardedURL(ctx *gear.Context) string {
+	// nginx ingress sets the full original URL
+	if v := ctx.GetHeader("X-Original-URL"); v != "" {
+		return v
+	}
+
+	host := ctx.GetHeader(gear.HeaderXForwardedHost)
+	if host == "" {
+		return ""
+	}
+
+	proto := ctx.GetHeader(gear.HeaderXForwardedProto)
+	if proto == "" {
+		proto = "https"
+	}
+
+	uri := ctx.GetHeader("X-Forwarded-Uri")
+	if uri == "" {
+		uri = ctx.GetHeader("X-Original-URI")
+	}
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return proto + "://" + host + uri
+}
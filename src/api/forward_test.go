@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestForwardAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	sign := testTokenSigner(t, apis)
+	uid, sid, sub := util.NewID(), util.NewID(), util.NewUUID()
+	up.Handle("POST /v1/session/verify", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.SessionOutput]{Result: bll.SessionOutput{SID: &sid, UID: &uid, Sub: &sub}}
+	})
+
+	forward := func(path string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	browser := func(h map[string]string) map[string]string {
+		h["Accept"] = "text/html,application/xhtml+xml"
+		return h
+	}
+
+	t.Run("valid session", func(t *testing.T) {
+		res := forward("/auth/forward", map[string]string{"X-Session": "session"})
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(uid.String(), res.Header.Get("X-Auth-User"))
+		assert.Equal(sub.String(), res.Header.Get("X-Auth-Sub"))
+		assert.Equal(sid.String(), res.Header.Get("X-Session-Id"))
+
+		res = forward("/auth/forward", map[string]string{"Authorization": "Bearer " + sign(util.JARVIS.String(), sid, uid)})
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(uid.String(), res.Header.Get("X-Auth-User"))
+		assert.Equal(sid.String(), res.Header.Get("X-Session-Id"))
+	})
+
+	t.Run("redirect the browser to login", func(t *testing.T) {
+		res := forward("/auth/forward", browser(map[string]string{
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "www.yiwen.ltd",
+			"X-Forwarded-Uri":   "/docs?id=1",
+		}))
+		assert.Equal(http.StatusFound, res.StatusCode)
+		u, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		assert.Equal("https://auth.yiwen.ltd/idp/github/authorize", u.Scheme+"://"+u.Host+u.Path)
+		assert.Equal("https://www.yiwen.ltd/docs?id=1", u.Query().Get("next_url"))
+
+		// nginx sets the original url, and the idp can be chosen by the gateway
+		res = forward("/auth/forward?idp=google", browser(map[string]string{
+			"X-Original-URL": "https://www.yiwen.ltd/home",
+		}))
+		u, err = url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		assert.Equal("/idp/google/authorize", u.Path)
+		assert.Equal("https://www.yiwen.ltd/home", u.Query().Get("next_url"))
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		h := map[string]string{"X-Forwarded-Host": "www.yiwen.ltd", "X-Forwarded-Uri": "/docs"}
+		assert.Equal(http.StatusUnauthorized, forward("/auth/forward", h).StatusCode, "not a browser navigation")
+
+		h = browser(map[string]string{"X-Forwarded-Host": "www.yiwen.ltd", "X-Forwarded-Method": http.MethodPost})
+		assert.Equal(http.StatusUnauthorized, forward("/auth/forward", h).StatusCode, "not a GET request")
+
+		h = browser(map[string]string{"X-Forwarded-Host": "evil.com", "X-Forwarded-Uri": "/"})
+		assert.Equal(http.StatusUnauthorized, forward("/auth/forward", h).StatusCode, "the host is not allowed")
+
+		assert.Equal(http.StatusUnauthorized, forward("/auth/forward", browser(map[string]string{})).StatusCode,
+			"missing forwarded url")
+	})
+}
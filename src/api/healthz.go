@@ -1,16 +1,30 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ldclabs/cose/key/ed25519"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/teambition/gear"
 
 	"github.com/yiwen-ai/auth-api/src/bll"
 	"github.com/yiwen-ai/auth-api/src/conf"
 	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/service"
 )
 
 // Healthz ..
 type Healthz struct {
-	blls *bll.Blls
+	blls   *bll.Blls
+	oss    *service.OSS
+	nonces service.NonceStore
 }
 
 // Get ..
@@ -21,9 +35,136 @@ func (a *Healthz) Get(ctx *gear.Context) error {
 	}
 
 	logging.SetTo(ctx, "stats", stats)
+	result := make(map[string]any)
+	for k, v := range GetVersion() {
+		result[k] = v
+	}
+	result["breakers"] = service.BreakerStates()
+	return ctx.OkJSON(bll.SuccessResponse[map[string]any]{Result: result})
+}
+
+// Livez reports that the process is alive, it does not check the dependencies.
+func (a *Healthz) Livez(ctx *gear.Context) error {
 	return ctx.OkJSON(bll.SuccessResponse[map[string]string]{Result: GetVersion()})
 }
 
+const readyzTimeout = 2 * time.Second
+
+type ReadyzCheck struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+type ReadyzOutput struct {
+	Status string                 `json:"status"`
+	Checks map[string]ReadyzCheck `json:"checks,omitempty"`
+}
+
+// Readyz checks the dependencies and the key material concurrently, it responds 503 if any of them fails
+// or the server is draining. The errors are logged but not responded, the endpoint is public.
+func (a *Healthz) Readyz(ctx *gear.Context) error {
+	if conf.Config.GlobalSignal.Err() != nil {
+		return ctx.JSON(http.StatusServiceUnavailable, ReadyzOutput{Status: "draining"})
+	}
+
+	checks := a.blls.Checks()
+	checks["oss"] = a.oss.Ping
+	checks["store"] = a.nonces.Ping
+	for name, check := range keyChecks(&conf.Config) {
+		checks[name] = check
+	}
+
+	output := ReadyzOutput{Status: "ok", Checks: make(map[string]ReadyzCheck, len(checks))}
+	errs := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, readyzTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(cctx)
+			res := ReadyzCheck{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				res.Status = "fail"
+			}
+
+			mu.Lock()
+			output.Checks[name] = res
+			if err != nil {
+				output.Status = "fail"
+				errs[name] = err.Error()
+			}
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	if output.Status != "ok" {
+		logging.SetTo(ctx, "readyz", errs)
+		return ctx.JSON(http.StatusServiceUnavailable, output)
+	}
+	return ctx.OkJSON(output)
+}
+
+// keyChecks checks that the keys loaded at startup still work, the 2FA key is optional.
+func keyChecks(cfg *conf.ConfigTpl) map[string]func(context.Context) error {
+	probe := []byte(conf.AppName + ":readyz")
+	checks := map[string]func(context.Context) error{
+		"cwt_pub": func(context.Context) error {
+			_, err := ed25519.NewVerifier(cfg.COSEKeys.CWTPub)
+			return err
+		},
+		"oauth2_state": func(context.Context) error {
+			macer, err := cfg.COSEKeys.Oauth2State.MACer()
+			if err != nil {
+				return err
+			}
+			tag, err := macer.MACCreate(probe)
+			if err != nil {
+				return err
+			}
+			return macer.MACVerify(probe, tag)
+		},
+	}
+
+	if cfg.COSEKeys.TOTPKEK != nil {
+		checks["totp_kek"] = func(context.Context) error {
+			enc, err := cfg.COSEKeys.TOTPKEK.Encryptor()
+			if err != nil {
+				return err
+			}
+			// a nonce must never be reused with the key, the probe runs on every /readyz
+			nonce := make([]byte, enc.NonceSize())
+			if _, err = rand.Read(nonce); err != nil {
+				return err
+			}
+			ciphertext, err := enc.Encrypt(nonce, probe, nil)
+			if err != nil {
+				return err
+			}
+			plaintext, err := enc.Decrypt(nonce, ciphertext, nil)
+			if err == nil && !bytes.Equal(plaintext, probe) {
+				err = errors.New("totp_kek decrypts a different plaintext")
+			}
+			return err
+		}
+	}
+	return checks
+}
+
+// the response is compressed by the app
+var metricsHandler = promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{DisableCompression: true})
+
+// Metrics exposes the Prometheus metrics.
+func (a *Healthz) Metrics(ctx *gear.Context) error {
+	metricsHandler.ServeHTTP(ctx.Res, ctx.Req)
+	return nil
+}
+
 func GetVersion() map[string]string {
 	return map[string]string{
 		"name":      conf.AppName,
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestHealthz(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, _ := newTestServer(t, up, nil, nil)
+	// the request to userbase makes its breaker
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/userinfo", nil)
+	req.AddCookie(loginTestUser(up, util.NewID()))
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+
+	res, err = http.Get(srv.URL + "/healthz")
+	assert.NoError(err)
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	output := struct {
+		Result struct {
+			Breakers map[string]string `json:"breakers"`
+		} `json:"result"`
+	}{}
+	assert.NoError(json.Unmarshal(data, &output))
+	// the base services of the test share the host, it is named as the last registered one
+	assert.NotEmpty(output.Result.Breakers)
+	for name, state := range output.Result.Breakers {
+		assert.Contains([]string{"userbase", "logbase", "walletbase"}, name)
+		assert.Equal("closed", state)
+	}
+	assert.NotContains(string(data), strings.TrimPrefix(up.URL, "http://"), "the internal addresses are not exposed")
+}
+
+func TestReadyz(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+
+	readyz := func() (int, map[string]any, string) {
+		res, err := http.Get(srv.URL + "/readyz")
+		assert.NoError(err)
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		output := make(map[string]any)
+		assert.NoError(json.Unmarshal(data, &output))
+		return res.StatusCode, output, string(data)
+	}
+
+	code, output, _ := readyz()
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", output["status"])
+	checks := output["checks"].(map[string]any)
+	for _, name := range []string{"userbase", "logbase", "walletbase", "oss", "store", "cwt_pub", "oauth2_state", "totp_kek"} {
+		assert.Equal("ok", checks[name].(map[string]any)["status"], name)
+	}
+
+	// the directory of the local object store is removed
+	dir := apis.Healthz.oss.LocalDir()
+	assert.NoError(os.Remove(dir))
+	code, output, raw := readyz()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("fail", output["status"])
+	checks = output["checks"].(map[string]any)
+	assert.Equal("fail", checks["oss"].(map[string]any)["status"])
+	assert.Equal("ok", checks["store"].(map[string]any)["status"])
+	assert.NotContains(raw, dir)
+	assert.NoError(os.Mkdir(dir, 0o700))
+	code, _, _ = readyz()
+	assert.Equal(http.StatusOK, code)
+
+	// the server is draining after the shutdown signal, the dependencies are not checked
+	signal := conf.Config.GlobalSignal
+	sctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conf.Config.GlobalSignal = sctx
+	calls := up.Calls("GET /healthz")
+	code, output, _ = readyz()
+	conf.Config.GlobalSignal = signal
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(map[string]any{"status": "draining"}, output)
+	assert.Equal(calls, up.Calls("GET /healthz"))
+
+	up.Handle("GET /healthz", func(body []byte) (int, any) {
+		return http.StatusInternalServerError, map[string]any{"error": map[string]any{"message": "dial tcp 10.0.0.8:9042: secret"}}
+	})
+	code, output, raw = readyz()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("fail", output["status"])
+	checks = output["checks"].(map[string]any)
+	assert.Equal(map[string]any{"status": "fail", "latency_ms": checks["userbase"].(map[string]any)["latency_ms"]}, checks["userbase"])
+	assert.NotContains(raw, "10.0.0.8")
+	assert.NotContains(raw, "error")
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, _ := newTestServer(t, up, nil, nil)
+	res, err := testClient.Get(srv.URL + "/metrics")
+	assert.NoError(err)
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NotEqual(http.StatusOK, res.StatusCode, "not on the public routes")
+	assert.NotContains(string(data), "auth_api_")
+
+	msrv := httptest.NewServer(NewMetricsApp())
+	defer msrv.Close()
+	res, err = http.Get(msrv.URL + "/metrics")
+	assert.NoError(err)
+	defer res.Body.Close()
+	data, _ = io.ReadAll(res.Body)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Contains(string(data), "auth_api_")
+}
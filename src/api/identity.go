@@ -0,0 +1,142 @@
+package api
+
+import (
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// ListIdentities returns the external identities linked to the logined user.
+func (a *AuthN) ListIdentities(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	authns, err := a.blls.AuthN.ListAuthN(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	output := make([]bll.AuthNOutput, 0, len(authns))
+	for _, v := range authns {
+		if v.Idp == "pk" { // passkeys are managed by /passkeys
+			continue
+		}
+		v.UID = nil // should not return uid
+		output = append(output, v)
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[[]bll.AuthNOutput]{Result: output})
+}
+
+// UpdateIdentity updates the preferences of the identities from the IdP. The profile can be synced
+// from one IdP only, enabling it for the IdP disables the others.
+func (a *AuthN) UpdateIdentity(ctx *gear.Context) error {
+	input := &bll.UpdateAuthNInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+	input.UID = *sess.UID
+	input.Idp = ctx.Param("idp")
+	if _, ok := conf.Config.Providers[input.Idp]; !ok {
+		return gear.ErrBadRequest.WithMsgf("can not sync profile from %q", input.Idp)
+	}
+
+	authns, err := a.blls.AuthN.ListAuthN(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	found := false
+	others := map[string]bool{}
+	for _, v := range authns {
+		if v.Idp == input.Idp {
+			found = true
+		} else if v.SyncProfile {
+			others[v.Idp] = true
+		}
+	}
+	if !found {
+		return gear.ErrNotFound.WithMsgf("identity %q not found", input.Idp)
+	}
+
+	// the others are disabled before enabling the IdP, and enabled again if it fails,
+	// so the profile is never synced from two IdPs
+	disabled := make([]string, 0, len(others))
+	rollback := func() {
+		for _, idp := range disabled {
+			if _, err := a.blls.AuthN.UpdateAuthN(conf.WithGlobalCtx(ctx), &bll.UpdateAuthNInput{UID: input.UID, Idp: idp, SyncProfile: true}); err != nil {
+				logging.Errf("rollback sync_profile of %s for %s error: %v", idp, input.UID.String(), err)
+			}
+		}
+	}
+	if input.SyncProfile {
+		for idp := range others {
+			if _, err := a.blls.AuthN.UpdateAuthN(ctx, &bll.UpdateAuthNInput{UID: input.UID, Idp: idp}); err != nil {
+				rollback()
+				return gear.ErrInternalServerError.From(err)
+			}
+			disabled = append(disabled, idp)
+		}
+	}
+
+	output, err := a.blls.AuthN.UpdateAuthN(ctx, input)
+	if err != nil {
+		rollback()
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserUpdate, 1, *sess.UID, *sess.UID, &bll.LogPayload{
+		Idp: util.Ptr(input.Idp),
+	})
+	return ctx.OkSend(output)
+}
+
+// UnlinkIdentity removes the identities from the IdP, it refuses to remove the last login method.
+func (a *AuthN) UnlinkIdentity(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	idp := ctx.Param("idp")
+	if idp == "pk" {
+		return gear.ErrBadRequest.WithMsg("use /passkeys to remove passkeys")
+	}
+
+	authns, err := a.blls.AuthN.ListAuthN(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	removing := 0
+	for _, v := range authns {
+		if v.Idp == idp {
+			removing++
+		}
+	}
+	if removing == 0 {
+		return gear.ErrNotFound.WithMsgf("identity %q not found", idp)
+	}
+
+	if err = a.checkOtherLoginMethod(ctx, *sess.UID, removing); err != nil {
+		return err
+	}
+
+	output, err := a.blls.AuthN.Unlink(ctx, *sess.UID, idp)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserUnlinkAuthN, 1, *sess.UID, *sess.UID, &bll.LogPayload{
+		Idp: util.Ptr(idp),
+	})
+	return ctx.OkSend(output)
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestIdentities(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	uid := util.NewID()
+	cookie, sid := loginTestSession(up, uid)
+
+	var mu sync.Mutex
+	authns := []bll.AuthNOutput{
+		{Idp: "github", Aud: "gh", Sub: "1", UID: &uid, CreatedAt: 1},
+		{Idp: "pk", Sub: "pk1", UID: &uid},
+	}
+	passkeys := []bll.PassKeyInfo{{ID: "pk1"}}
+	up.Handle("GET /v1/authn/list", func(body []byte) (int, any) {
+		mu.Lock()
+		defer mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[[]bll.AuthNOutput]{Result: authns}
+	})
+	up.Handle("GET /v1/passkey/list", func(body []byte) (int, any) {
+		mu.Lock()
+		defer mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[[]bll.PassKeyInfo]{Result: passkeys}
+	})
+	up.Handle("DELETE /v1/authn", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+	})
+
+	do := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.AddCookie(cookie)
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		return res
+	}
+	status := func(method, path string) int {
+		res := do(method, path)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	t.Run("list", func(t *testing.T) {
+		res := do(http.MethodGet, "/identities")
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		output := bll.SuccessResponse[[]bll.AuthNOutput]{}
+		assert.NoError(json.NewDecoder(res.Body).Decode(&output))
+		// the passkeys are listed by /passkeys, and the uid is not returned
+		assert.Equal([]bll.AuthNOutput{{Idp: "github", Aud: "gh", Sub: "1", CreatedAt: 1}}, output.Result)
+	})
+
+	t.Run("unlink", func(t *testing.T) {
+		assert.Equal(http.StatusUnauthorized, status(http.MethodDelete, "/identities/github"), "requires step-up")
+		stepUpTestSession(t, apis, sid, AALMultiFactor)
+
+		assert.Equal(http.StatusBadRequest, status(http.MethodDelete, "/identities/pk"))
+		assert.Equal(http.StatusNotFound, status(http.MethodDelete, "/identities/google"))
+
+		mu.Lock()
+		passkeys = nil
+		mu.Unlock()
+		assert.Equal(http.StatusConflict, status(http.MethodDelete, "/identities/github"), "the last login method")
+		assert.Equal(0, up.Calls("DELETE /v1/authn"))
+
+		mu.Lock()
+		passkeys = []bll.PassKeyInfo{{ID: "pk1"}}
+		mu.Unlock()
+		assert.Equal(http.StatusOK, status(http.MethodDelete, "/identities/github"))
+		assert.Equal(1, up.Calls("DELETE /v1/authn"))
+	})
+}
+
+func TestUpdateIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, _ := newTestServer(t, up, nil, nil)
+	conf.Config.Providers["google"] = conf.Provider{}
+	defer delete(conf.Config.Providers, "google")
+
+	uid := util.NewID()
+	cookie := loginTestUser(up, uid)
+	up.Handle("GET /v1/authn/list", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[[]bll.AuthNOutput]{Result: []bll.AuthNOutput{
+			{Idp: "github", Sub: "1"},
+			{Idp: "google", Sub: "2", SyncProfile: true},
+		}}
+	})
+
+	var mu sync.Mutex
+	var updates []bll.UpdateAuthNInput
+	failGithub := true
+	up.Handle("PATCH /v1/authn", func(body []byte) (int, any) {
+		input := bll.UpdateAuthNInput{}
+		cbor.Unmarshal(body, &input)
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, input)
+		if failGithub && input.Idp == "github" {
+			return http.StatusInternalServerError, map[string]string{"error": "failed"}
+		}
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+	})
+
+	patch := func() int {
+		req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/identities/github", strings.NewReader(`{"sync_profile":true}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// google is disabled first, and enabled again as github fails
+	assert.Equal(http.StatusInternalServerError, patch())
+	assert.Equal([]bll.UpdateAuthNInput{
+		{UID: uid, Idp: "google"},
+		{UID: uid, Idp: "github", SyncProfile: true},
+		{UID: uid, Idp: "google", SyncProfile: true},
+	}, updates)
+
+	updates, failGithub = nil, false
+	assert.Equal(http.StatusOK, patch())
+	assert.Equal([]bll.UpdateAuthNInput{
+		{UID: uid, Idp: "google"},
+		{UID: uid, Idp: "github", SyncProfile: true},
+	}, updates)
+}
@@ -0,0 +1,448 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ldclabs/cose/cose"
+	"github.com/ldclabs/cose/key"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+const maxMFAAttempts = 5
+
+type MFACodeInput struct {
+	Code         string `json:"code" cbor:"code" form:"code"`
+	RecoveryCode string `json:"recovery_code" cbor:"recovery_code" form:"recovery_code"`
+}
+
+func (i *MFACodeInput) Validate() error {
+	if i.Code == "" && i.RecoveryCode == "" {
+		return gear.ErrBadRequest.WithMsg("code or recovery_code required")
+	}
+	return nil
+}
+
+type TOTPEnrollOutput struct {
+	Secret string `json:"secret"` // base32 encoded for the manual entry
+	URI    string `json:"uri"`    // otpauth:// URI, the payload of the QR code
+}
+
+type RecoveryCodesOutput struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type MFAVerifyOutput struct {
+	NextURL string `json:"next_url,omitempty"`
+}
+
+// pendingLogin is the login that has passed the first factor, it is kept in the encrypted cookie
+// and becomes a session after the second factor.
+type pendingLogin struct {
+	id      []byte
+	uid     util.ID
+	sid     string
+	session string
+	nextURL string
+}
+
+// TOTPEnroll generates a new TOTP secret for the logined user, it should be activated by TOTPActivate.
+func (a *AuthN) TOTPEnroll(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+	if a.kek == nil {
+		return gear.ErrNotImplemented.WithMsg("2FA is disabled")
+	}
+
+	info, err := a.blls.Session.GetMFA(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if info != nil && info.Enabled {
+		return gear.ErrConflict.WithMsg("2FA is enabled")
+	}
+
+	user, err := a.blls.Session.UserInfo(ctx, sess.UID, "")
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	secret := util.NewTOTPSecret()
+	data, err := a.encryptTOTPSecret(*sess.UID, secret)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if _, err = a.blls.Session.UpsertMFA(ctx, &bll.MFAInfo{
+		UID:        *sess.UID,
+		TOTPSecret: data,
+	}); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[TOTPEnrollOutput]{Result: TOTPEnrollOutput{
+		Secret: util.TOTPSecretString(secret),
+		URI:    util.TOTPURI(a.mfa.Issuer, user.CN, secret),
+	}})
+}
+
+// TOTPActivate enables 2FA with the first code from the authenticator, and returns the recovery codes.
+func (a *AuthN) TOTPActivate(ctx *gear.Context) error {
+	input := &MFACodeInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+	if a.kek == nil {
+		return gear.ErrNotImplemented.WithMsg("2FA is disabled")
+	}
+
+	info, err := a.blls.Session.GetMFA(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if info == nil {
+		return gear.ErrNotFound.WithMsg("2FA is not enrolled")
+	}
+	if info.Enabled {
+		return gear.ErrConflict.WithMsg("2FA is enabled")
+	}
+
+	// only TOTP code is accepted for activation
+	if err = a.verifyTOTP(ctx, info, input.Code); err != nil {
+		return err
+	}
+
+	codes := util.NewRecoveryCodes(10)
+	info.Enabled = true
+	info.RecoveryCodes = hashRecoveryCodes(codes)
+	if _, err = a.blls.Session.UpsertMFA(ctx, info); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserEnableMFA, 1, *sess.UID, *sess.UID, nil)
+	return ctx.OkSend(bll.SuccessResponse[RecoveryCodesOutput]{Result: RecoveryCodesOutput{RecoveryCodes: codes}})
+}
+
+// TOTPDisable disables 2FA, it requires the TOTP code or a recovery code.
+func (a *AuthN) TOTPDisable(ctx *gear.Context) error {
+	input := &MFACodeInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	info, err := a.enabledMFA(ctx, *sess.UID)
+	if err != nil {
+		return err
+	}
+	if err = a.verifySecondFactor(ctx, info, input); err != nil {
+		return err
+	}
+
+	output, err := a.blls.Session.DeleteMFA(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserDisableMFA, 1, *sess.UID, *sess.UID, nil)
+	return ctx.OkSend(output)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, it requires the TOTP code.
+func (a *AuthN) RegenerateRecoveryCodes(ctx *gear.Context) error {
+	input := &MFACodeInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	info, err := a.enabledMFA(ctx, *sess.UID)
+	if err != nil {
+		return err
+	}
+	if err = a.verifyTOTP(ctx, info, input.Code); err != nil {
+		return err
+	}
+
+	codes := util.NewRecoveryCodes(10)
+	info.RecoveryCodes = hashRecoveryCodes(codes)
+	if _, err = a.blls.Session.UpsertMFA(ctx, info); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[RecoveryCodesOutput]{Result: RecoveryCodesOutput{RecoveryCodes: codes}})
+}
+
+// MFAVerify verifies the second factor of the pending login, and turns it into a session.
+func (a *AuthN) MFAVerify(ctx *gear.Context) error {
+	input := &MFACodeInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	pending, err := a.readPendingLogin(ctx)
+	if err != nil {
+		failAttempt(ctx)
+		logging.SetTo(ctx, "error", err.Error())
+		return gear.ErrUnauthorized.WithMsg("invalid or expired login, please login again")
+	}
+	if err = lockoutSubject(ctx, "uid", pending.uid.String()); err != nil {
+		return err
+	}
+
+	ttl := time.Duration(a.mfa.ExpiresIn) * time.Second
+	pid := pendingLoginID(pending.id)
+	if n, err := a.nonces.Incr(ctx, pid+":attempts", ttl); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if n > maxMFAAttempts {
+		http.SetCookie(ctx.Res, a.pendingLoginCookie(ctx, "", -1))
+		return gear.ErrTooManyRequests.WithMsg("too many attempts, please login again")
+	}
+
+	info, err := a.enabledMFA(ctx, pending.uid)
+	if err != nil {
+		return err
+	}
+	if err = a.verifySecondFactor(ctx, info, input); err != nil {
+		a.blls.Logbase.Log(ctx, bll.LogActionUserVerifyMFA, -1, pending.uid, pending.uid, nil)
+		return err
+	}
+	// kept until expirePendingLogin checks it
+	if err = consumeToken(ctx, a.blls, a.nonces, "mfa", pid, ttl+time.Minute); err != nil {
+		failAttempt(ctx)
+		return gear.ErrUnauthorized.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserVerifyMFA, 1, pending.uid, pending.uid, nil)
+	http.SetCookie(ctx.Res, a.pendingLoginCookie(ctx, "", -1))
+
+	sid, err := util.ParseID(pending.sid)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	a.setSessionCookies(ctx, a.cookieDomain(ctx), sid, pending.session, AALMultiFactor, "totp")
+	return ctx.OkSend(bll.SuccessResponse[MFAVerifyOutput]{Result: MFAVerifyOutput{NextURL: pending.nextURL}})
+}
+
+// startMFA keeps the login pending if the user has enabled 2FA, it returns false if 2FA is not required.
+func (a *AuthN) startMFA(ctx *gear.Context, uid util.ID, sid, session, nextURL string) (bool, error) {
+	if a.kek == nil {
+		return false, nil
+	}
+
+	info, err := a.blls.Session.GetMFA(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	if info == nil || !info.Enabled {
+		return false, nil
+	}
+
+	id := key.GetRandomBytes(16)
+	obj := &cose.Encrypt0Message[key.IntMap]{
+		Payload: key.IntMap{
+			0: time.Now().Add(time.Duration(a.mfa.ExpiresIn) * time.Second).Unix(),
+			1: id,
+			2: uid.Bytes(),
+			3: sid,
+			4: session,
+			5: nextURL,
+		},
+	}
+	data, err := obj.EncryptAndEncode(a.kek, []byte("mfa"))
+	if err != nil {
+		return false, err
+	}
+
+	http.SetCookie(ctx.Res, a.pendingLoginCookie(ctx, base64.RawURLEncoding.EncodeToString(data), int(a.mfa.ExpiresIn)))
+	if sessionID, err := util.ParseID(sid); err == nil {
+		a.expirePendingLogin(conf.WithGlobalCtx(ctx), uid, sessionID, pendingLoginID(id))
+	}
+	return true, nil
+}
+
+func pendingLoginID(id []byte) string {
+	return "mfa:" + util.Bytes(id).String()
+}
+
+// expirePendingLogin revokes the session created by the first factor if the second factor is not verified
+// before the pending login expires. The pending login is consumed as MFAVerify does, so only one of them wins.
+// The session is only in the encrypted cookie, it can not be used without the second factor anyway.
+func (a *AuthN) expirePendingLogin(gctx context.Context, uid, sid util.ID, pid string) {
+	ttl := time.Duration(a.mfa.ExpiresIn) * time.Second
+	time.AfterFunc(ttl+time.Second, func() {
+		ok, err := a.nonces.Consume(gctx, tokenKey("mfa", pid), ttl)
+		if err != nil {
+			logging.Errf("expirePendingLogin for %s error: %v", uid.String(), err)
+			return
+		}
+		if !ok {
+			return // verified
+		}
+		if _, err = a.blls.Session.Delete(gctx, sid); err != nil {
+			logging.Errf("expirePendingLogin for %s, delete session %s error: %v", uid.String(), sid.String(), err)
+		} else {
+			logging.Infof("expirePendingLogin for %s, session %s deleted", uid.String(), sid.String())
+		}
+	})
+}
+
+// mfaVerifyURL returns the page to enter the second factor.
+func (a *AuthN) mfaVerifyURL(nextURL string) string {
+	return a.mfa.VerifyURL + "?next_url=" + url.QueryEscape(nextURL)
+}
+
+func (a *AuthN) readPendingLogin(ctx *gear.Context) (*pendingLogin, error) {
+	if a.kek == nil {
+		return nil, fmt.Errorf("2FA is disabled")
+	}
+
+	cookie, _ := ctx.Req.Cookie(a.cookie.NamePrefix + "_MFA")
+	if cookie == nil {
+		return nil, fmt.Errorf("missing pending login")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := cose.DecryptEncrypt0Message[key.IntMap](a.kek, data, []byte("mfa"))
+	if err != nil {
+		return nil, err
+	}
+	if v, _ := obj.Payload.GetInt64(0); v < time.Now().Unix() {
+		return nil, fmt.Errorf("expired pending login")
+	}
+
+	p := &pendingLogin{}
+	p.id, _ = obj.Payload.GetBytes(1)
+	uid, _ := obj.Payload.GetBytes(2)
+	if p.uid, err = util.IDFromBytes(uid); err != nil {
+		return nil, err
+	}
+	p.sid, _ = obj.Payload.GetString(3)
+	p.session, _ = obj.Payload.GetString(4)
+	p.nextURL, _ = obj.Payload.GetString(5)
+	return p, nil
+}
+
+func (a *AuthN) pendingLoginCookie(ctx *gear.Context, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     a.cookie.NamePrefix + "_MFA",
+		Value:    value,
+		HttpOnly: true,
+		Secure:   a.cookie.Secure,
+		MaxAge:   maxAge,
+		Path:     "/2fa/",
+		Domain:   a.cookieDomain(ctx),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (a *AuthN) cookieDomain(ctx *gear.Context) string {
+	if a.cookie.WeChatDomain != "" && strings.HasSuffix(ctx.Host, a.cookie.WeChatDomain) {
+		return a.cookie.WeChatDomain
+	}
+	return a.cookie.Domain
+}
+
+func (a *AuthN) enabledMFA(ctx *gear.Context, uid util.ID) (*bll.MFAInfo, error) {
+	if a.kek == nil {
+		return nil, gear.ErrNotImplemented.WithMsg("2FA is disabled")
+	}
+
+	info, err := a.blls.Session.GetMFA(ctx, uid)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	if info == nil || !info.Enabled {
+		return nil, gear.ErrNotFound.WithMsg("2FA is not enabled")
+	}
+	return info, nil
+}
+
+// verifySecondFactor verifies the TOTP code, or uses the recovery code.
+func (a *AuthN) verifySecondFactor(ctx *gear.Context, info *bll.MFAInfo, input *MFACodeInput) error {
+	if input.RecoveryCode == "" {
+		return a.verifyTOTP(ctx, info, input.Code)
+	}
+
+	ok, err := a.blls.Session.UseRecoveryCode(ctx, info.UID, util.HashRecoveryCode(input.RecoveryCode))
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if !ok {
+		failAttempt(ctx)
+		return gear.ErrForbidden.WithMsg("invalid recovery code")
+	}
+	return nil
+}
+
+// verifyTOTP verifies the TOTP code, a code can not be reused in its time step.
+func (a *AuthN) verifyTOTP(ctx *gear.Context, info *bll.MFAInfo, code string) error {
+	secret, err := a.decryptTOTPSecret(info.UID, info.TOTPSecret)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	counter, ok := util.VerifyTOTP(secret, code, time.Now())
+	if !ok {
+		failAttempt(ctx)
+		return gear.ErrForbidden.WithMsg("invalid code")
+	}
+
+	step := fmt.Sprintf("totp:%s:%d", info.UID.String(), counter)
+	if ok, err = a.nonces.Consume(ctx, step, 3*util.TOTPPeriod*time.Second); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if !ok {
+		failAttempt(ctx)
+		return gear.ErrForbidden.WithMsg("code has been used")
+	}
+	return nil
+}
+
+// encryptTOTPSecret encrypts the secret with the KEK, the uid is bound as the external data.
+func (a *AuthN) encryptTOTPSecret(uid util.ID, secret []byte) ([]byte, error) {
+	obj := &cose.Encrypt0Message[[]byte]{Payload: secret}
+	return obj.EncryptAndEncode(a.kek, uid.Bytes())
+}
+
+func (a *AuthN) decryptTOTPSecret(uid util.ID, data []byte) ([]byte, error) {
+	obj, err := cose.DecryptEncrypt0Message[[]byte](a.kek, data, uid.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return obj.Payload, nil
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = util.HashRecoveryCode(c)
+	}
+	return hashes
+}
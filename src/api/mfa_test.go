@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// testMFAStore fakes the 2FA records of userbase.
+type testMFAStore struct {
+	mu   sync.Mutex
+	info *bll.MFAInfo
+}
+
+func (s *testMFAStore) handle(up *testUpstream) {
+	up.Handle("GET /v1/user/mfa", func(body []byte) (int, any) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.info == nil {
+			return http.StatusNotFound, map[string]any{"error": "NotFound"}
+		}
+		return http.StatusOK, bll.SuccessResponse[bll.MFAInfo]{Result: *s.info}
+	})
+	up.Handle("PUT /v1/user/mfa", func(body []byte) (int, any) {
+		info := &bll.MFAInfo{}
+		cbor.Unmarshal(body, info)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.info = info
+		return http.StatusOK, bll.SuccessResponse[bll.MFAInfo]{Result: *info}
+	})
+	up.Handle("DELETE /v1/user/mfa", func(body []byte) (int, any) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.info = nil
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+	})
+	up.Handle("POST /v1/user/mfa/use_recovery_code", func(body []byte) (int, any) {
+		input := &bll.UseRecoveryCodeInput{}
+		cbor.Unmarshal(body, input)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, h := range s.info.RecoveryCodes {
+			if h == input.Hash {
+				s.info.RecoveryCodes = append(s.info.RecoveryCodes[:i], s.info.RecoveryCodes[i+1:]...)
+				return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+			}
+		}
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: false}
+	})
+}
+
+func TestTOTP(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	store := &testMFAStore{}
+	store.handle(up)
+	uid := util.NewID()
+	up.Handle("GET /v1/user", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.UserInfo]{Result: bll.UserInfo{CN: "alice"}}
+	})
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID: util.NewID(), UID: &uid, Session: "session",
+		}}
+	})
+	// the attempts of a pending login are limited without the rate limiter
+	rl := conf.Config.RateLimit.Enabled
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.RateLimit.Enabled = rl })
+	mailer := &testMailer{}
+	srv, apis := newTestServer(t, up, mailer, nil)
+	cookie, sid := loginTestSession(up, uid)
+
+	post := func(path, body string, cookies ...*http.Cookie) (*http.Response, map[string]any) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		output := make(map[string]any)
+		json.NewDecoder(res.Body).Decode(&output)
+		return res, output
+	}
+	codeInput := func(code string) string { return `{"code":"` + code + `"}` }
+
+	// a stolen session can not enroll its own TOTP
+	res, output := post("/2fa/totp/enroll", "", cookie)
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+	assert.Equal("StepUpRequired", output["error"])
+	res, output = post("/2fa/totp/activate", codeInput("123456"), cookie)
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+	assert.Equal("StepUpRequired", output["error"])
+	assert.Nil(store.info)
+
+	// enroll
+	stepUpTestSession(t, apis, sid, AALSingleFactor)
+	res, output = post("/2fa/totp/enroll", "", cookie)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	result := output["result"].(map[string]any)
+	assert.Contains(result["uri"], "otpauth://totp/")
+	assert.Contains(result["uri"], "alice")
+	assert.NotNil(store.info)
+	assert.False(store.info.Enabled)
+	secret, err := apis.AuthN.decryptTOTPSecret(uid, store.info.TOTPSecret)
+	assert.NoError(err)
+	assert.Equal(util.TOTPSecretString(secret), result["secret"])
+	_, err = apis.AuthN.decryptTOTPSecret(util.NewID(), store.info.TOTPSecret)
+	assert.Error(err, "bound to the user")
+
+	counter := util.TOTPCounter(time.Now())
+	code := util.HOTP(secret, counter, util.TOTPDigits)
+	n, _ := strconv.Atoi(code)
+	wrong := fmt.Sprintf("%06d", (n+1)%1000000)
+
+	// activate
+	res, _ = post("/2fa/totp/activate", codeInput(wrong), cookie)
+	assert.Equal(http.StatusForbidden, res.StatusCode)
+	assert.False(store.info.Enabled)
+
+	res, output = post("/2fa/totp/activate", codeInput(code), cookie)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.True(store.info.Enabled)
+	codes := output["result"].(map[string]any)["recovery_codes"].([]any)
+	assert.Len(codes, 10)
+	assert.Len(store.info.RecoveryCodes, 10)
+	assert.NotContains(store.info.RecoveryCodes, codes[0], "hashed")
+
+	res, _ = post("/2fa/totp/activate", codeInput(code), cookie)
+	assert.Equal(http.StatusConflict, res.StatusCode)
+	res, _ = post("/2fa/totp/enroll", "", cookie)
+	assert.Equal(http.StatusConflict, res.StatusCode)
+
+	// the login is pending until the second factor is verified
+	login := func() *http.Cookie {
+		n := len(mailer.mails)
+		res, _ := post("/email/start", `{"email":"alice@example.com"}`)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		m := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(mailer.mails[n].Text)
+		token, _ := url.QueryUnescape(m[1])
+
+		res, err := testClient.PostForm(srv.URL+"/email/confirm", url.Values{"token": {token}})
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusSeeOther, res.StatusCode)
+		assert.True(strings.HasPrefix(res.Header.Get("Location"), conf.Config.MFA.VerifyURL))
+		assert.Nil(testCookie(res, "_SESS"))
+		pending := testCookie(res, "_MFA")
+		assert.NotNil(pending)
+		return pending
+	}
+
+	pending := login()
+	res, _ = post("/2fa/verify", codeInput(code), pending)
+	assert.Equal(http.StatusForbidden, res.StatusCode, "the code of the time step has been used")
+	assert.Nil(testCookie(res, "_SESS"))
+
+	res, _ = post("/2fa/verify", codeInput(util.HOTP(secret, counter+1, util.TOTPDigits)), pending)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("session", testCookie(res, "_SESS").Value)
+	assert.Equal(-1, testCookie(res, "_MFA").MaxAge)
+
+	// the pending login can be used only once
+	res, _ = post("/2fa/verify", codeInput(util.HOTP(secret, counter-1, util.TOTPDigits)), pending)
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+	assert.Nil(testCookie(res, "_SESS"))
+
+	// a recovery code can be used only once
+	pending = login()
+	res, _ = post("/2fa/verify", `{"recovery_code":"`+strings.ToUpper(codes[1].(string))+`"}`, pending)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Len(store.info.RecoveryCodes, 9)
+
+	pending = login()
+	res, _ = post("/2fa/verify", `{"recovery_code":"`+codes[1].(string)+`"}`, pending)
+	assert.Equal(http.StatusForbidden, res.StatusCode)
+
+	// the forged pending login
+	res, _ = post("/2fa/verify", codeInput(wrong), &http.Cookie{Name: pending.Name, Value: "forged"})
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	// too many attempts
+	for i := 0; i < maxMFAAttempts-1; i++ {
+		res, _ = post("/2fa/verify", codeInput(wrong), pending)
+		assert.Equal(http.StatusForbidden, res.StatusCode)
+	}
+	res, _ = post("/2fa/verify", `{"recovery_code":"`+codes[2].(string)+`"}`, pending)
+	assert.Equal(http.StatusTooManyRequests, res.StatusCode)
+	assert.Len(store.info.RecoveryCodes, 9, "not used")
+}
+
+func TestPendingLoginExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	store := &testMFAStore{}
+	store.handle(up)
+	uid := util.NewID()
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID: util.NewID(), UID: &uid, Session: "session",
+		}}
+	})
+	up.Handle("DELETE /v1/session", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+	})
+	expiresIn := conf.Config.MFA.ExpiresIn
+	conf.Config.MFA.ExpiresIn = 1
+	t.Cleanup(func() { conf.Config.MFA.ExpiresIn = expiresIn })
+	mailer := &testMailer{}
+	srv, apis := newTestServer(t, up, mailer, nil)
+
+	secret := util.NewTOTPSecret()
+	encrypted, err := apis.AuthN.encryptTOTPSecret(uid, secret)
+	assert.NoError(err)
+	store.info = &bll.MFAInfo{UID: uid, TOTPSecret: encrypted, Enabled: true}
+
+	login := func() *http.Cookie {
+		n := len(mailer.mails)
+		res, err := http.Post(srv.URL+"/email/start", "application/json", strings.NewReader(`{"email":"alice@example.com"}`))
+		assert.NoError(err)
+		res.Body.Close()
+		m := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(mailer.mails[n].Text)
+		token, _ := url.QueryUnescape(m[1])
+		res, err = testClient.PostForm(srv.URL+"/email/confirm", url.Values{"token": {token}})
+		assert.NoError(err)
+		res.Body.Close()
+		return testCookie(res, "_MFA")
+	}
+
+	// the second factor is verified in time, the session is kept
+	pending := login()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/2fa/verify",
+		strings.NewReader(`{"code":"`+util.HOTP(secret, util.TOTPCounter(time.Now()), util.TOTPDigits)+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(pending)
+	res, err := testClient.Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	// the abandoned pending login, its session is revoked after it expires
+	login()
+	assert.Eventually(func() bool {
+		return up.Calls("DELETE /v1/session") > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(2, up.Calls("POST /v1/authn/login_or_new"))
+	assert.Equal(1, up.Calls("DELETE /v1/session"), "only the abandoned session is revoked")
+}
@@ -0,0 +1,436 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ldclabs/cose/key"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/service"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// OAuth2 is the authorization server for third-party apps, "Sign in with Yiwen".
+// https://datatracker.ietf.org/doc/html/rfc6749
+type OAuth2 struct {
+	blls       *bll.Blls
+	nonces     service.NonceStore
+	stateMACer key.MACer
+	cfg        *conf.OAuth2
+	clients    map[util.ID]*conf.OAuth2Client
+}
+
+func NewOAuth2(blls *bll.Blls, nonces service.NonceStore, cfg *conf.ConfigTpl) *OAuth2 {
+	macer, err := cfg.COSEKeys.Oauth2State.MACer()
+	if err != nil {
+		panic(err)
+	}
+
+	o := &OAuth2{
+		blls:       blls,
+		nonces:     nonces,
+		stateMACer: macer,
+		cfg:        &cfg.OAuth2,
+		clients:    make(map[util.ID]*conf.OAuth2Client, len(cfg.OAuth2.Clients)),
+	}
+
+	for _, v := range cfg.OAuth2.Clients {
+		client := v
+		o.clients[client.ClientID] = &client
+	}
+
+	return o
+}
+
+// Authorize handles the authorization request from the third-party app,
+// and redirects the user to the login page or the consent page.
+func (a *OAuth2) Authorize(ctx *gear.Context) error {
+	client, redirectURI, err := a.checkClient(ctx.Query("client_id"), ctx.Query("redirect_uri"))
+	if err != nil {
+		// should not redirect to an unverified redirect_uri
+		return gear.ErrBadRequest.From(err)
+	}
+
+	state := ctx.Query("state")
+	if ctx.Query("response_type") != "code" {
+		return ctx.Redirect(oauth2ErrorURL(redirectURI, state, "unsupported_response_type", "only \"code\" is supported"))
+	}
+
+	scope, ok := checkScope(client, ctx.Query("scope"))
+	if !ok {
+		return ctx.Redirect(oauth2ErrorURL(redirectURI, state, "invalid_scope", ""))
+	}
+
+	challenge := ctx.Query("code_challenge")
+	if challenge != "" && ctx.Query("code_challenge_method") != "S256" {
+		return ctx.Redirect(oauth2ErrorURL(redirectURI, state, "invalid_request", "code_challenge_method must be \"S256\""))
+	}
+	if challenge == "" && client.ClientSecret == "" {
+		return ctx.Redirect(oauth2ErrorURL(redirectURI, state, "invalid_request", "code_challenge is required for public client"))
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		loginURL, err := url.Parse(a.cfg.LoginURL)
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+
+		q := loginURL.Query()
+		q.Set("next_url", ctx.Scheme()+"://"+ctx.Host+ctx.Req.URL.RequestURI())
+		loginURL.RawQuery = q.Encode()
+		return ctx.Redirect(loginURL.String())
+	}
+
+	consent, err := sealState(a.stateMACer, statePurposeConsent, key.IntMap{
+		0: time.Now().Add(10 * time.Minute).Unix(),
+		1: *sess.UID,
+		2: client.ClientID,
+		3: redirectURI,
+		4: strings.Join(scope, " "),
+		5: state,
+		6: challenge,
+		7: ctx.Query("nonce"),
+		// the redirect_uri is required at the token endpoint if it is included in the request
+		8: ctx.Query("redirect_uri") != "",
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	consentURL, err := url.Parse(a.cfg.ConsentURL)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	q := consentURL.Query()
+	q.Set("consent", consent)
+	consentURL.RawQuery = q.Encode()
+	return ctx.Redirect(consentURL.String())
+}
+
+type ConsentOutput struct {
+	ClientID    util.ID  `json:"client_id" cbor:"client_id"`
+	ClientName  string   `json:"client_name" cbor:"client_name"`
+	Scope       []string `json:"scope" cbor:"scope"`
+	RedirectURI string   `json:"redirect_uri" cbor:"redirect_uri"`
+}
+
+// Consent returns the authorization request details for the consent page.
+func (a *OAuth2) Consent(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	req, err := a.verifyConsent(ctx.Query("consent"), *sess.UID)
+	if err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return ctx.OkSend(&ConsentOutput{
+		ClientID:    req.client.ClientID,
+		ClientName:  req.client.Name,
+		Scope:       req.scope,
+		RedirectURI: req.redirectURI,
+	})
+}
+
+type ApproveInput struct {
+	Consent string `json:"consent" cbor:"consent" validate:"required"`
+	Approve bool   `json:"approve" cbor:"approve"`
+}
+
+func (i *ApproveInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+type ApproveOutput struct {
+	RedirectURI string `json:"redirect_uri" cbor:"redirect_uri"`
+}
+
+// Approve handles the user's decision on the consent page,
+// and returns the redirect_uri with the authorization code or the error.
+func (a *OAuth2) Approve(ctx *gear.Context) error {
+	input := &ApproveInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	req, err := a.verifyConsent(input.Consent, *sess.UID)
+	if err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	if !input.Approve {
+		return ctx.OkSend(&ApproveOutput{
+			RedirectURI: oauth2ErrorURL(req.redirectURI, req.state, "access_denied", ""),
+		})
+	}
+
+	code, err := sealState(a.stateMACer, statePurposeCode, key.IntMap{
+		0: time.Now().Add(time.Duration(a.cfg.CodeExpiresIn) * time.Second).Unix(),
+		1: *sess.UID,
+		2: req.client.ClientID,
+		3: req.redirectURI,
+		4: strings.Join(req.scope, " "),
+		5: req.challenge,
+		6: req.nonce,
+		7: req.redirectURIPresent,
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	redirectURI, _ := url.Parse(req.redirectURI)
+	q := redirectURI.Query()
+	q.Set("code", code)
+	if req.state != "" {
+		q.Set("state", req.state)
+	}
+	redirectURI.RawQuery = q.Encode()
+	return ctx.OkSend(&ApproveOutput{RedirectURI: redirectURI.String()})
+}
+
+type OAuth2TokenInput struct {
+	GrantType    string `json:"grant_type" cbor:"grant_type" form:"grant_type"`
+	Code         string `json:"code" cbor:"code" form:"code"`
+	RedirectURI  string `json:"redirect_uri" cbor:"redirect_uri" form:"redirect_uri"`
+	ClientID     string `json:"client_id" cbor:"client_id" form:"client_id"`
+	ClientSecret string `json:"client_secret" cbor:"client_secret" form:"client_secret"`
+	CodeVerifier string `json:"code_verifier" cbor:"code_verifier" form:"code_verifier"`
+}
+
+func (i *OAuth2TokenInput) Validate() error {
+	// errors should be responded in OAuth2 format
+	return nil
+}
+
+type OAuth2TokenOutput struct {
+	AccessToken string `json:"access_token" cbor:"access_token"`
+	TokenType   string `json:"token_type" cbor:"token_type"`
+	ExpiresIn   uint   `json:"expires_in" cbor:"expires_in"`
+	IDToken     string `json:"id_token,omitempty" cbor:"id_token,omitempty"`
+	Scope       string `json:"scope,omitempty" cbor:"scope,omitempty"`
+}
+
+// AccessToken exchanges the authorization code for the access_token issued by userbase.
+// https://datatracker.ietf.org/doc/html/rfc6749#section-4.1.3
+func (a *OAuth2) AccessToken(ctx *gear.Context) error {
+	input := &OAuth2TokenInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return oauth2Error(ctx, http.StatusBadRequest, "invalid_request", err.Error())
+	}
+
+	if id, secret, ok := ctx.Req.BasicAuth(); ok {
+		input.ClientID, _ = url.QueryUnescape(id)
+		input.ClientSecret, _ = url.QueryUnescape(secret)
+	}
+
+	if input.GrantType != "authorization_code" {
+		return oauth2Error(ctx, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+
+	clientID, err := util.ParseID(input.ClientID)
+	if err != nil {
+		return oauth2Error(ctx, http.StatusUnauthorized, "invalid_client", "")
+	}
+	client, ok := a.clients[clientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(input.ClientSecret)) != 1 {
+		return oauth2Error(ctx, http.StatusUnauthorized, "invalid_client", "")
+	}
+
+	payload, err := openState(a.stateMACer, statePurposeCode, input.Code)
+	if err != nil {
+		logging.SetTo(ctx, "error", fmt.Sprintf("invalid code: %v", err))
+		return oauth2Error(ctx, http.StatusBadRequest, "invalid_grant", "invalid code")
+	}
+
+	uid, _ := payload.GetBytes(1)
+	aud, _ := payload.GetBytes(2)
+	redirectURI, _ := payload.GetString(3)
+	scope, _ := payload.GetString(4)
+	challenge, _ := payload.GetString(5)
+	nonce, _ := payload.GetString(6)
+	redirectURIPresent, _ := payload.GetBool(7)
+	if string(aud) != string(client.ClientID.Bytes()) {
+		return oauth2Error(ctx, http.StatusBadRequest, "invalid_grant", "client_id mismatch")
+	}
+	if (redirectURIPresent || input.RedirectURI != "") && input.RedirectURI != redirectURI {
+		return oauth2Error(ctx, http.StatusBadRequest, "invalid_grant", "redirect_uri mismatch")
+	}
+	if challenge != "" || input.CodeVerifier != "" {
+		sum := sha256.Sum256([]byte(input.CodeVerifier))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			return oauth2Error(ctx, http.StatusBadRequest, "invalid_grant", "code_verifier mismatch")
+		}
+	}
+
+	id, err := util.IDFromBytes(uid)
+	if err != nil {
+		return oauth2Error(ctx, http.StatusBadRequest, "invalid_grant", "invalid code")
+	}
+
+	// the code is valid only once
+	if err = consumeToken(ctx, a.blls, a.nonces, "code", input.Code, time.Duration(a.cfg.CodeExpiresIn)*time.Second); err != nil {
+		logging.SetTo(ctx, "error", err.Error())
+		return oauth2Error(ctx, http.StatusBadRequest, "invalid_grant", "invalid code")
+	}
+
+	output, err := a.blls.Session.Authorize(ctx, &bll.AuthorizeInput{
+		UID:       id,
+		Aud:       client.ClientID,
+		Scope:     strings.Fields(scope),
+		ExpiresIn: a.cfg.TokenExpiresIn,
+		Ip:        ctx.IP().String(),
+		Nonce:     nonce,
+	})
+	if err != nil {
+		logging.SetTo(ctx, "error", fmt.Sprintf("Session.Authorize failed: %v", err))
+		return oauth2Error(ctx, http.StatusInternalServerError, "server_error", "")
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserAuthz, 1, id, id, &bll.LogPayload{
+		Aud: util.Ptr(client.ClientID.String()),
+	})
+
+	ctx.SetHeader(gear.HeaderCacheControl, "no-store")
+	ctx.SetHeader(gear.HeaderPragma, "no-cache")
+	return ctx.JSON(http.StatusOK, &OAuth2TokenOutput{
+		AccessToken: output.AccessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   output.ExpiresIn,
+		IDToken:     output.IDToken,
+		Scope:       scope,
+	})
+}
+
+type consentRequest struct {
+	client      *conf.OAuth2Client
+	redirectURI string
+	scope       []string
+	state       string
+	challenge   string
+	nonce       string
+	// whether the redirect_uri was included in the authorization request
+	redirectURIPresent bool
+}
+
+func (a *OAuth2) checkClient(clientID, redirectURI string) (*conf.OAuth2Client, string, error) {
+	id, err := util.ParseID(clientID)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid client_id %q", clientID)
+	}
+
+	client, ok := a.clients[id]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown client_id %q", clientID)
+	}
+
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		return client, client.RedirectURIs[0], nil
+	}
+	if !util.SliceHas(client.RedirectURIs, redirectURI) {
+		return nil, "", fmt.Errorf("invalid redirect_uri %q", redirectURI)
+	}
+	return client, redirectURI, nil
+}
+
+func (a *OAuth2) verifyConsent(consent string, uid util.ID) (*consentRequest, error) {
+	payload, err := openState(a.stateMACer, statePurposeConsent, consent)
+	if err != nil {
+		return nil, err
+	}
+
+	if id, _ := payload.GetBytes(1); string(id) != string(uid.Bytes()) {
+		return nil, fmt.Errorf("invalid consent for current user")
+	}
+
+	aud, _ := payload.GetBytes(2)
+	redirectURI, _ := payload.GetString(3)
+	clientID, err := util.IDFromBytes(aud)
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := a.checkClient(clientID.String(), redirectURI)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, _ := payload.GetString(4)
+	state, _ := payload.GetString(5)
+	challenge, _ := payload.GetString(6)
+	nonce, _ := payload.GetString(7)
+	redirectURIPresent, _ := payload.GetBool(8)
+	return &consentRequest{
+		client:      client,
+		redirectURI: redirectURI,
+		scope:       strings.Fields(scope),
+		state:       state,
+		challenge:   challenge,
+		nonce:       nonce,
+
+		redirectURIPresent: redirectURIPresent,
+	}, nil
+}
+
+func checkScope(client *conf.OAuth2Client, scope string) ([]string, bool) {
+	if scope == "" {
+		return client.Scopes, true
+	}
+
+	scopes := strings.Fields(scope)
+	for _, s := range scopes {
+		if !util.SliceHas(client.Scopes, s) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+func oauth2ErrorURL(redirectURI, state, code, desc string) string {
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	q.Set("error", code)
+	if desc != "" {
+		q.Set("error_description", desc)
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func oauth2Error(ctx *gear.Context, status int, code, desc string) error {
+	if code == "invalid_client" || code == "invalid_grant" {
+		failAttempt(ctx)
+	}
+	if status == http.StatusUnauthorized {
+		ctx.SetHeader(gear.HeaderWWWAuthenticate, `Basic realm="oauth2"`)
+	}
+	ctx.SetHeader(gear.HeaderCacheControl, "no-store")
+	ctx.SetHeader(gear.HeaderPragma, "no-cache")
+	return ctx.JSON(status, map[string]string{
+		"error":             code,
+		"error_description": desc,
+	})
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// withTestOAuth2Clients configures a confidential client and a public client before newTestServer.
+func withTestOAuth2Clients(t *testing.T) (confidential, public conf.OAuth2Client) {
+	confidential = conf.OAuth2Client{
+		ClientID:     util.NewID(),
+		ClientSecret: "secret",
+		Name:         "Demo",
+		RedirectURIs: []string{"https://demo.example.com/callback"},
+		Scopes:       []string{"openid", "profile"},
+	}
+	public = conf.OAuth2Client{
+		ClientID:     util.NewID(),
+		Name:         "Mobile",
+		RedirectURIs: []string{"https://mobile.example.com/callback", "com.example.mobile:/callback"},
+		Scopes:       []string{"profile"},
+	}
+
+	clients, rl := conf.Config.OAuth2.Clients, conf.Config.RateLimit.Enabled
+	conf.Config.OAuth2.Clients = map[string]conf.OAuth2Client{"demo": confidential, "mobile": public}
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.OAuth2.Clients, conf.Config.RateLimit.Enabled = clients, rl })
+	return
+}
+
+func TestOAuth2Code(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	confidential, public := withTestOAuth2Clients(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	sign := testTokenSigner(t, apis)
+	uid := util.NewID()
+	cookie := loginTestUser(up, uid)
+
+	var authorized []*bll.AuthorizeInput
+	up.Handle("POST /v1/session/authorize", func(body []byte) (int, any) {
+		input := &bll.AuthorizeInput{}
+		cbor.Unmarshal(body, input)
+		authorized = append(authorized, input)
+		return http.StatusOK, bll.SuccessResponse[bll.SessionOutput]{Result: bll.SessionOutput{
+			AccessToken: sign(input.Aud.String(), util.NewID(), input.UID, input.Scope...), ExpiresIn: input.ExpiresIn,
+		}}
+	})
+
+	get := func(path string, cookies ...*http.Cookie) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	authorize := func(client conf.OAuth2Client, query url.Values) string {
+		query.Set("client_id", client.ClientID.String())
+		query.Set("response_type", "code")
+		res := get("/oauth2/authorize?"+query.Encode(), cookie)
+		assert.Equal(http.StatusFound, res.StatusCode)
+		return res.Header.Get("Location")
+	}
+	approve := func(consent string, ok bool) *url.URL {
+		body, _ := json.Marshal(map[string]any{"consent": consent, "approve": ok})
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/oauth2/authorize", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		output := &ApproveOutput{}
+		assert.NoError(json.NewDecoder(res.Body).Decode(output))
+		u, err := url.Parse(output.RedirectURI)
+		assert.NoError(err)
+		return u
+	}
+	consentOf := func(location string) string {
+		u, err := url.Parse(location)
+		assert.NoError(err)
+		assert.True(strings.HasPrefix(location, conf.Config.OAuth2.ConsentURL))
+		return u.Query().Get("consent")
+	}
+	exchange := func(form url.Values, basic ...string) (int, map[string]any) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/oauth2/access_token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(basic) == 2 {
+			req.SetBasicAuth(basic[0], basic[1])
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal("no-store", res.Header.Get("Cache-Control"))
+		output := make(map[string]any)
+		json.NewDecoder(res.Body).Decode(&output)
+		return res.StatusCode, output
+	}
+
+	t.Run("authorize", func(t *testing.T) {
+		// the unverified redirect_uri is not redirected to
+		unknown := util.NewID()
+		res := get("/oauth2/authorize?client_id=" + unknown.String() + "&response_type=code")
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+		res = get("/oauth2/authorize?client_id=" + confidential.ClientID.String() + "&redirect_uri=https://evil.com/callback")
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+		res = get("/oauth2/authorize?client_id=" + confidential.ClientID.String() + "&response_type=token&state=s1")
+		assert.Equal(http.StatusFound, res.StatusCode)
+		assert.Contains(res.Header.Get("Location"), "https://demo.example.com/callback?error=unsupported_response_type")
+		assert.Contains(res.Header.Get("Location"), "state=s1")
+
+		res = get("/oauth2/authorize?client_id=" + confidential.ClientID.String() + "&response_type=code&scope=email")
+		assert.Contains(res.Header.Get("Location"), "error=invalid_scope")
+
+		// the user without session logins first
+		res = get("/oauth2/authorize?client_id=" + confidential.ClientID.String() + "&response_type=code")
+		assert.Equal(http.StatusFound, res.StatusCode)
+		loc, _ := url.Parse(res.Header.Get("Location"))
+		assert.True(strings.HasPrefix(loc.String(), conf.Config.OAuth2.LoginURL))
+		assert.Contains(loc.Query().Get("next_url"), "/oauth2/authorize?client_id="+confidential.ClientID.String())
+
+		// PKCE is required for the public client, only S256
+		loc, _ = url.Parse(authorize(public, url.Values{"redirect_uri": {public.RedirectURIs[0]}}))
+		assert.Equal("invalid_request", loc.Query().Get("error"))
+		loc, _ = url.Parse(authorize(public, url.Values{
+			"redirect_uri": {public.RedirectURIs[0]}, "code_challenge": {"abc"}, "code_challenge_method": {"plain"},
+		}))
+		assert.Equal("invalid_request", loc.Query().Get("error"))
+	})
+
+	t.Run("consent", func(t *testing.T) {
+		consent := consentOf(authorize(confidential, url.Values{"scope": {"profile"}, "state": {"s2"}}))
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/oauth2/consent?consent="+url.QueryEscape(consent), nil)
+		req.AddCookie(cookie)
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		output := &ConsentOutput{}
+		assert.NoError(json.NewDecoder(res.Body).Decode(output))
+		res.Body.Close()
+		assert.Equal(confidential.ClientID, output.ClientID)
+		assert.Equal([]string{"profile"}, output.Scope)
+		assert.Equal(confidential.RedirectURIs[0], output.RedirectURI)
+
+		u := approve(consent, false)
+		assert.Equal("access_denied", u.Query().Get("error"))
+		assert.Equal("s2", u.Query().Get("state"))
+		assert.Equal("", u.Query().Get("code"))
+
+		// the consent of another user
+		other := loginTestUser(up, util.NewID())
+		req, _ = http.NewRequest(http.MethodGet, srv.URL+"/oauth2/consent?consent="+url.QueryEscape(consent), nil)
+		req.AddCookie(other)
+		res, err = testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+		loginTestUser(up, uid)
+	})
+
+	t.Run("approve", func(t *testing.T) {
+		post := func(body string, cookies ...*http.Cookie) *http.Response {
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/oauth2/authorize", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			res, err := testClient.Do(req)
+			assert.NoError(err)
+			res.Body.Close()
+			return res
+		}
+
+		consent := consentOf(authorize(confidential, url.Values{"state": {"s4"}}))
+		assert.Equal(http.StatusUnauthorized, post(`{"consent":"`+consent+`","approve":true}`).StatusCode)
+		assert.Equal(http.StatusBadRequest, post(`{"approve":true}`, cookie).StatusCode, "missing consent")
+		assert.Equal(http.StatusBadRequest, post(`{"consent":"`+consent+`x","approve":true}`, cookie).StatusCode)
+
+		// the code can not be used as the consent
+		u := approve(consent, true)
+		code := u.Query().Get("code")
+		assert.NotEqual("", code)
+		assert.Equal(http.StatusBadRequest, post(`{"consent":"`+code+`","approve":true}`, cookie).StatusCode)
+
+		// the consent of another user
+		loginTestUser(up, util.NewID())
+		assert.Equal(http.StatusBadRequest, post(`{"consent":"`+consent+`","approve":true}`, cookie).StatusCode)
+		loginTestUser(up, uid)
+	})
+
+	t.Run("confidential client", func(t *testing.T) {
+		consent := consentOf(authorize(confidential, url.Values{"state": {"s3"}, "nonce": {"n3"}}))
+		u := approve(consent, true)
+		assert.Equal("demo.example.com", u.Host)
+		assert.Equal("s3", u.Query().Get("state"))
+		code := u.Query().Get("code")
+		assert.NotEqual("", code)
+
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {confidential.RedirectURIs[0]}}
+		status, output := exchange(form, confidential.ClientID.String(), "wrong")
+		assert.Equal(http.StatusUnauthorized, status)
+		assert.Equal("invalid_client", output["error"])
+
+		// the consent can not be used as the code
+		form.Set("code", consent)
+		status, output = exchange(form, confidential.ClientID.String(), confidential.ClientSecret)
+		assert.Equal(http.StatusBadRequest, status)
+		assert.Equal("invalid_grant", output["error"])
+		form.Set("code", code)
+
+		form.Set("redirect_uri", "https://demo.example.com/other")
+		status, output = exchange(form, confidential.ClientID.String(), confidential.ClientSecret)
+		assert.Equal("invalid_grant", output["error"], "redirect_uri mismatch")
+		form.Set("redirect_uri", confidential.RedirectURIs[0])
+
+		assert.Len(authorized, 0)
+		status, output = exchange(form, confidential.ClientID.String(), confidential.ClientSecret)
+		assert.Equal(http.StatusOK, status)
+		assert.Equal("Bearer", output["token_type"])
+		assert.Equal("openid profile", output["scope"])
+		assert.Len(authorized, 1)
+		assert.Equal(uid, authorized[0].UID)
+		assert.Equal(confidential.ClientID, authorized[0].Aud)
+		assert.Equal("n3", authorized[0].Nonce, "the nonce is emitted in the id_token")
+
+		// the redirect_uri is optional if it was not included in the authorization request
+		consent = consentOf(authorize(confidential, url.Values{}))
+		form = url.Values{"grant_type": {"authorization_code"}, "code": {approve(consent, true).Query().Get("code")}}
+		status, _ = exchange(form, confidential.ClientID.String(), confidential.ClientSecret)
+		assert.Equal(http.StatusOK, status)
+		assert.Len(authorized, 2)
+		form.Set("code", code)
+		form.Set("redirect_uri", confidential.RedirectURIs[0])
+
+		// the code can be used only once
+		status, output = exchange(form, confidential.ClientID.String(), confidential.ClientSecret)
+		assert.Equal(http.StatusBadRequest, status)
+		assert.Equal("invalid_grant", output["error"])
+		assert.Len(authorized, 2)
+	})
+
+	t.Run("public client with PKCE", func(t *testing.T) {
+		verifier := base64.RawURLEncoding.EncodeToString(util.NewTOTPSecret()) + "-verifier"
+		sum := sha256.Sum256([]byte(verifier))
+		consent := consentOf(authorize(public, url.Values{
+			"redirect_uri":          {public.RedirectURIs[1]},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+			"code_challenge_method": {"S256"},
+		}))
+		u := approve(consent, true)
+		assert.Equal("com.example.mobile", u.Scheme)
+		code := u.Query().Get("code")
+
+		form := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"client_id":    {public.ClientID.String()},
+			"redirect_uri": {public.RedirectURIs[1]},
+		}
+		status, output := exchange(form)
+		assert.Equal(http.StatusBadRequest, status)
+		assert.Equal("invalid_grant", output["error"], "missing code_verifier")
+
+		form.Set("code_verifier", verifier+"x")
+		_, output = exchange(form)
+		assert.Equal("invalid_grant", output["error"], "code_verifier mismatch")
+		form.Set("code_verifier", verifier)
+
+		// the redirect_uri is required if it was included in the authorization request
+		form.Del("redirect_uri")
+		_, output = exchange(form)
+		assert.Equal("invalid_grant", output["error"], "missing redirect_uri")
+		form.Set("redirect_uri", public.RedirectURIs[0])
+		_, output = exchange(form)
+		assert.Equal("invalid_grant", output["error"], "redirect_uri mismatch")
+		form.Set("redirect_uri", public.RedirectURIs[1])
+
+		// the code of the public client can not be used by another client
+		_, output = exchange(form, confidential.ClientID.String(), confidential.ClientSecret)
+		assert.Equal("invalid_grant", output["error"], "client_id mismatch")
+
+		n := len(authorized)
+		status, output = exchange(form)
+		assert.Equal(http.StatusOK, status)
+		assert.Equal("profile", output["scope"])
+		assert.Len(authorized, n+1)
+		assert.Equal("", authorized[n].Nonce)
+
+		status, output = exchange(form)
+		assert.Equal(http.StatusBadRequest, status)
+		assert.Equal("invalid_grant", output["error"])
+	})
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"unicode"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ldclabs/cose/iana"
+	"github.com/ldclabs/cose/key"
+	"github.com/ldclabs/cose/key/ed25519"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+const MIMEApplicationCOSEKeySet = "application/cose-key-set"
+
+// OIDC serves the OpenID Connect discovery document and the token-signing public keys.
+// https://openid.net/specs/openid-connect-discovery-1_0.html
+type OIDC struct {
+	config *OIDCConfiguration
+	jwks   *JWKSet
+	keySet []byte
+}
+
+type OIDCConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	COSEKeysURI                       string   `json:"cose_keys_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// JWK represents an Ed25519 public key in JSON Web Key format.
+// https://datatracker.ietf.org/doc/html/rfc8037
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewOIDC(cfg *conf.ConfigTpl) *OIDC {
+	pub, err := ed25519.ToPublicKey(cfg.COSEKeys.CWTPub)
+	if err != nil {
+		panic(err)
+	}
+
+	x, _ := pub.GetBytes(iana.OKPKeyParameterX)
+	jwk := JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Kid: kidString(pub.Kid()),
+		Alg: "EdDSA",
+		Use: "sig",
+	}
+
+	keySet, err := cbor.Marshal(key.KeySet{pub})
+	if err != nil {
+		panic(err)
+	}
+
+	scopes := []string{"openid"}
+	for _, c := range cfg.OAuth2.Clients {
+		for _, s := range c.Scopes {
+			if !util.SliceHas(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	sort.Strings(scopes)
+
+	issuer := cfg.OAuth2.Issuer
+	return &OIDC{
+		config: &OIDCConfiguration{
+			Issuer:                            issuer,
+			AuthorizationEndpoint:             issuer + "/oauth2/authorize",
+			TokenEndpoint:                     issuer + "/oauth2/access_token",
+			UserinfoEndpoint:                  issuer + "/userinfo",
+			JwksURI:                           issuer + "/.well-known/jwks.json",
+			COSEKeysURI:                       issuer + "/.well-known/cose-keys",
+			ScopesSupported:                   scopes,
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{"authorization_code"},
+			SubjectTypesSupported:             []string{"pairwise"},
+			IDTokenSigningAlgValuesSupported:  []string{"EdDSA"},
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{"S256"},
+			ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "name", "picture", "locale"},
+		},
+		jwks:   &JWKSet{Keys: []JWK{jwk}},
+		keySet: keySet,
+	}
+}
+
+// Configuration returns the OpenID Provider metadata.
+func (a *OIDC) Configuration(ctx *gear.Context) error {
+	ctx.SetHeader(gear.HeaderCacheControl, "public, max-age=3600")
+	return ctx.JSON(http.StatusOK, a.config)
+}
+
+// JWKS returns the token-signing public keys as a JWK Set.
+func (a *OIDC) JWKS(ctx *gear.Context) error {
+	ctx.SetHeader(gear.HeaderCacheControl, "public, max-age=3600")
+	return ctx.JSON(http.StatusOK, a.jwks)
+}
+
+// COSEKeys returns the token-signing public keys as a COSE_KeySet.
+// https://datatracker.ietf.org/doc/html/rfc9052#section-7
+func (a *OIDC) COSEKeys(ctx *gear.Context) error {
+	ctx.SetHeader(gear.HeaderCacheControl, "public, max-age=3600")
+	ctx.Type(MIMEApplicationCOSEKeySet)
+	return ctx.End(http.StatusOK, a.keySet)
+}
+
+// kidString returns the kid as it is if it is printable, otherwise in base64url encoding.
+func kidString(kid []byte) string {
+	for _, r := range string(kid) {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return base64.RawURLEncoding.EncodeToString(kid)
+		}
+	}
+	return string(kid)
+}
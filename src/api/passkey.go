@@ -1,12 +1,14 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/mssola/useragent"
 	"github.com/teambition/gear"
 	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/logging"
 	"github.com/yiwen-ai/auth-api/src/util"
 )
 
@@ -37,6 +39,7 @@ func (a *AuthN) PassKeyVerifyRegistration(ctx *gear.Context) error {
 	}
 
 	output, err := a.blls.AuthN.PassKeyVerifyRegistration(ctx, input)
+	util.MetricPassKeyVerifications.WithLabelValues("registration", util.Outcome(err)).Inc()
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
@@ -84,7 +87,13 @@ func (a *AuthN) PassKeyVerifyAuthentication(ctx *gear.Context) error {
 	input.DeviceDesc = strings.Join(desc, ", ")
 
 	output, err := a.blls.AuthN.PassKeyVerifyAuthentication(ctx, input)
+	util.MetricPassKeyVerifications.WithLabelValues("authentication", util.Outcome(err)).Inc()
+	util.MetricLogins.WithLabelValues("pk", util.Outcome(err)).Inc()
 	if err != nil {
+		// the assertion is rejected by userbase
+		if status := gear.ParseError(err).Status(); status >= 400 && status < 500 {
+			failAttempt(ctx)
+		}
 		return gear.ErrInternalServerError.From(err)
 	}
 
@@ -93,6 +102,19 @@ func (a *AuthN) PassKeyVerifyAuthentication(ctx *gear.Context) error {
 		Sub: util.Ptr(input.ID),
 	})
 
+	// the login is pending until the second factor is verified
+	pending, err := a.startMFA(ctx, *output.UID, output.SID.String(), output.Session, "")
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if pending {
+		output.SID = util.ZeroID
+		output.Session = ""
+		output.UID = nil
+		output.MFARequired = true
+		return ctx.OkSend(output)
+	}
+
 	domain := a.cookie.Domain
 	didCookie := &http.Cookie{
 		Name:     didCookieName,
@@ -118,6 +140,112 @@ func (a *AuthN) PassKeyVerifyAuthentication(ctx *gear.Context) error {
 	}
 
 	http.SetCookie(ctx.Res, sessCookie)
+	if err := a.setAuthnContext(ctx, output.SID, AALMultiFactor, "passkey"); err != nil {
+		logging.SetTo(ctx, "error", fmt.Sprintf("setAuthnContext failed: %v", err))
+	}
 	output.UID = nil
 	return ctx.OkSend(output)
 }
+
+// PassKeyList returns the registered passkeys of the logined user.
+func (a *AuthN) PassKeyList(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	output, err := a.blls.AuthN.PassKeyList(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[[]bll.PassKeyInfo]{Result: output})
+}
+
+func (a *AuthN) PassKeyUpdate(ctx *gear.Context) error {
+	input := &bll.UpdatePassKeyInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+	input.UID = *sess.UID
+	input.ID = ctx.Param("id")
+
+	output, err := a.blls.AuthN.PassKeyUpdate(ctx, input)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserUpdatePassKey, 1, *sess.UID, *sess.UID, &bll.LogPayload{
+		Idp: util.Ptr("pk"),
+		Sub: util.Ptr(input.ID),
+	})
+	return ctx.OkSend(output)
+}
+
+func (a *AuthN) PassKeyDelete(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	id := ctx.Param("id")
+	passkeys, err := a.blls.AuthN.PassKeyList(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	found := false
+	for _, pk := range passkeys {
+		if pk.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return gear.ErrNotFound.WithMsgf("passkey %q not found", id)
+	}
+
+	if err = a.checkOtherLoginMethod(ctx, *sess.UID, 1); err != nil {
+		return err
+	}
+
+	output, err := a.blls.AuthN.PassKeyDelete(ctx, *sess.UID, id)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserDeletePassKey, 1, *sess.UID, *sess.UID, &bll.LogPayload{
+		Idp: util.Ptr("pk"),
+		Sub: util.Ptr(id),
+	})
+	return ctx.OkSend(output)
+}
+
+// checkOtherLoginMethod refuses to remove the last login methods of the user,
+// removing is the number of the methods to be removed.
+func (a *AuthN) checkOtherLoginMethod(ctx *gear.Context, uid util.ID, removing int) error {
+	passkeys, err := a.blls.AuthN.PassKeyList(ctx, uid)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	authns, err := a.blls.AuthN.ListAuthN(ctx, uid)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	methods := len(passkeys)
+	for _, v := range authns {
+		if v.Idp != "pk" {
+			methods++
+		}
+	}
+
+	if methods <= removing {
+		return gear.ErrConflict.WithMsg("can not remove the last login method")
+	}
+	return nil
+}
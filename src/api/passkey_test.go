@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestPassKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	uid := util.NewID()
+	cookie, sid := loginTestSession(up, uid)
+
+	var mu sync.Mutex
+	authns := []bll.AuthNOutput{{Idp: "pk", Sub: "pk1"}}
+	up.Handle("GET /v1/authn/list", func(body []byte) (int, any) {
+		mu.Lock()
+		defer mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[[]bll.AuthNOutput]{Result: authns}
+	})
+	up.Handle("GET /v1/passkey/list", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[[]bll.PassKeyInfo]{Result: []bll.PassKeyInfo{
+			{ID: "pk1", DisplayName: "YubiKey", Authenticator: "YubiKey 5", CreatedAt: 1, LastUsedAt: 2},
+		}}
+	})
+	var update bll.UpdatePassKeyInput
+	up.Handle("PATCH /v1/passkey", func(body []byte) (int, any) {
+		cbor.Unmarshal(body, &update)
+		return http.StatusOK, bll.SuccessResponse[bll.PassKeyInfo]{Result: bll.PassKeyInfo{ID: update.ID, DisplayName: update.DisplayName}}
+	})
+	up.Handle("DELETE /v1/passkey", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+	})
+	var actions []string
+	up.Handle("POST /v1/log", func(body []byte) (int, any) {
+		input := bll.CreateLogInput{}
+		cbor.Unmarshal(body, &input)
+		mu.Lock()
+		actions = append(actions, input.Action)
+		mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[bll.LogOutput]{}
+	})
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.AddCookie(cookie)
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		return res
+	}
+	status := func(method, path, body string) int {
+		res := do(method, path, body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	t.Run("list", func(t *testing.T) {
+		res := do(http.MethodGet, "/passkeys", "")
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		output := bll.SuccessResponse[[]bll.PassKeyInfo]{}
+		assert.NoError(json.NewDecoder(res.Body).Decode(&output))
+		assert.Equal([]bll.PassKeyInfo{
+			{ID: "pk1", DisplayName: "YubiKey", Authenticator: "YubiKey 5", CreatedAt: 1, LastUsedAt: 2},
+		}, output.Result)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		assert.Equal(http.StatusBadRequest, status(http.MethodPatch, "/passkeys/pk1", `{"display_name":""}`))
+		assert.Equal(0, up.Calls("PATCH /v1/passkey"))
+
+		assert.Equal(http.StatusOK, status(http.MethodPatch, "/passkeys/pk1", `{"display_name":"Office key"}`))
+		assert.Equal(bll.UpdatePassKeyInput{UID: uid, ID: "pk1", DisplayName: "Office key"}, update)
+		assert.Equal([]string{bll.LogActionUserUpdatePassKey}, actions)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.Equal(http.StatusUnauthorized, status(http.MethodDelete, "/passkeys/pk1", ""), "requires step-up")
+		stepUpTestSession(t, apis, sid, AALMultiFactor)
+
+		assert.Equal(http.StatusNotFound, status(http.MethodDelete, "/passkeys/pk2", ""))
+		assert.Equal(http.StatusConflict, status(http.MethodDelete, "/passkeys/pk1", ""), "the last login method")
+		assert.Equal(0, up.Calls("DELETE /v1/passkey"))
+
+		mu.Lock()
+		authns = append(authns, bll.AuthNOutput{Idp: "github", Sub: "1"})
+		mu.Unlock()
+		assert.Equal(http.StatusOK, status(http.MethodDelete, "/passkeys/pk1", ""))
+		assert.Equal(1, up.Calls("DELETE /v1/passkey"))
+		assert.Equal([]string{bll.LogActionUserUpdatePassKey, bll.LogActionUserDeletePassKey}, actions)
+	})
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+// UploadPicture sets the picture of the user, the image is in the "picture" field of a multipart form,
+// or is the raw body with an image content type.
+func (a *Session) UploadPicture(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	data, err := readPicture(ctx, conf.Config.Picture.MaxBytes)
+	if err != nil {
+		return err
+	}
+
+	output, err := a.blls.AuthN.UploadPicture(ctx, *sess.UID, data)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	output.ID = nil // should not return id
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserUpdate, 1, *sess.UID, *sess.UID, nil)
+	return ctx.OkSend(output)
+}
+
+func readPicture(ctx *gear.Context, maxBytes int) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(ctx.GetHeader(gear.HeaderContentType))
+	if err != nil {
+		return nil, gear.ErrUnsupportedMediaType.From(err)
+	}
+
+	// some room for the multipart headers
+	body := http.MaxBytesReader(ctx.Res, ctx.Req.Body, int64(maxBytes)+64<<10)
+	var r io.Reader = body
+	switch {
+	case mediaType == "multipart/form-data":
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, gear.ErrBadRequest.WithMsg("missing picture field")
+			}
+			if err != nil {
+				return nil, readPictureErr(err)
+			}
+			if part.FormName() == "picture" {
+				r = part
+				break
+			}
+		}
+	case strings.HasPrefix(mediaType, "image/"):
+	default:
+		return nil, gear.ErrUnsupportedMediaType.WithMsgf("unsupported content type %q", mediaType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return nil, readPictureErr(err)
+	}
+	if len(data) > maxBytes {
+		return nil, gear.ErrRequestEntityTooLarge.WithMsgf("picture is too large: over %d bytes", maxBytes)
+	}
+	return data, nil
+}
+
+func readPictureErr(err error) error {
+	var merr *http.MaxBytesError
+	if errors.As(err, &merr) {
+		return gear.ErrRequestEntityTooLarge.WithMsgf("request body is too large: over %d bytes", merr.Limit)
+	}
+	return gear.ErrBadRequest.From(err)
+}
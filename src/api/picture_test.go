@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 80, 80))))
+	return buf.Bytes()
+}
+
+func testMultipart(field string, data []byte) (string, []byte) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("name", "alice")
+	fw, _ := w.CreateFormFile(field, "a.png")
+	fw.Write(data)
+	w.Close()
+	return w.FormDataContentType(), buf.Bytes()
+}
+
+func TestReadPicture(t *testing.T) {
+	const maxBytes = 1024
+
+	app := gear.New()
+	app.Use(func(ctx *gear.Context) error {
+		data, err := readPicture(ctx, maxBytes)
+		if err != nil {
+			return err
+		}
+		return ctx.End(http.StatusOK, []byte(strconv.Itoa(len(data))))
+	})
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+
+	small := bytes.Repeat([]byte("a"), maxBytes)
+	large := bytes.Repeat([]byte("a"), maxBytes+1)
+	huge := bytes.Repeat([]byte("a"), maxBytes+128<<10)
+	ctype, form := testMultipart("picture", small)
+	ctypeLarge, formLarge := testMultipart("picture", large)
+	ctypeHuge, formHuge := testMultipart("picture", huge)
+	ctypeMissing, formMissing := testMultipart("avatar", small)
+
+	for _, c := range []struct {
+		name   string
+		ctype  string
+		body   []byte
+		status int
+	}{
+		{"multipart", ctype, form, http.StatusOK},
+		{"multipart missing field", ctypeMissing, formMissing, http.StatusBadRequest},
+		{"multipart too large", ctypeLarge, formLarge, http.StatusRequestEntityTooLarge},
+		{"multipart body too large", ctypeHuge, formHuge, http.StatusRequestEntityTooLarge},
+		{"multipart invalid", "multipart/form-data; boundary=x", []byte("invalid"), http.StatusBadRequest},
+		{"raw", "image/png", small, http.StatusOK},
+		{"raw too large", "image/webp", large, http.StatusRequestEntityTooLarge},
+		{"raw body too large", "image/jpeg", huge, http.StatusRequestEntityTooLarge},
+		{"unsupported type", "application/json", small, http.StatusUnsupportedMediaType},
+		{"missing type", "", small, http.StatusUnsupportedMediaType},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(c.body))
+			if c.ctype != "" {
+				req.Header.Set(gear.HeaderContentType, c.ctype)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(err)
+			defer res.Body.Close()
+			data, _ := io.ReadAll(res.Body)
+			assert.Equal(c.status, res.StatusCode, string(data))
+			if c.status == http.StatusOK {
+				assert.Equal(strconv.Itoa(maxBytes), string(data))
+			}
+		})
+	}
+}
+
+func TestUploadPicture(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	var mu sync.Mutex
+	var calls []string
+	var picture string
+	up.Handle("PATCH /v1/user", func(body []byte) (int, any) {
+		input := &bll.UpdateUserInput{}
+		cbor.Unmarshal(body, input)
+		mu.Lock()
+		calls = append(calls, "user")
+		picture = input.Picture
+		mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[bll.UserInfo]{Result: bll.UserInfo{
+			ID: input.ID, Name: "alice", Picture: input.Picture,
+		}}
+	})
+	up.Handle("PATCH /v1/group", func(body []byte) (int, any) {
+		mu.Lock()
+		calls = append(calls, "group")
+		mu.Unlock()
+		return http.StatusInternalServerError, map[string]any{"error": "InternalServerError"}
+	})
+	srv, _ := newTestServer(t, up, nil, nil)
+	cookie := loginTestUser(up, util.NewID())
+
+	upload := func(ctype string, body []byte) (*http.Response, map[string]any) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/userinfo/picture", bytes.NewReader(body))
+		req.Header.Set(gear.HeaderContentType, ctype)
+		req.AddCookie(cookie)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		output := make(map[string]any)
+		json.NewDecoder(res.Body).Decode(&output)
+		return res, output
+	}
+
+	// the group logo is best-effort after the user is updated
+	ctype, form := testMultipart("picture", testPNG(t))
+	res, output := upload(ctype, form)
+	assert.Equal(http.StatusOK, res.StatusCode, output)
+	assert.Nil(output["id"])
+	assert.Equal(picture, output["picture"])
+	assert.True(strings.HasSuffix(picture, "/80.jpg"))
+	assert.Equal([]string{"user", "group"}, calls)
+
+	// the group is not updated if the user fails
+	calls = nil
+	up.Handle("PATCH /v1/user", func(body []byte) (int, any) {
+		mu.Lock()
+		calls = append(calls, "user")
+		mu.Unlock()
+		return http.StatusBadRequest, map[string]any{"error": "BadRequest"}
+	})
+	res, _ = upload("image/png", testPNG(t))
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+	assert.Equal([]string{"user"}, calls)
+
+	res, _ = upload("image/png", []byte("not an image"))
+	assert.Equal(http.StatusUnsupportedMediaType, res.StatusCode)
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/service"
+)
+
+// RateLimiter throttles the routes with the token bucket policies in the config,
+// and locks the keys out after repeated failures.
+type RateLimiter struct {
+	store    service.RateLimitStore
+	enabled  bool
+	policies map[string]conf.RateLimitPolicy
+	cookie   conf.Cookie
+}
+
+func NewRateLimiter(store service.RateLimitStore, cfg *conf.ConfigTpl) *RateLimiter {
+	return &RateLimiter{
+		store:    store,
+		enabled:  cfg.RateLimit.Enabled,
+		policies: cfg.RateLimit.Policies,
+		cookie:   cfg.Cookie,
+	}
+}
+
+// Limit returns the middleware of the policy, it does nothing if the policy is not configured.
+// The "uid" key requires Session.Verify (or TryVerify) before it.
+func (l *RateLimiter) Limit(name string) gear.Middleware {
+	policy, ok := l.policies[name]
+	if !l.enabled || !ok {
+		return func(ctx *gear.Context) error { return nil }
+	}
+
+	rate := float64(policy.Limit) / float64(policy.Period)
+	return func(ctx *gear.Context) error {
+		keys, lockoutKeys := l.keys(ctx, name, policy)
+		if policy.LockoutFailures > 0 {
+			for _, key := range lockoutKeys {
+				if err := l.checkLockout(ctx, name, key); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, key := range keys {
+			wait, err := l.store.Allow(ctx, key, rate, int(policy.Burst))
+			if err != nil {
+				logging.SetTo(ctx, "rate_limit_error", err.Error())
+				return nil
+			}
+			if wait > 0 {
+				return l.tooManyRequests(ctx, name, wait, "too many requests")
+			}
+		}
+
+		if policy.LockoutFailures > 0 {
+			attempt := &loginAttempt{limiter: l, name: name, keys: lockoutKeys}
+			ctx.WithContext(gear.CtxWith[loginAttempt](ctx.Context(), attempt))
+			ctx.OnEnd(func() {
+				if !attempt.failed {
+					return
+				}
+				gctx := conf.WithGlobalCtx(ctx)
+				for _, key := range attempt.keys {
+					if err := l.store.Fail(gctx, key, int64(policy.LockoutFailures),
+						time.Duration(policy.LockoutWindow)*time.Second,
+						time.Duration(policy.LockoutDuration)*time.Second); err != nil {
+						logging.Warningf("rate limit Fail %q failed: %v", key, err)
+					}
+				}
+			})
+		}
+		return nil
+	}
+}
+
+// loginAttempt is set by the policies with lockout, the failures are marked by failAttempt.
+// The other 401 and 403 responses, such as the step-up challenge, are not failures.
+type loginAttempt struct {
+	failed  bool
+	limiter *RateLimiter
+	name    string
+	keys    []string // the lockout keys
+}
+
+// failAttempt marks the request as a failed attempt on a bad code, state or signature,
+// it does nothing if the route has no lockout policy.
+func failAttempt(ctx *gear.Context) {
+	if attempt := gear.CtxValue[loginAttempt](ctx); attempt != nil {
+		attempt.failed = true
+	}
+}
+
+// lockoutSubject adds the account of the login attempt, such as the phone number or the user of the pending login,
+// to the lockout keys, so the failures on it from any IP and device count. The subject is hashed in the key.
+// It returns 429 if the account is locked out, and does nothing if the route has no lockout policy.
+func lockoutSubject(ctx *gear.Context, kind, subject string) error {
+	attempt := gear.CtxValue[loginAttempt](ctx)
+	if attempt == nil || subject == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(subject))
+	key := attempt.name + ":" + kind + ":" + base64.RawURLEncoding.EncodeToString(sum[:])
+	if err := attempt.limiter.checkLockout(ctx, attempt.name, key); err != nil {
+		return err
+	}
+	attempt.keys = append(attempt.keys, key)
+	return nil
+}
+
+// checkLockout returns 429 if the key is locked out, it fails open on the store errors.
+func (l *RateLimiter) checkLockout(ctx *gear.Context, name, key string) error {
+	wait, err := l.store.Locked(ctx, key)
+	if err != nil {
+		// fail open, the store should not break the login
+		logging.SetTo(ctx, "rate_limit_error", err.Error())
+		return nil
+	}
+	if wait > 0 {
+		return l.tooManyRequests(ctx, name, wait, "too many failed attempts")
+	}
+	return nil
+}
+
+// keys returns the throttling keys of the request and the lockout keys among them.
+// The device id is set by the client, it throttles but never locks out: a new id would escape the lockout,
+// and anyone could lock out the device of another user with its id.
+func (l *RateLimiter) keys(ctx *gear.Context, name string, policy conf.RateLimitPolicy) (keys, lockoutKeys []string) {
+	keys = make([]string, 0, len(policy.Keys))
+	for _, k := range policy.Keys {
+		var v string
+		switch k {
+		case "ip":
+			v = ctx.IP().String()
+		case "device":
+			v = ctx.GetHeader("X-Device-Id")
+			if v == "" {
+				if cookie, _ := ctx.Req.Cookie(l.cookie.NamePrefix + "_DID"); cookie != nil {
+					v = cookie.Value
+				}
+			}
+			if len(v) > 64 {
+				v = "" // ignore the invalid device id
+			}
+		case "uid":
+			if sess := gear.CtxValue[bll.SessionOutput](ctx); sess != nil && sess.UID != nil {
+				v = sess.UID.String()
+			}
+		}
+		if v != "" {
+			keys = append(keys, name+":"+k+":"+v)
+			if k != "device" {
+				lockoutKeys = append(lockoutKeys, name+":"+k+":"+v)
+			}
+		}
+	}
+	return keys, lockoutKeys
+}
+
+func (l *RateLimiter) tooManyRequests(ctx *gear.Context, name string, wait time.Duration, msg string) error {
+	secs := int(math.Ceil(wait.Seconds()))
+	logging.SetTo(ctx, "rate_limit", name)
+	ctx.SetHeader(gear.HeaderRetryAfter, strconv.Itoa(secs))
+	return gear.ErrTooManyRequests.WithMsgf("%s, please retry after %d seconds", msg, secs)
+}
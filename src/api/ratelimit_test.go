@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/service"
+)
+
+func TestRateLimiterLockout(t *testing.T) {
+	newServer := func(keys ...string) *httptest.Server {
+		cfg := &conf.ConfigTpl{}
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Policies = map[string]conf.RateLimitPolicy{
+			"login": {Limit: 1000, Period: 1, Burst: 1000, Keys: keys,
+				LockoutFailures: 3, LockoutWindow: 60, LockoutDuration: 60},
+		}
+		limiter := NewRateLimiter(service.NewMemoryStore(0), cfg)
+		login := limiter.Limit("login")
+
+		router := gear.NewRouter()
+		// the IdP callback redirects on the invalid state
+		router.Get("/callback", login, func(ctx *gear.Context) error {
+			failAttempt(ctx)
+			return ctx.Redirect("https://www.yiwen.ltd/login/state?status=403")
+		})
+		// the code verification of the account
+		router.Get("/verify", login, func(ctx *gear.Context) error {
+			if err := lockoutSubject(ctx, "phone", ctx.Query("phone")); err != nil {
+				return err
+			}
+			failAttempt(ctx)
+			return gear.ErrForbidden.WithMsg("invalid code")
+		})
+		// the step-up challenge is not a failure
+		router.Get("/step_up", login, func(ctx *gear.Context) error {
+			return gear.ErrUnauthorized.WithErr("StepUpRequired")
+		})
+		router.Get("/ok", login, func(ctx *gear.Context) error {
+			return ctx.End(http.StatusNoContent)
+		})
+		app := gear.New()
+		app.UseHandler(router)
+		srv := httptest.NewServer(app)
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	get := func(t *testing.T, srv *httptest.Server, path, device string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set("X-Device-Id", device)
+		res, err := testClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	t.Run("ip", func(t *testing.T) {
+		assert := assert.New(t)
+		srv := newServer("ip", "device")
+
+		for i := 0; i < 5; i++ {
+			assert.Equal(http.StatusUnauthorized, get(t, srv, "/step_up", "a"))
+		}
+		assert.Equal(http.StatusNoContent, get(t, srv, "/ok", "a"))
+
+		for i := 0; i < 3; i++ {
+			assert.Equal(http.StatusFound, get(t, srv, "/callback", "b"))
+		}
+		assert.Equal(http.StatusTooManyRequests, get(t, srv, "/ok", "b"))
+		assert.Equal(http.StatusTooManyRequests, get(t, srv, "/ok", "c"), "a new device id does not escape")
+	})
+
+	t.Run("device does not lock out", func(t *testing.T) {
+		assert := assert.New(t)
+		srv := newServer("device")
+
+		for i := 0; i < 5; i++ {
+			assert.Equal(http.StatusFound, get(t, srv, "/callback", "a"))
+		}
+		assert.Equal(http.StatusNoContent, get(t, srv, "/ok", "a"))
+	})
+
+	t.Run("subject", func(t *testing.T) {
+		assert := assert.New(t)
+		srv := newServer("device")
+
+		for i := 0; i < 3; i++ {
+			assert.Equal(http.StatusForbidden, get(t, srv, "/verify?phone=1", string(rune('a'+i))))
+		}
+		assert.Equal(http.StatusTooManyRequests, get(t, srv, "/verify?phone=1", "d"))
+		assert.Equal(http.StatusForbidden, get(t, srv, "/verify?phone=2", "d"))
+		assert.Equal(http.StatusNoContent, get(t, srv, "/ok", "d"))
+	})
+}
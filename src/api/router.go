@@ -10,6 +10,7 @@ import (
 	"github.com/yiwen-ai/auth-api/src/bll"
 	"github.com/yiwen-ai/auth-api/src/conf"
 	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/service"
 	"github.com/yiwen-ai/auth-api/src/util"
 )
 
@@ -23,18 +24,28 @@ type APIs struct {
 	Healthz *Healthz
 	AuthN   *AuthN
 	Session *Session
+	OAuth2  *OAuth2
+	OIDC    *OIDC
+	Forward *ForwardAuth
+	Limiter *RateLimiter
+	Files   *Files // nil unless the local object store is used
 }
 
-func newAPIs(blls *bll.Blls) *APIs {
-	return &APIs{
-		Healthz: &Healthz{blls: blls},
-		AuthN:   NewAuth(blls, &conf.Config),
-		Session: NewSession(blls, &conf.Config),
+func newAPIs(blls *bll.Blls, oss *service.OSS, nonces service.NonceStore, mailer service.Mailer, smsSender service.SMSSender, limits service.RateLimitStore) *APIs {
+	session := NewSession(blls, nonces, &conf.Config)
+	apis := &APIs{
+		Healthz: &Healthz{blls: blls, oss: oss, nonces: nonces},
+		AuthN:   NewAuth(blls, nonces, mailer, smsSender, &conf.Config),
+		Session: session,
+		OAuth2:  NewOAuth2(blls, nonces, &conf.Config),
+		OIDC:    NewOIDC(&conf.Config),
+		Forward: NewForwardAuth(session, &conf.Config),
+		Limiter: NewRateLimiter(limits, &conf.Config),
 	}
-}
-
-func todo(ctx *gear.Context) error {
-	return gear.ErrNotFound
+	if dir := oss.LocalDir(); dir != "" {
+		apis.Files = &Files{dir: http.Dir(dir)}
+	}
+	return apis
 }
 
 func newRouters(apis *APIs) []*gear.Router {
@@ -54,22 +65,66 @@ func newRouters(apis *APIs) []*gear.Router {
 		return nil
 	})
 
+	// rate limit policies in the config
+	login := apis.Limiter.Limit("login")
+	send := apis.Limiter.Limit("send")
+	sensitive := apis.Limiter.Limit("sensitive")
+	upload := apis.Limiter.Limit("upload")
+
 	// health check
 	router.Get("/healthz", apis.Healthz.Get)
+	router.Get("/livez", apis.Healthz.Livez)
+	router.Get("/readyz", apis.Healthz.Readyz)
 	router.Get("/access_token", apis.Session.AccessToken)
-	router.Get("/userinfo", apis.Session.Verify, apis.Session.UserInfo)
+	router.Get("/userinfo", apis.Session.VerifyClient("profile"), apis.Session.UserInfo)
 	router.Patch("/userinfo", apis.Session.Verify, apis.Session.UpdateUserInfo)
+	router.Post("/userinfo/picture", apis.Session.Verify, upload, apis.Session.UploadPicture)
 	router.Post("/logout", apis.Session.Verify, apis.Session.Logout)
+	router.Get("/sessions", apis.Session.Verify, apis.Session.ListSessions)
+	router.Delete("/sessions/:sid", apis.Session.Verify, apis.Session.DeleteSession)
+	router.Post("/sessions/revoke_others", apis.Session.Verify, apis.Session.RevokeOtherSessions)
 	router.Get("/sync_session", apis.AuthN.SyncSession)
-	router.Post("/cose/renew_kek", apis.Session.Verify, apis.AuthN.COSERenewKEK)
+	router.Get("/auth/forward", apis.Forward.Verify)
+	router.Post("/cose/renew_kek", apis.Session.Verify, sensitive, apis.AuthN.StepUp, apis.AuthN.COSERenewKEK)
 
-	router.Get("/idp/:idp/authorize", apis.AuthN.Login)
-	router.Get("/idp/:idp/callback", apis.AuthN.Callback)
+	router.Get("/idp/:idp/authorize", apis.Session.TryVerify, apis.AuthN.Login)
+	router.Get("/idp/:idp/callback", login, apis.AuthN.Callback)
+	router.Post("/idp/:idp/callback", login, apis.AuthN.Callback)
+	if apis.AuthN.mailer != nil {
+		router.Post("/email/start", send, apis.AuthN.EmailStart)
+		router.Get("/email/verify", apis.AuthN.EmailVerify)
+		router.Post("/email/verify", login, apis.AuthN.EmailVerifyCode)
+		router.Post("/email/confirm", login, apis.AuthN.EmailConfirm)
+	}
+	if apis.AuthN.smsSender != nil {
+		router.Post("/sms/send_code", send, apis.AuthN.SMSSendCode)
+		router.Post("/sms/verify", login, apis.AuthN.SMSVerify)
+	}
 	router.Get("/passkey/get_challenge", apis.AuthN.PassKeyGetChallenge)
 	router.Post("/passkey/verify_registration", apis.Session.TryVerify, apis.AuthN.PassKeyVerifyRegistration)
-	router.Post("/passkey/verify_authentication", apis.AuthN.PassKeyVerifyAuthentication)
-	router.Get("/oauth2/authorize", todo)
-	router.Get("/oauth2/access_token", todo)
+	router.Post("/passkey/verify_authentication", login, apis.AuthN.PassKeyVerifyAuthentication)
+	router.Post("/2fa/verify", login, apis.AuthN.MFAVerify)
+	router.Post("/2fa/totp/enroll", apis.Session.Verify, sensitive, apis.AuthN.StepUp, apis.AuthN.TOTPEnroll)
+	router.Post("/2fa/totp/activate", apis.Session.Verify, sensitive, apis.AuthN.StepUp, apis.AuthN.TOTPActivate)
+	router.Post("/2fa/totp/disable", apis.Session.Verify, sensitive, apis.AuthN.StepUp, apis.AuthN.TOTPDisable)
+	router.Post("/2fa/step_up", apis.Session.Verify, sensitive, apis.AuthN.MFAStepUp)
+	router.Post("/2fa/recovery_codes", apis.Session.Verify, sensitive, apis.AuthN.RegenerateRecoveryCodes)
+	router.Get("/identities", apis.Session.Verify, apis.AuthN.ListIdentities)
+	router.Patch("/identities/:idp", apis.Session.Verify, apis.AuthN.UpdateIdentity)
+	router.Delete("/identities/:idp", apis.Session.Verify, sensitive, apis.AuthN.StepUp, apis.AuthN.UnlinkIdentity)
+	router.Get("/passkeys", apis.Session.Verify, apis.AuthN.PassKeyList)
+	router.Patch("/passkeys/:id", apis.Session.Verify, apis.AuthN.PassKeyUpdate)
+	router.Delete("/passkeys/:id", apis.Session.Verify, sensitive, apis.AuthN.StepUp, apis.AuthN.PassKeyDelete)
+	router.Get("/oauth2/authorize", apis.Session.TryVerify, apis.OAuth2.Authorize)
+	router.Post("/oauth2/authorize", apis.Session.Verify, apis.OAuth2.Approve)
+	router.Get("/oauth2/consent", apis.Session.Verify, apis.OAuth2.Consent)
+	router.Post("/oauth2/access_token", login, apis.OAuth2.AccessToken)
+	router.Get("/.well-known/openid-configuration", apis.OIDC.Configuration)
+	router.Get("/.well-known/jwks.json", apis.OIDC.JWKS)
+	router.Get("/.well-known/cose-keys", apis.OIDC.COSEKeys)
+	if apis.Files != nil {
+		router.Get("/files/:filepath*", apis.Files.Get)
+	}
 	router.Otherwise(func(ctx *gear.Context) error {
 		if !strings.Contains(conf.Config.Home, ctx.Req.Host) {
 			return ctx.Redirect(conf.Config.Home)
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ldclabs/cose/cose"
+	"github.com/ldclabs/cose/cwt"
+	"github.com/ldclabs/cose/iana"
+	"github.com/ldclabs/cose/key/ed25519"
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/service"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// testUpstream fakes the base services, the routes respond {"result": {}} by default.
+type testUpstream struct {
+	*httptest.Server
+	mu     sync.Mutex
+	routes map[string]func(body []byte) (int, any)
+	calls  map[string]int
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	up := &testUpstream{
+		routes: make(map[string]func(body []byte) (int, any)),
+		calls:  make(map[string]int),
+	}
+	up.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		route := r.Method + " " + r.URL.Path
+
+		up.mu.Lock()
+		up.calls[route]++
+		fn := up.routes[route]
+		up.mu.Unlock()
+
+		code, res := http.StatusOK, any(bll.SuccessResponse[map[string]any]{Result: map[string]any{}})
+		if fn != nil {
+			code, res = fn(body)
+		}
+		data, _ := cbor.Marshal(res)
+		w.Header().Set(gear.HeaderContentType, gear.MIMEApplicationCBOR)
+		w.WriteHeader(code)
+		w.Write(data)
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+func (up *testUpstream) Handle(route string, fn func(body []byte) (int, any)) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.routes[route] = fn
+}
+
+func (up *testUpstream) Calls(route string) int {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.calls[route]
+}
+
+// newTestServer serves the routers with the base services faked by the upstream.
+func newTestServer(t *testing.T, up *testUpstream, mailer service.Mailer, smsSender service.SMSSender) (*httptest.Server, *APIs) {
+	base := conf.Config.Base
+	conf.Config.Base = conf.Base{Userbase: up.URL, Logbase: up.URL, Walletbase: up.URL}
+	t.Cleanup(func() { conf.Config.Base = base })
+
+	ossCfg := conf.Config.OSS
+	conf.Config.OSS = conf.OSS{Kind: "local", Dir: t.TempDir(), UrlBase: "http://localhost:8080/files/"}
+	oss := service.NewOSS()
+	conf.Config.OSS = ossCfg
+	apis := newAPIs(bll.NewBlls(oss), oss, service.NewMemoryStore(0), mailer, smsSender, service.NewMemoryStore(0))
+
+	app := gear.New()
+	app.Set(gear.SetBodyParser, &bodyParser{gear.DefaultBodyParser(2 << 18)})
+	app.Set(gear.SetSender, &sendObject{})
+	for _, router := range newRouters(apis) {
+		app.UseHandler(router)
+	}
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	return srv, apis
+}
+
+// testClient does not follow the redirects.
+var testClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func testCookie(res *http.Response, name string) *http.Cookie {
+	for _, c := range res.Cookies() {
+		if strings.HasSuffix(c.Name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// loginTestUser makes the session cookie "session" valid for the user.
+func loginTestUser(up *testUpstream, uid util.ID) *http.Cookie {
+	cookie, _ := loginTestSession(up, uid)
+	return cookie
+}
+
+// loginTestSession is loginTestUser, and returns the session id.
+func loginTestSession(up *testUpstream, uid util.ID) (*http.Cookie, util.ID) {
+	sid := util.NewID()
+	up.Handle("POST /v1/session/verify", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.SessionOutput]{Result: bll.SessionOutput{SID: &sid, UID: &uid}}
+	})
+	return &http.Cookie{Name: conf.Config.Cookie.NamePrefix + "_SESS", Value: "session"}, sid
+}
+
+// stepUpTestSession makes the session authenticated just now with the level.
+func stepUpTestSession(t *testing.T, apis *APIs, sid util.ID, level int) {
+	data, err := cbor.Marshal(&authnContext{AuthAt: time.Now().Unix(), Level: level, Method: "idp"})
+	assert.NoError(t, err)
+	assert.NoError(t, apis.AuthN.nonces.Set(context.Background(), authnContextKey(sid), data, time.Hour))
+}
+
+// testTokenSigner makes the session verify the access tokens signed by a new key,
+// and returns the function to sign the tokens as userbase.
+func testTokenSigner(t *testing.T, apis *APIs) func(aud string, sid, uid util.ID, scope ...string) string {
+	k, err := ed25519.GenerateKey()
+	assert.NoError(t, err)
+	signer, err := ed25519.NewSigner(k)
+	assert.NoError(t, err)
+	pub, err := ed25519.ToPublicKey(k)
+	assert.NoError(t, err)
+	apis.Session.cwtVerifier, err = ed25519.NewVerifier(pub)
+	assert.NoError(t, err)
+
+	return func(aud string, sid, uid util.ID, scope ...string) string {
+		msg := &cose.Sign1Message[cwt.ClaimsMap]{Payload: cwt.ClaimsMap{
+			iana.CWTClaimIss: conf.Config.OAuth2.Issuer,
+			iana.CWTClaimAud: aud,
+			iana.CWTClaimExp: time.Now().Add(time.Hour).Unix(),
+			iana.CWTClaimCti: sid.Bytes(),
+			claimUID:         uid.Bytes(),
+			claimScope:       strings.Join(scope, " "),
+		}}
+		data, err := msg.SignAndEncode(signer, nil)
+		assert.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+}
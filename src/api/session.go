@@ -1,34 +1,157 @@
 package api
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/ldclabs/cose/cose"
+	"github.com/ldclabs/cose/cwt"
+	"github.com/ldclabs/cose/iana"
+	"github.com/ldclabs/cose/key"
+	"github.com/ldclabs/cose/key/ed25519"
 	_ "github.com/ldclabs/cose/key/hmac"
 	"github.com/teambition/gear"
 
 	"github.com/yiwen-ai/auth-api/src/bll"
 	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/service"
 	"github.com/yiwen-ai/auth-api/src/util"
 )
 
+// The private claims of yiwen access tokens, userbase signs the uid and the scope with the session id (cti).
+// Integer claim keys less than -65536 are for private use, https://www.iana.org/assignments/cwt/cwt.xhtml
+const (
+	claimUID   = -65537
+	claimScope = -65538
+)
+
 type Session struct {
-	blls   *bll.Blls
-	cookie conf.Cookie
+	blls        *bll.Blls
+	nonces      service.NonceStore
+	cookie      conf.Cookie
+	cwtVerifier key.Verifier
+	validator   *cwt.Validator
+	clients     map[string]struct{}
+	tokenTTL    time.Duration // the max lifetime of the access tokens
 }
 
-func NewSession(blls *bll.Blls, cfg *conf.ConfigTpl) *Session {
+func NewSession(blls *bll.Blls, nonces service.NonceStore, cfg *conf.ConfigTpl) *Session {
+	verifier, err := ed25519.NewVerifier(cfg.COSEKeys.CWTPub)
+	if err != nil {
+		panic(err)
+	}
+
+	validator, err := cwt.NewValidator(&cwt.ValidatorOpts{
+		ExpectedIssuer: cfg.OAuth2.Issuer,
+		ClockSkew:      time.Minute,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// the third-party apps
+	clients := make(map[string]struct{}, len(cfg.OAuth2.Clients))
+	for _, c := range cfg.OAuth2.Clients {
+		clients[c.ClientID.String()] = struct{}{}
+	}
+
 	sess := &Session{
-		blls:   blls,
-		cookie: cfg.Cookie,
+		blls:        blls,
+		nonces:      nonces,
+		cookie:      cfg.Cookie,
+		cwtVerifier: verifier,
+		validator:   validator,
+		clients:     clients,
+		tokenTTL:    time.Duration(max(3600, cfg.OAuth2.TokenExpiresIn))*time.Second + time.Minute,
 	}
 
 	return sess
 }
 
 func (a *Session) Verify(ctx *gear.Context) error {
+	output, err := a.verify(ctx)
+	if err != nil {
+		return err
+	}
+
+	header := gear.CtxValue[util.ContextHTTPHeader](ctx)
+	http.Header(*header).Set("x-auth-user", output.UID.String())
+	ctx.WithContext(gear.CtxWith[bll.SessionOutput](ctx.Context(), output))
+	return nil
+}
+
+func (a *Session) TryVerify(ctx *gear.Context) error {
+	if output, _ := a.verify(ctx); output != nil {
+		header := gear.CtxValue[util.ContextHTTPHeader](ctx)
+		http.Header(*header).Set("x-auth-user", output.UID.String())
+		ctx.WithContext(gear.CtxWith[bll.SessionOutput](ctx.Context(), output))
+	}
+
+	return nil
+}
+
+// VerifyClient accepts the access token of the third-party app with the scope,
+// or the session of yiwen apps as Verify.
+func (a *Session) VerifyClient(scope string) gear.Middleware {
+	return func(ctx *gear.Context) error {
+		token := extractBearer(ctx)
+		if token == "" {
+			return a.Verify(ctx)
+		}
+
+		claims, err := a.verifyCWT(token)
+		if err != nil {
+			return gear.ErrUnauthorized.From(err)
+		}
+		aud, _ := claims.GetString(iana.CWTClaimAud)
+		if aud == util.JARVIS.String() {
+			return a.Verify(ctx)
+		}
+		if _, ok := a.clients[aud]; !ok {
+			return gear.ErrUnauthorized.WithMsgf("invalid audience %q", aud)
+		}
+
+		output, scopes, err := a.verifyAccessToken(ctx, claims)
+		if err != nil {
+			return gear.ErrUnauthorized.From(err)
+		}
+		if !util.SliceHas(scopes, scope) {
+			return gear.ErrForbidden.WithMsgf("missing scope %q", scope)
+		}
+
+		ctx.WithContext(gear.CtxWith[bll.SessionOutput](ctx.Context(), output))
+		return nil
+	}
+}
+
+// verify verifies the CWT access token of yiwen apps from the Authorization header locally,
+// and falls back to userbase for the opaque session from X-Session header or cookie.
+// The access tokens of the third-party apps are accepted by VerifyClient only.
+func (a *Session) verify(ctx *gear.Context) (*bll.SessionOutput, error) {
+	if token := extractBearer(ctx); token != "" {
+		claims, err := a.verifyCWT(token)
+		if err != nil {
+			return nil, gear.ErrUnauthorized.From(err)
+		}
+		if aud, _ := claims.GetString(iana.CWTClaimAud); aud != util.JARVIS.String() {
+			return nil, gear.ErrUnauthorized.WithMsgf("invalid audience %q", aud)
+		}
+
+		output, _, err := a.verifyAccessToken(ctx, claims)
+		if err != nil {
+			return nil, gear.ErrUnauthorized.From(err)
+		}
+		return output, nil
+	}
+
 	sess := a.extractSession(ctx)
 	if sess == "" {
-		return gear.ErrUnauthorized.WithMsg("missing session")
+		return nil, gear.ErrUnauthorized.WithMsg("missing session")
 	}
 
 	output, err := a.blls.Session.Verify(ctx, &bll.SessionInput{
@@ -37,34 +160,84 @@ func (a *Session) Verify(ctx *gear.Context) error {
 		ExpiresIn: 3600,
 	})
 	if err != nil {
-		return gear.ErrUnauthorized.From(err)
+		return nil, gear.ErrUnauthorized.From(err)
 	}
 
 	if output.UID == nil {
-		return gear.ErrInternalServerError.WithMsg("missing uid")
+		return nil, gear.ErrInternalServerError.WithMsg("missing uid")
 	}
+	return output, nil
+}
 
-	header := gear.CtxValue[util.ContextHTTPHeader](ctx)
-	http.Header(*header).Set("x-auth-user", output.UID.String())
-	ctx.WithContext(gear.CtxWith[bll.SessionOutput](ctx.Context(), output))
-	return nil
+// verifyCWT verifies the signature, expiry and issuer of the CWT access token.
+// https://datatracker.ietf.org/doc/html/rfc8392
+func (a *Session) verifyCWT(token string) (cwt.ClaimsMap, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := cose.VerifySign1Message[cwt.ClaimsMap](a.cwtVerifier, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = a.validator.ValidateMap(msg.Payload); err != nil {
+		return nil, err
+	}
+	return msg.Payload, nil
 }
 
-func (a *Session) TryVerify(ctx *gear.Context) error {
-	if sess := a.extractSession(ctx); sess != "" {
-		output, _ := a.blls.Session.Verify(ctx, &bll.SessionInput{
-			Session:   sess,
-			Aud:       &util.JARVIS,
-			ExpiresIn: 3600,
-		})
-		if output != nil && output.UID != nil {
-			header := gear.CtxValue[util.ContextHTTPHeader](ctx)
-			http.Header(*header).Set("x-auth-user", output.UID.String())
-			ctx.WithContext(gear.CtxWith[bll.SessionOutput](ctx.Context(), output))
+// verifyAccessToken reads the user, the session and the scope of the verified access token from its claims,
+// they are signed by userbase, so the token is verified without any lookup except the revoked sessions.
+func (a *Session) verifyAccessToken(ctx *gear.Context, claims cwt.ClaimsMap) (*bll.SessionOutput, []string, error) {
+	data, _ := claims.GetBytes(claimUID)
+	uid, err := util.IDFromBytes(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid uid claim: %v", err)
+	}
+	data, _ = claims.GetBytes(iana.CWTClaimCti)
+	sid, err := util.IDFromBytes(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cti claim: %v", err)
+	}
+	if a.isRevoked(ctx, sid) {
+		return nil, nil, fmt.Errorf("session has been revoked")
+	}
+
+	output := &bll.SessionOutput{UID: &uid, SID: &sid}
+	if sub, _ := claims.GetString(iana.CWTClaimSub); sub != "" {
+		output.Sub = &util.UUID{}
+		if err = output.Sub.UnmarshalText([]byte(sub)); err != nil {
+			return nil, nil, fmt.Errorf("invalid sub claim: %v", err)
 		}
 	}
+	scope, _ := claims.GetString(claimScope)
+	return output, strings.Fields(scope), nil
+}
 
-	return nil
+func revokedKey(sid util.ID) string {
+	return "revoked:" + sid.String()
+}
+
+// isRevoked reports whether the session of the access token has been revoked.
+// It fails open to the signature check, the store outage should not reject all the access tokens.
+func (a *Session) isRevoked(ctx *gear.Context, sid util.ID) bool {
+	data, err := a.nonces.Get(ctx, revokedKey(sid))
+	if err != nil {
+		logging.SetTo(ctx, "error", fmt.Sprintf("read revoked session failed: %v", err))
+		return false
+	}
+	return data != nil
+}
+
+// revokeTokens denies the access tokens of the session until they expire,
+// and removes the authentication context of the session. It should be called before the session is deleted.
+func (a *Session) revokeTokens(ctx context.Context, sid util.ID) error {
+	if err := a.nonces.Set(ctx, revokedKey(sid), []byte{1}, a.tokenTTL); err != nil {
+		return err
+	}
+	return a.nonces.Delete(ctx, authnContextKey(sid))
 }
 
 func (a *Session) AccessToken(ctx *gear.Context) error {
@@ -81,7 +254,6 @@ func (a *Session) AccessToken(ctx *gear.Context) error {
 	if err != nil {
 		return gear.ErrUnauthorized.From(err)
 	}
-
 	output.SID = nil // should not return sid
 	output.UID = nil // should not return uid
 	return ctx.OkSend(output)
@@ -112,6 +284,20 @@ func (a *Session) UpdateUserInfo(ctx *gear.Context) error {
 		return gear.ErrUnauthorized.WithMsg("missing session")
 	}
 	input.ID = sess.UID
+	if input.Picture != "" {
+		user, err := a.blls.Session.UserInfo(ctx, sess.UID, "")
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		if err = input.CheckPicture(user.Picture); err != nil {
+			return err
+		}
+		if input.Name == "" && input.Picture == "" {
+			user.ID = nil // nothing changed
+			return ctx.OkSend(user)
+		}
+	}
+
 	output, err := a.blls.Session.UpdateUserInfo(ctx, input)
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
@@ -127,6 +313,9 @@ func (a *Session) Logout(ctx *gear.Context) error {
 		return gear.ErrUnauthorized.WithMsg("missing session")
 	}
 
+	if err := a.revokeTokens(ctx, *sess.SID); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
 	output, err := a.blls.Session.Delete(ctx, *sess.SID)
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
@@ -161,6 +350,106 @@ func (a *Session) Logout(ctx *gear.Context) error {
 	return ctx.OkSend(output)
 }
 
+// ListSessions returns the active sessions (devices) of the user, the current one is flagged.
+func (a *Session) ListSessions(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.SID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	output, err := a.blls.Session.ListSessions(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	for i := range output {
+		output[i].Current = output[i].ID == *sess.SID
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[[]bll.SessionInfo]{Result: output})
+}
+
+// DeleteSession revokes another session of the user, the current session should use Logout.
+func (a *Session) DeleteSession(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.SID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	sid, err := util.ParseID(ctx.Param("sid"))
+	if err != nil {
+		return gear.ErrBadRequest.WithMsgf("invalid sid: %v", err)
+	}
+	if sid == *sess.SID {
+		return gear.ErrBadRequest.WithMsg("can not delete the current session, use logout instead")
+	}
+
+	// the session must belong to the user
+	sessions, err := a.blls.Session.ListSessions(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	found := false
+	for _, s := range sessions {
+		if s.ID == sid {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return gear.ErrNotFound.WithMsgf("session %s not found", sid.String())
+	}
+
+	if err = a.revokeTokens(ctx, sid); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	output, err := a.blls.Session.Delete(ctx, sid)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserRevokeSession, 1, *sess.UID, *sess.UID, &bll.LogPayload{
+		SID: util.Ptr(sid.String()),
+	})
+	return ctx.OkSend(output)
+}
+
+// RevokeOtherSessions revokes all sessions of the user except the current one.
+func (a *Session) RevokeOtherSessions(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.SID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	sessions, err := a.blls.Session.ListSessions(ctx, *sess.UID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	for _, s := range sessions {
+		if s.ID != *sess.SID {
+			if err = a.revokeTokens(ctx, s.ID); err != nil {
+				return gear.ErrInternalServerError.From(err)
+			}
+		}
+	}
+
+	output, err := a.blls.Session.RevokeOthers(ctx, *sess.UID, *sess.SID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserRevokeSession, 1, *sess.UID, *sess.UID, &bll.LogPayload{
+		Kind: util.Ptr("others"),
+	})
+	return ctx.OkSend(output)
+}
+
+func extractBearer(ctx *gear.Context) string {
+	if auth := ctx.GetHeader(gear.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
 func (a *Session) extractSession(ctx *gear.Context) string {
 	sess := ctx.GetHeader("X-Session")
 	if sess == "" {
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/service"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestVerifyCWT(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	confidential, _ := withTestOAuth2Clients(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	sign := testTokenSigner(t, apis)
+
+	uid := util.NewID()
+	up.Handle("GET /v1/user", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.UserInfo]{Result: bll.UserInfo{ID: &uid, Name: "alice"}}
+	})
+	up.Handle("GET /v1/session/list", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[[]bll.SessionInfo]{Result: []bll.SessionInfo{}}
+	})
+
+	issue := func(aud string, scope ...string) string {
+		return sign(aud, util.NewID(), uid, scope...)
+	}
+	get := func(path, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	clientID := confidential.ClientID.String()
+	unknown := util.NewID()
+	sid := util.NewID()
+	revoked := sign(util.JARVIS.String(), sid, uid)
+	assert.NoError(apis.Session.revokeTokens(context.Background(), sid))
+	for _, c := range []struct {
+		name     string
+		token    string
+		sessions int // GET /sessions, Session.Verify
+		userinfo int // GET /userinfo, Session.VerifyClient("profile")
+	}{
+		{"first-party token", issue(util.JARVIS.String()), http.StatusOK, http.StatusOK},
+		{"third-party token", issue(clientID, "openid", "profile"), http.StatusUnauthorized, http.StatusOK},
+		{"third-party token without scope", issue(clientID, "openid"), http.StatusUnauthorized, http.StatusForbidden},
+		{"unknown audience", issue(unknown.String(), "profile"), http.StatusUnauthorized, http.StatusUnauthorized},
+		{"revoked session", revoked, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"invalid token", "invalid", http.StatusUnauthorized, http.StatusUnauthorized},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(c.sessions, get("/sessions", c.token), "/sessions")
+			assert.Equal(c.userinfo, get("/userinfo", c.token), "/userinfo")
+		})
+	}
+
+	t.Run("store outage", func(t *testing.T) {
+		// the denylist fails open to the signature check
+		nonces := apis.Session.nonces
+		apis.Session.nonces = &testFailingStore{nonces}
+		defer func() { apis.Session.nonces = nonces }()
+		assert.Equal(http.StatusOK, get("/sessions", issue(util.JARVIS.String())))
+	})
+
+	// the token signed by another key
+	token := issue(util.JARVIS.String())
+	testTokenSigner(t, apis)
+	assert.Equal(http.StatusUnauthorized, get("/sessions", token))
+}
+
+func TestSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	sign := testTokenSigner(t, apis)
+	uid := util.NewID()
+	cookie, sid := loginTestSession(up, uid)
+	others := []util.ID{util.NewID(), util.NewID()}
+	up.Handle("GET /v1/session/list", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[[]bll.SessionInfo]{Result: []bll.SessionInfo{
+			{ID: sid, DeviceID: "d0"}, {ID: others[0], DeviceID: "d1"}, {ID: others[1], DeviceID: "d2"},
+		}}
+	})
+	up.Handle("DELETE /v1/session", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bool]{Result: true}
+	})
+	up.Handle("POST /v1/session/revoke_others", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[uint]{Result: 2}
+	})
+	for _, id := range append(others, sid) {
+		stepUpTestSession(t, apis, id, AALMultiFactor)
+	}
+
+	do := func(method, path, token string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			req.AddCookie(cookie)
+		}
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		return res
+	}
+	status := func(method, path, token string) int {
+		res := do(method, path, token)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// revoked reports whether the access tokens of the session are denied and its authentication context is removed
+	revoked := func(id util.ID) bool {
+		denied := status(http.MethodGet, "/sessions", sign(util.JARVIS.String(), id, uid)) == http.StatusUnauthorized
+		data, err := apis.AuthN.nonces.Get(context.Background(), authnContextKey(id))
+		assert.NoError(err)
+		assert.Equal(denied, data == nil)
+		return denied
+	}
+
+	t.Run("list", func(t *testing.T) {
+		res := do(http.MethodGet, "/sessions", "")
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		output := bll.SuccessResponse[[]bll.SessionInfo]{}
+		assert.NoError(json.NewDecoder(res.Body).Decode(&output))
+		assert.Len(output.Result, 3)
+		for _, s := range output.Result {
+			assert.Equal(s.ID == sid, s.Current, s.DeviceID)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.Equal(http.StatusBadRequest, status(http.MethodDelete, "/sessions/invalid", ""))
+		assert.Equal(http.StatusBadRequest, status(http.MethodDelete, "/sessions/"+sid.String(), ""), "use logout")
+		another := util.NewID()
+		assert.Equal(http.StatusNotFound, status(http.MethodDelete, "/sessions/"+another.String(), ""),
+			"the session of another user")
+		assert.Equal(0, up.Calls("DELETE /v1/session"))
+
+		assert.False(revoked(others[0]))
+		assert.Equal(http.StatusOK, status(http.MethodDelete, "/sessions/"+others[0].String(), ""))
+		assert.Equal(1, up.Calls("DELETE /v1/session"))
+		assert.True(revoked(others[0]))
+		assert.False(revoked(others[1]))
+		assert.False(revoked(sid))
+	})
+
+	t.Run("revoke others", func(t *testing.T) {
+		assert.Equal(http.StatusOK, status(http.MethodPost, "/sessions/revoke_others", ""))
+		assert.Equal(1, up.Calls("POST /v1/session/revoke_others"))
+		assert.True(revoked(others[1]))
+		assert.False(revoked(sid), "the current session is kept")
+	})
+}
+
+func TestUpdateUserInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, _ := newTestServer(t, up, nil, nil)
+	uid := util.NewID()
+	cookie := loginTestUser(up, uid)
+	legacy := "https://avatars.githubusercontent.com/u/1"
+	up.Handle("GET /v1/user", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.UserInfo]{Result: bll.UserInfo{ID: &uid, Name: "alice", Picture: legacy}}
+	})
+	var updates []bll.UpdateUserInput
+	up.Handle("PATCH /v1/user", func(body []byte) (int, any) {
+		input := bll.UpdateUserInput{}
+		cbor.Unmarshal(body, &input)
+		updates = append(updates, input)
+		return http.StatusOK, bll.SuccessResponse[bll.UserInfo]{Result: bll.UserInfo{ID: &uid, Name: input.Name, Picture: input.Picture}}
+	})
+
+	patch := func(body string) (int, map[string]any) {
+		req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/userinfo", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		res, err := testClient.Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		output := map[string]any{}
+		json.NewDecoder(res.Body).Decode(&output)
+		return res.StatusCode, output
+	}
+
+	// the client sends back the legacy IdP picture unchanged
+	code, output := patch(`{"name":"Alice","picture":"` + legacy + `"}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal([]bll.UpdateUserInput{{ID: &uid, Name: "Alice"}}, updates, "the picture is not updated")
+	assert.Equal("Alice", output["name"])
+	assert.NotContains(output, "id")
+
+	code, output = patch(`{"picture":"` + legacy + `"}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Len(updates, 1, "nothing to update")
+	assert.Equal(legacy, output["picture"])
+	assert.NotContains(output, "id")
+
+	code, _ = patch(`{"name":"Alice","picture":"https://example.com/a.jpg"}`)
+	assert.Equal(http.StatusBadRequest, code, "the new picture should be in the object store")
+	assert.Len(updates, 1)
+
+	picture := conf.Config.OSS.UrlBase + "pic/1/400.jpg"
+	code, _ = patch(`{"picture":"` + picture + `"}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(bll.UpdateUserInput{ID: &uid, Picture: picture}, updates[1])
+}
+
+// testFailingStore is the nonce store in outage.
+type testFailingStore struct {
+	service.NonceStore
+}
+
+func (s *testFailingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.New("store outage")
+}
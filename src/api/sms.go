@@ -0,0 +1,173 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ldclabs/cose/key"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+const (
+	smsSendInterval     = time.Minute
+	maxSMSSendsPerPhone = 10 // in smsSendWindow
+	maxSMSSendsPerIP    = 20 // in smsSendWindow
+	smsSendWindow       = time.Hour
+	maxSMSCodeAttempts  = 5
+	smsCodeDigits       = 6
+	smsChallengeKind    = "sms_code"
+)
+
+type SMSSendCodeInput struct {
+	Phone string `json:"phone" cbor:"phone" form:"phone"`
+}
+
+func (i *SMSSendCodeInput) Validate() error {
+	phone, err := util.NormalizePhone(i.Phone)
+	if err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+	i.Phone = phone
+	return nil
+}
+
+type SMSSendCodeOutput struct {
+	// The challenge should be sent back with the code to POST /sms/verify.
+	Challenge string `json:"challenge"`
+	ExpiresIn uint   `json:"expires_in"`
+}
+
+type SMSVerifyInput struct {
+	Challenge string `json:"challenge" cbor:"challenge" form:"challenge"`
+	Code      string `json:"code" cbor:"code" form:"code"`
+}
+
+func (i *SMSVerifyInput) Validate() error {
+	if i.Challenge == "" || i.Code == "" {
+		return gear.ErrBadRequest.WithMsg("challenge and code required")
+	}
+	return nil
+}
+
+// SMSSendCode sends the one-time code to the mainland China mobile number.
+func (a *AuthN) SMSSendCode(ctx *gear.Context) error {
+	input := &SMSSendCodeInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	if err := a.throttleSMS(ctx, input.Phone); err != nil {
+		return err
+	}
+
+	code, err := randomDigits(smsCodeDigits)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	id := key.GetRandomBytes(16)
+	codeMAC, err := a.stateMACer.MACCreate(oneTimeCodeData(smsChallengeKind, id, code))
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	challenge, err := sealState(a.stateMACer, statePurposeSMSChallenge, key.IntMap{
+		0: time.Now().Add(a.smsTTL()).Unix(),
+		1: smsChallengeKind,
+		2: input.Phone,
+		3: id,
+		4: codeMAC,
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if err = a.smsSender.SendCode(ctx, input.Phone, code); err != nil {
+		logging.SetTo(ctx, "error", fmt.Sprintf("send sms failed: %v", err))
+		return gear.ErrBadGateway.WithMsg("failed to send sms")
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[SMSSendCodeOutput]{Result: SMSSendCodeOutput{
+		Challenge: challenge,
+		ExpiresIn: a.sms.ExpiresIn,
+	}})
+}
+
+// SMSVerify logs in with the one-time code, the user is created if the number is new.
+func (a *AuthN) SMSVerify(ctx *gear.Context) error {
+	input := &SMSVerifyInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	payload, err := openState(a.stateMACer, statePurposeSMSChallenge, input.Challenge)
+	if err == nil {
+		if v, _ := payload.GetString(1); v != smsChallengeKind {
+			err = fmt.Errorf("unexpected state kind %q", v)
+		} else if v, _ := payload.GetString(2); v == "" {
+			err = fmt.Errorf("invalid sms state")
+		}
+	}
+	if err != nil {
+		failAttempt(ctx)
+		logging.SetTo(ctx, "error", err.Error())
+		return gear.ErrUnauthorized.WithMsg("invalid or expired challenge, please try again")
+	}
+	phone, _ := payload.GetString(2)
+	id, _ := payload.GetBytes(3)
+	codeMAC, _ := payload.GetBytes(4)
+	if err = lockoutSubject(ctx, "phone", phone); err != nil {
+		return err
+	}
+
+	if n, err := a.nonces.Incr(ctx, "sms_code:"+util.Bytes(id).String()+":attempts", a.smsTTL()); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if n > maxSMSCodeAttempts {
+		return gear.ErrTooManyRequests.WithMsg("too many attempts, please try again")
+	}
+	if err = a.stateMACer.MACVerify(oneTimeCodeData(smsChallengeKind, id, strings.TrimSpace(input.Code)), codeMAC); err != nil {
+		util.MetricLogins.WithLabelValues("phone", "failure").Inc()
+		failAttempt(ctx)
+		return gear.ErrForbidden.WithMsg("invalid code")
+	}
+
+	output, pending, err := a.loginWithCode(ctx, "sms", id, a.smsTTL(), &bll.AuthNInput{
+		Idp:  "phone",
+		Aud:  "phone",
+		Sub:  phone,
+		User: bll.UserInfo{Name: util.MaskPhone(phone)},
+	}, "")
+	if err != nil {
+		return err
+	}
+	return a.sendCodeLogin(ctx, output, pending, "sms")
+}
+
+// throttleSMS limits the sending per number and per IP, the number can receive one code per minute.
+func (a *AuthN) throttleSMS(ctx *gear.Context, phone string) error {
+	if ok, err := a.nonces.Consume(ctx, "sms_send_interval:"+phone, smsSendInterval); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if !ok {
+		return gear.ErrTooManyRequests.WithMsg("please wait a minute before resending")
+	}
+
+	if n, err := a.nonces.Incr(ctx, "sms_send:"+phone, smsSendWindow); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if n > maxSMSSendsPerPhone {
+		return gear.ErrTooManyRequests.WithMsg("too many codes for the number, please try again later")
+	}
+
+	if n, err := a.nonces.Incr(ctx, "sms_send_ip:"+ctx.IP().String(), smsSendWindow); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	} else if n > maxSMSSendsPerIP {
+		return gear.ErrTooManyRequests.WithMsg("too many codes, please try again later")
+	}
+	return nil
+}
+
+func (a *AuthN) smsTTL() time.Duration {
+	return time.Duration(a.sms.ExpiresIn) * time.Second
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ldclabs/cose/key"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+type testSMSSender struct {
+	mu    sync.Mutex
+	codes map[string]string // the last code sent to the number
+	sends int
+}
+
+func (s *testSMSSender) SendCode(ctx context.Context, phone, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.codes == nil {
+		s.codes = make(map[string]string)
+	}
+	s.codes[phone] = code
+	s.sends++
+	return nil
+}
+
+func (s *testSMSSender) code(phone string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.codes[phone]
+}
+
+func TestSMSLogin(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	var mu sync.Mutex
+	var logins []bll.AuthNInput
+	up.Handle("POST /v1/authn/login_or_new", func(body []byte) (int, any) {
+		input := bll.AuthNInput{}
+		cbor.Unmarshal(body, &input)
+		mu.Lock()
+		logins = append(logins, input)
+		mu.Unlock()
+		return http.StatusOK, bll.SuccessResponse[bll.AuthNSessionOutput]{Result: bll.AuthNSessionOutput{
+			SID:     util.NewID(),
+			UID:     util.Ptr(util.NewID()),
+			Session: "session",
+		}}
+	})
+	rl := conf.Config.RateLimit.Enabled
+	conf.Config.RateLimit.Enabled = false
+	t.Cleanup(func() { conf.Config.RateLimit.Enabled = rl })
+	sender := &testSMSSender{}
+	srv, apis := newTestServer(t, up, nil, sender)
+
+	post := func(path, body string) (*http.Response, map[string]any) {
+		res, err := testClient.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		assert.NoError(err)
+		defer res.Body.Close()
+		output := map[string]any{}
+		json.NewDecoder(res.Body).Decode(&output)
+		return res, output
+	}
+	sendCode := func(phone string) (int, string) {
+		res, output := post("/sms/send_code", `{"phone":"`+phone+`"}`)
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, ""
+		}
+		result := output["result"].(map[string]any)
+		assert.Equal(float64(conf.Config.SMS.ExpiresIn), result["expires_in"])
+		return res.StatusCode, result["challenge"].(string)
+	}
+	verify := func(challenge, code string) *http.Response {
+		res, _ := post("/sms/verify", `{"challenge":"`+challenge+`","code":"`+code+`"}`)
+		return res
+	}
+
+	t.Run("send code and login", func(t *testing.T) {
+		code, _ := sendCode("12345")
+		assert.Equal(http.StatusBadRequest, code)
+		code, _ = sendCode("+1 415 555 2671")
+		assert.Equal(http.StatusBadRequest, code, "only mainland China numbers")
+
+		code, challenge := sendCode("138-0013-8000")
+		assert.Equal(http.StatusOK, code)
+		assert.Regexp(`^\d{6}$`, sender.code("+8613800138000"), "normalized to E.164")
+
+		assert.Equal(http.StatusForbidden, verify(challenge, "wrong").StatusCode)
+		res := verify(challenge, sender.code("+8613800138000"))
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal("session", testCookie(res, "_SESS").Value)
+		assert.Len(logins, 1)
+		assert.Equal("phone", logins[0].Idp)
+		assert.Equal("+8613800138000", logins[0].Sub)
+		assert.Equal("138****8000", logins[0].User.Name)
+
+		assert.Equal(http.StatusForbidden, verify(challenge, sender.code("+8613800138000")).StatusCode,
+			"the code can be used only once")
+		assert.Len(logins, 1)
+	})
+
+	t.Run("invalid challenge", func(t *testing.T) {
+		assert.Equal(http.StatusUnauthorized, verify("invalid", "123456").StatusCode)
+
+		expired, err := sealState(apis.AuthN.stateMACer, statePurposeSMSChallenge, key.IntMap{
+			0: time.Now().Add(-time.Second).Unix(),
+			1: smsChallengeKind,
+			2: "+8613800138001",
+			3: key.GetRandomBytes(16),
+			4: key.GetRandomBytes(32),
+		})
+		assert.NoError(err)
+		assert.Equal(http.StatusUnauthorized, verify(expired, "123456").StatusCode)
+
+		// the email challenge can not be used for the sms login
+		wrong, err := sealState(apis.AuthN.stateMACer, statePurposeEmailChallenge, key.IntMap{
+			0: time.Now().Add(time.Minute).Unix(),
+			1: smsChallengeKind,
+			2: "+8613800138001",
+		})
+		assert.NoError(err)
+		assert.Equal(http.StatusUnauthorized, verify(wrong, "123456").StatusCode)
+	})
+
+	t.Run("too many attempts", func(t *testing.T) {
+		code, challenge := sendCode("13800138002")
+		assert.Equal(http.StatusOK, code)
+		for i := 0; i < maxSMSCodeAttempts; i++ {
+			assert.Equal(http.StatusForbidden, verify(challenge, "wrong").StatusCode)
+		}
+		assert.Equal(http.StatusTooManyRequests, verify(challenge, sender.code("+8613800138002")).StatusCode)
+		assert.Len(logins, 1)
+	})
+
+	t.Run("throttle per number", func(t *testing.T) {
+		phone := "+8613800138003"
+		code, _ := sendCode(phone)
+		assert.Equal(http.StatusOK, code)
+		code, _ = sendCode(phone)
+		assert.Equal(http.StatusTooManyRequests, code, "one code per minute")
+
+		for i := 1; i < maxSMSSendsPerPhone; i++ {
+			assert.NoError(apis.AuthN.nonces.Delete(context.Background(), "sms_send_interval:"+phone))
+			code, _ = sendCode(phone)
+			assert.Equal(http.StatusOK, code)
+		}
+		assert.NoError(apis.AuthN.nonces.Delete(context.Background(), "sms_send_interval:"+phone))
+		code, _ = sendCode(phone)
+		assert.Equal(http.StatusTooManyRequests, code, "too many codes in the window")
+	})
+
+	t.Run("throttle per IP", func(t *testing.T) {
+		// the codes sent above count for the IP too
+		sender.mu.Lock()
+		sent := sender.sends
+		sender.mu.Unlock()
+		for i := sent; i < maxSMSSendsPerIP; i++ {
+			code, _ := sendCode(fmt.Sprintf("1390013%04d", i))
+			assert.Equal(http.StatusOK, code)
+		}
+		code, _ := sendCode("13900139999")
+		assert.Equal(http.StatusTooManyRequests, code)
+		assert.Equal("", sender.code("+8613900139999"))
+	})
+}
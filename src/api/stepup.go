@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// Authentication assurance levels of the session.
+const (
+	AALSingleFactor = 1 // OAuth IdP
+	AALMultiFactor  = 2 // passkey, or OAuth IdP with 2FA
+)
+
+// authnContext records how and when the session was authenticated, it is kept in the nonce store
+// by the session id, so the bearer access tokens of the session share it with the cookie.
+type authnContext struct {
+	AuthAt int64  `cbor:"1,keyasint"`
+	Level  int    `cbor:"2,keyasint"`
+	Method string `cbor:"3,keyasint"`
+}
+
+// StepUpRequirement is the data of the 401 response, it tells the client how to step up.
+type StepUpRequirement struct {
+	Level   int      `json:"level"`
+	MaxAge  uint     `json:"max_age"`
+	Methods []string `json:"methods"`
+}
+
+// StepUp requires a recent and strong enough authentication for the sensitive operations.
+// It should be used after Session.Verify.
+func (a *AuthN) StepUp(ctx *gear.Context) error {
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.SID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	err := a.checkStepUp(ctx, *sess.SID)
+	if err == nil {
+		return nil
+	}
+
+	logging.SetTo(ctx, "error", err.Error())
+	methods := []string{"passkey", "totp"}
+	if a.stepUp.Level <= AALSingleFactor {
+		methods = append(methods, "idp")
+	}
+	er := gear.ErrUnauthorized.WithErr("StepUpRequired").WithMsg("recent authentication required")
+	er.Data = &StepUpRequirement{
+		Level:   a.stepUp.Level,
+		MaxAge:  a.stepUp.MaxAge,
+		Methods: methods,
+	}
+	return er
+}
+
+// checkStepUp returns an error if the session was not authenticated recently or strongly enough.
+func (a *AuthN) checkStepUp(ctx *gear.Context, sid util.ID) error {
+	ac, err := a.readAuthnContext(ctx, sid)
+	if err != nil {
+		return err
+	}
+	if ac.Level < a.stepUp.Level {
+		return fmt.Errorf("assurance level %d is lower than %d", ac.Level, a.stepUp.Level)
+	}
+	if time.Since(time.Unix(ac.AuthAt, 0)) > time.Duration(a.stepUp.MaxAge)*time.Second {
+		return fmt.Errorf("authenticated at %d is too old", ac.AuthAt)
+	}
+	return nil
+}
+
+// MFAStepUp re-authenticates the current session with the second factor.
+func (a *AuthN) MFAStepUp(ctx *gear.Context) error {
+	input := &MFACodeInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[bll.SessionOutput](ctx)
+	if sess == nil || sess.UID == nil || sess.SID == nil {
+		return gear.ErrUnauthorized.WithMsg("missing session")
+	}
+
+	info, err := a.enabledMFA(ctx, *sess.UID)
+	if err != nil {
+		return err
+	}
+	if err = a.verifySecondFactor(ctx, info, input); err != nil {
+		a.blls.Logbase.Log(ctx, bll.LogActionUserVerifyMFA, -1, *sess.UID, *sess.UID, nil)
+		return err
+	}
+
+	a.blls.Logbase.Log(ctx, bll.LogActionUserVerifyMFA, 1, *sess.UID, *sess.UID, nil)
+	if err = a.setAuthnContext(ctx, *sess.SID, AALMultiFactor, "totp"); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return ctx.OkSend(bll.SuccessResponse[bool]{Result: true})
+}
+
+func authnContextKey(sid util.ID) string {
+	return "aal:" + sid.String()
+}
+
+// setAuthnContext records the authentication context of the session for the lifetime of the session cookie.
+func (a *AuthN) setAuthnContext(ctx *gear.Context, sid util.ID, level int, method string) error {
+	data, err := cbor.Marshal(&authnContext{AuthAt: time.Now().Unix(), Level: level, Method: method})
+	if err != nil {
+		return err
+	}
+	return a.nonces.Set(ctx, authnContextKey(sid), data, time.Duration(a.cookie.ExpiresIn)*time.Second)
+}
+
+func (a *AuthN) readAuthnContext(ctx *gear.Context, sid util.ID) (*authnContext, error) {
+	data, err := a.nonces.Get(ctx, authnContextKey(sid))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("missing authentication context")
+	}
+
+	ac := &authnContext{}
+	if err = cbor.Unmarshal(data, ac); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
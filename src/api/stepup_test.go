@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/bll"
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestStepUp(t *testing.T) {
+	assert := assert.New(t)
+
+	up := newTestUpstream(t)
+	srv, apis := newTestServer(t, up, nil, nil)
+	sign := testTokenSigner(t, apis)
+
+	uid, sid := util.NewID(), util.NewID()
+	up.Handle("POST /v1/session/verify", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.SessionOutput]{Result: bll.SessionOutput{SID: &sid, UID: &uid}}
+	})
+	up.Handle("POST /v1/session/renew_token", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.SessionOutput]{Result: bll.SessionOutput{
+			SID: &sid, UID: &uid, AccessToken: sign(util.JARVIS.String(), sid, uid), ExpiresIn: 3600,
+		}}
+	})
+	up.Handle("GET /v1/passkey/list", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[[]bll.PassKeyInfo]{Result: []bll.PassKeyInfo{}}
+	})
+	secret := util.NewTOTPSecret()
+	encrypted, err := apis.AuthN.encryptTOTPSecret(uid, secret)
+	assert.NoError(err)
+	up.Handle("GET /v1/user/mfa", func(body []byte) (int, any) {
+		return http.StatusOK, bll.SuccessResponse[bll.MFAInfo]{Result: bll.MFAInfo{UID: uid, TOTPSecret: encrypted, Enabled: true}}
+	})
+
+	cookie := &http.Cookie{Name: conf.Config.Cookie.NamePrefix + "_SESS", Value: "session"}
+	do := func(method, path, body string, auth func(*http.Request)) (int, map[string]any) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		auth(req)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		output := make(map[string]any)
+		json.NewDecoder(res.Body).Decode(&output)
+		return res.StatusCode, output
+	}
+	withCookie := func(req *http.Request) { req.AddCookie(cookie) }
+
+	code, output := do(http.MethodGet, "/access_token", "", withCookie)
+	assert.Equal(http.StatusOK, code)
+	token := output["access_token"].(string)
+	assert.Nil(output["sid"])
+	withBearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	// the bearer client without the authentication context
+	code, output = do(http.MethodDelete, "/passkeys/abc", "", withBearer(token))
+	assert.Equal(http.StatusUnauthorized, code)
+	assert.Equal("StepUpRequired", output["error"])
+
+	// the bearer client steps up with TOTP
+	totp := util.HOTP(secret, util.TOTPCounter(time.Now()), 6)
+	code, _ = do(http.MethodPost, "/2fa/step_up", `{"code":"`+totp+`"}`, withBearer(token))
+	assert.Equal(http.StatusOK, code)
+	code, _ = do(http.MethodDelete, "/passkeys/abc", "", withBearer(token))
+	assert.Equal(http.StatusNotFound, code, "passed the step-up")
+
+	// the cookie of the same session shares the authentication context
+	code, _ = do(http.MethodDelete, "/passkeys/abc", "", withCookie)
+	assert.Equal(http.StatusNotFound, code, "passed the step-up")
+
+	// another session
+	sid = util.NewID()
+	code, output = do(http.MethodDelete, "/passkeys/abc", "", withCookie)
+	assert.Equal(http.StatusUnauthorized, code)
+	assert.Equal("StepUpRequired", output["error"])
+
+	// the token of the first session still passes
+	code, _ = do(http.MethodDelete, "/passkeys/abc", "", withBearer(token))
+	assert.Equal(http.StatusNotFound, code)
+
+	// the outdated authentication context
+	ac := &authnContext{AuthAt: time.Now().Add(-time.Hour).Unix(), Level: AALMultiFactor, Method: "totp"}
+	data, _ := cbor.Marshal(ac)
+	assert.NoError(apis.AuthN.nonces.Set(context.Background(), authnContextKey(sid), data, time.Hour))
+	code, output = do(http.MethodDelete, "/passkeys/abc", "", withCookie)
+	assert.Equal(http.StatusUnauthorized, code)
+	assert.Equal("StepUpRequired", output["error"])
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/teambition/gear"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// tracing starts the server span of the request, the trace context from the client is respected.
+// The span is named by the route pattern when it ends.
+func tracing(ctx *gear.Context) error {
+	pctx := otel.GetTextMapPropagator().Extract(ctx.Context(), propagation.HeaderCarrier(ctx.Req.Header))
+	sctx, span := util.Tracer.Start(pctx, ctx.Method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(ctx.Method),
+			semconv.URLPath(ctx.Path),
+			semconv.ServerAddress(ctx.Host),
+			semconv.ClientAddress(ctx.IP().String()),
+		))
+	ctx.WithContext(sctx)
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		logging.SetTo(ctx, "trace_id", sc.TraceID().String())
+	}
+
+	ctx.OnEnd(func() {
+		if pattern := gear.GetRouterPatternFromCtx(ctx); pattern != "" {
+			span.SetName(ctx.Method + " " + pattern)
+			span.SetAttributes(semconv.HTTPRoute(pattern))
+		}
+		status := ctx.Res.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	})
+	return nil
+}
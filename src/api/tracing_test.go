@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	sr := tracetest.NewSpanRecorder()
+	tracer := util.Tracer
+	util.Tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() {
+		util.Tracer = tracer
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	scs := make(chan trace.SpanContext, 1)
+	router := gear.NewRouter()
+	router.Get("/users/:id", func(ctx *gear.Context) error {
+		scs <- trace.SpanContextFromContext(ctx.Context())
+		if ctx.Param("id") == "fail" {
+			return gear.ErrInternalServerError.WithMsg("failed")
+		}
+		return ctx.End(http.StatusNoContent)
+	})
+	app := gear.New()
+	app.Use(tracing)
+	app.UseHandler(router)
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+
+	get := func(path, traceparent string) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if traceparent != "" {
+			req.Header.Set("Traceparent", traceparent)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+	}
+	// the span ends after the response in the end hook
+	ended := func(n int) []sdktrace.ReadOnlySpan {
+		assert.Eventually(func() bool { return len(sr.Ended()) == n }, time.Second, 10*time.Millisecond)
+		return sr.Ended()
+	}
+	attr := func(s sdktrace.ReadOnlySpan, key string) string {
+		for _, kv := range s.Attributes() {
+			if string(kv.Key) == key {
+				return kv.Value.Emit()
+			}
+		}
+		return ""
+	}
+
+	t.Run("continues the trace of the client", func(t *testing.T) {
+		get("/users/123", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		sc := <-scs
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+
+		s := ended(1)[0]
+		assert.Equal(sc.SpanID(), s.SpanContext().SpanID(), "the handler runs in the server span")
+		assert.Equal("00f067aa0ba902b7", s.Parent().SpanID().String())
+		assert.True(s.Parent().IsRemote())
+		assert.Equal(trace.SpanKindServer, s.SpanKind())
+		assert.Equal("GET /users/:id", s.Name(), "named by the route pattern")
+		assert.Equal("/users/:id", attr(s, string(semconv.HTTPRouteKey)))
+		assert.Equal("204", attr(s, string(semconv.HTTPResponseStatusCodeKey)))
+		assert.Equal(codes.Unset, s.Status().Code)
+	})
+
+	t.Run("starts a new trace and marks the server error", func(t *testing.T) {
+		get("/users/fail", "")
+		<-scs
+		s := ended(2)[1]
+		assert.False(s.Parent().IsValid())
+		assert.NotEqual("4bf92f3577b34da6a3ce929d0e0e4736", s.SpanContext().TraceID().String())
+		assert.Equal("500", attr(s, string(semconv.HTTPResponseStatusCodeKey)))
+		assert.Equal(codes.Error, s.Status().Code)
+	})
+}
@@ -2,6 +2,9 @@ package bll
 
 import (
 	"context"
+	"net/url"
+
+	"github.com/teambition/gear"
 
 	"github.com/yiwen-ai/auth-api/src/conf"
 	"github.com/yiwen-ai/auth-api/src/logging"
@@ -15,52 +18,213 @@ type AuthN struct {
 }
 
 func (b *AuthN) LoginOrNew(ctx context.Context, input *AuthNInput) (*AuthNSessionOutput, error) {
+	// userbase names the new user by the identity, the subject is the name if the IdP does not respond one.
+	// The existing user is not renamed by it, the profile sync uses the name from the IdP only.
+	req := *input
+	if req.User.Name == "" {
+		req.User.Name = req.Sub
+	}
+
 	output := SuccessResponse[AuthNSessionOutput]{}
-	if err := b.svc.Post(ctx, "/v1/authn/login_or_new", input, &output); err != nil {
+	if err := b.svc.Post(ctx, "/v1/authn/login_or_new", &req, &output); err != nil {
 		return nil, err
 	}
 
 	gctx := conf.WithGlobalCtx(ctx)
-	go b.updateUserPicture(gctx, &output.Result, input.User.Picture)
+	go b.syncUserProfile(gctx, &output.Result, input)
+	return &output.Result, nil
+}
+
+// ListAuthN returns the identities of the user linked from the IdPs.
+func (b *AuthN) ListAuthN(ctx context.Context, uid util.ID) ([]AuthNOutput, error) {
+	output := SuccessResponse[[]AuthNOutput]{}
+	if err := b.svc.Get(ctx, "/v1/authn/list?uid="+uid.String(), &output); err != nil {
+		return nil, err
+	}
+	return output.Result, nil
+}
+
+type LinkAuthNInput struct {
+	UID     util.ID  `json:"uid" cbor:"uid"`
+	Idp     string   `json:"idp" cbor:"idp"`
+	Aud     string   `json:"aud" cbor:"aud"`
+	Sub     string   `json:"sub" cbor:"sub"`
+	Payload []byte   `json:"payload" cbor:"payload"`
+	CoAuthN *AuthNPK `json:"co_authn,omitempty" cbor:"co_authn,omitempty"`
+}
+
+// Link links the identity to the user, userbase responds 409 if it is linked to another user.
+func (b *AuthN) Link(ctx context.Context, uid util.ID, input *AuthNInput) (*AuthNOutput, error) {
+	output := SuccessResponse[AuthNOutput]{}
+	if err := b.svc.Post(ctx, "/v1/authn/link", &LinkAuthNInput{
+		UID:     uid,
+		Idp:     input.Idp,
+		Aud:     input.Aud,
+		Sub:     input.Sub,
+		Payload: input.Payload,
+		CoAuthN: input.CoAuthN,
+	}, &output); err != nil {
+		return nil, err
+	}
 	return &output.Result, nil
 }
 
-func (b *AuthN) updateUserPicture(gctx context.Context, input *AuthNSessionOutput, imgUrl string) {
-	picture := input.Sub.Base64()
-	if imgUrl == "" || input.Picture != "" {
+// Unlink deletes the identities of the user from the IdP.
+func (b *AuthN) Unlink(ctx context.Context, uid util.ID, idp string) (*SuccessResponse[bool], error) {
+	output := SuccessResponse[bool]{}
+	query := url.Values{}
+	query.Add("uid", uid.String())
+	query.Add("idp", idp)
+	if err := b.svc.Delete(ctx, "/v1/authn?"+query.Encode(), &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+// syncUserProfile saves the IdP picture for the user without a picture. If the user syncs the profile
+// from the IdP, the name and the picture are updated when they are changed.
+func (b *AuthN) syncUserProfile(gctx context.Context, sess *AuthNSessionOutput, input *AuthNInput) {
+	provider, ok := conf.Config.Providers[input.Idp]
+	if !ok {
 		return
 	}
 
 	conf.Config.ObtainJob()
 	defer conf.Config.ReleaseJob()
+	gctx, span := util.StartBackgroundSpan(gctx, "syncUserProfile")
+	defer span.End()
 
-	url, err := b.oss.SavePicture(gctx, picture, imgUrl)
-	if err != nil {
-		logging.Errf("SavePicture for %s error: %v", input.UID.String(), err)
+	syncName, syncPicture := decideProfileSync(sess, input, func() bool {
+		sync, err := b.syncEnabled(gctx, *sess.UID, input)
+		if err != nil {
+			logging.Errf("syncEnabled for %s error: %v", sess.UID.String(), err)
+		}
+		return sync
+	})
+
+	update := UpdateUserInput{ID: sess.UID}
+	if syncName {
+		update.Name = input.User.Name
+		if err := util.Validator.Struct(&update); err != nil {
+			update.Name = ""
+		}
+	}
+
+	if syncPicture {
+		url, err := b.oss.SavePicture(gctx, input.User.Picture, provider.PictureHosts, sess.Picture)
+		switch {
+		case err != nil:
+			logging.Errf("SavePicture for %s error: %v", sess.UID.String(), err)
+		case url != sess.Picture:
+			update.Picture = url
+		}
+	}
+
+	if update.Name == "" && update.Picture == "" {
+		return
+	}
+	output := SuccessResponse[any]{}
+	if err := b.svc.Patch(gctx, "/v1/user", &update, &output); err != nil {
+		logging.Errf("syncUserProfile for %s error: %v", sess.UID.String(), err)
 		return
 	}
+	logging.Infof("syncUserProfile for %s success, name: %q, picture: %q", sess.UID.String(), update.Name, update.Picture)
+
+	// the user is updated, the logo of the group follows it as UploadPicture
+	if update.Picture != "" {
+		if err := b.updateGroupLogo(gctx, *sess.UID, update.Picture); err != nil {
+			logging.Errf("updateGroupLogo for %s error: %v", sess.UID.String(), err)
+		} else {
+			logging.Infof("updateGroupLogo for %s success, %s", sess.UID.String(), update.Picture)
+		}
+	}
+}
+
+// decideProfileSync decides whether to sync the name and the picture from the identity on login.
+// The sync preference is looked up by syncEnabled only if userbase does not respond it.
+func decideProfileSync(sess *AuthNSessionOutput, input *AuthNInput, syncEnabled func() bool) (syncName, syncPicture bool) {
+	if input.User.Name == "" && input.User.Picture == "" {
+		return false, false
+	}
+
+	var sync bool
+	if sess.SyncProfile != nil {
+		sync = *sess.SyncProfile
+	} else {
+		sync = syncEnabled()
+	}
 
+	syncName = sync && input.User.Name != "" && input.User.Name != sess.Name
+	syncPicture = input.User.Picture != "" && (sync || sess.Picture == "")
+	return syncName, syncPicture
+}
+
+// syncEnabled reports whether the user syncs the profile from the identity.
+func (b *AuthN) syncEnabled(ctx context.Context, uid util.ID, input *AuthNInput) (bool, error) {
+	authns, err := b.ListAuthN(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range authns {
+		if v.Idp == input.Idp && v.Sub == input.Sub {
+			return v.SyncProfile, nil
+		}
+	}
+	return false, nil
+}
+
+type UpdateAuthNInput struct {
+	UID         util.ID `json:"uid" cbor:"uid"`
+	Idp         string  `json:"idp" cbor:"idp"`
+	SyncProfile bool    `json:"sync_profile" cbor:"sync_profile"`
+}
+
+func (i *UpdateAuthNInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// UpdateAuthN updates the preferences of the identities of the user from the IdP.
+func (b *AuthN) UpdateAuthN(ctx context.Context, input *UpdateAuthNInput) (*SuccessResponse[bool], error) {
+	output := SuccessResponse[bool]{}
+	if err := b.svc.Patch(ctx, "/v1/authn", input, &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+// UploadPicture saves the picture uploaded by the user, and sets it as the picture of the user.
+// It is also set as the logo of the personal group, a failure of which is logged but not returned.
+func (b *AuthN) UploadPicture(ctx context.Context, uid util.ID, data []byte) (*UserInfo, error) {
+	url, err := b.oss.PutPicture(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	output := SuccessResponse[UserInfo]{}
+	if err := b.svc.Patch(ctx, "/v1/user", &UpdateUserInput{ID: &uid, Picture: url}, &output); err != nil {
+		return nil, err
+	}
+
+	// the user is updated, the logo of the group is best-effort
+	if err := b.updateGroupLogo(ctx, uid, url); err != nil {
+		logging.Errf("updateGroupLogo for %s error: %v", uid.String(), err)
+	}
+	return &output.Result, nil
+}
+
+// updateGroupLogo updates the logo of the personal group, its id is the user id.
+func (b *AuthN) updateGroupLogo(ctx context.Context, uid util.ID, url string) error {
 	update := struct {
 		ID   util.ID `json:"id" cbor:"id"`
 		Logo string  `json:"logo" cbor:"logo"`
 	}{
-		ID:   *input.UID,
+		ID:   uid,
 		Logo: url,
 	}
 	output := SuccessResponse[any]{}
-	if err := b.svc.Patch(gctx, "/v1/group", &update, &output); err != nil {
-		logging.Errf("updateGroupPicture for %s error: %v", input.UID.String(), err)
-	} else {
-		logging.Infof("updateGroupPicture for %s success, %s", input.UID.String(), url)
-	}
-
-	updateUser := UpdateUserInput{
-		ID:      input.UID,
-		Picture: url,
-	}
-	if err := b.svc.Patch(gctx, "/v1/user", &updateUser, &output); err != nil {
-		logging.Errf("updateUserPicture for %s error: %v", input.UID.String(), err)
-	} else {
-		logging.Infof("updateUserPicture for %s success, %s", input.UID.String(), url)
-	}
+	return b.svc.Patch(ctx, "/v1/group", &update, &output)
 }
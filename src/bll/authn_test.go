@@ -0,0 +1,52 @@
+package bll
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func TestDecideProfileSync(t *testing.T) {
+	assert := assert.New(t)
+
+	idp := UserInfo{Name: "alice", Picture: "https://avatars.githubusercontent.com/u/1"}
+	for _, c := range []struct {
+		name        string
+		sess        AuthNSessionOutput
+		user        UserInfo
+		enabled     bool
+		syncName    bool
+		syncPicture bool
+		lookup      bool
+	}{
+		{name: "nothing from idp", sess: AuthNSessionOutput{SyncProfile: util.Ptr(true)}},
+		{name: "picture kept without sync", sess: AuthNSessionOutput{Name: "bob", Picture: "p", SyncProfile: util.Ptr(false)}, user: idp},
+		{name: "picture kept, lookup disabled", sess: AuthNSessionOutput{Name: "bob", Picture: "p"}, user: idp,
+			lookup: true},
+		{name: "picture synced, lookup enabled", sess: AuthNSessionOutput{Name: "bob", Picture: "p"}, user: idp, enabled: true,
+			syncName: true, syncPicture: true, lookup: true},
+		{name: "synced", sess: AuthNSessionOutput{Name: "bob", Picture: "p", SyncProfile: util.Ptr(true)}, user: idp,
+			syncName: true, syncPicture: true},
+		{name: "name unchanged", sess: AuthNSessionOutput{Name: "alice", Picture: "p", SyncProfile: util.Ptr(true)}, user: idp,
+			syncPicture: true},
+		{name: "missing picture without sync", sess: AuthNSessionOutput{Name: "bob", SyncProfile: util.Ptr(false)}, user: idp,
+			syncPicture: true},
+		{name: "missing picture, lookup disabled", sess: AuthNSessionOutput{Name: "bob"}, user: idp,
+			syncPicture: true, lookup: true},
+		{name: "missing picture, lookup enabled", sess: AuthNSessionOutput{Name: "bob"}, user: idp, enabled: true,
+			syncName: true, syncPicture: true, lookup: true},
+		{name: "no picture from idp", sess: AuthNSessionOutput{Name: "bob", SyncProfile: util.Ptr(true)}, user: UserInfo{Name: "alice"},
+			syncName: true},
+	} {
+		looked := false
+		syncName, syncPicture := decideProfileSync(&c.sess, &AuthNInput{User: c.user}, func() bool {
+			looked = true
+			return c.enabled
+		})
+		assert.Equal(c.syncName, syncName, c.name)
+		assert.Equal(c.syncPicture, syncPicture, c.name)
+		assert.Equal(c.lookup, looked, c.name)
+	}
+}
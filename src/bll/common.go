@@ -2,6 +2,7 @@ package bll
 
 import (
 	"context"
+	"strings"
 
 	"github.com/teambition/gear"
 	"github.com/yiwen-ai/auth-api/src/conf"
@@ -24,6 +25,9 @@ type Blls struct {
 // NewBlls ...
 func NewBlls(oss *service.OSS) *Blls {
 	cfg := conf.Config.Base
+	util.RegisterUpstream(cfg.Userbase, "userbase")
+	util.RegisterUpstream(cfg.Logbase, "logbase")
+	util.RegisterUpstream(cfg.Walletbase, "walletbase")
 	return &Blls{
 		AuthN:      &AuthN{svc: service.APIHost(cfg.Userbase), oss: oss},
 		Logbase:    &Logbase{svc: service.APIHost(cfg.Logbase)},
@@ -36,6 +40,21 @@ func (b *Blls) Stats(ctx context.Context) (res map[string]any, err error) {
 	return b.Session.svc.Stats(ctx)
 }
 
+// Checks returns the readiness checks of the base services.
+func (b *Blls) Checks() map[string]func(context.Context) error {
+	check := func(svc service.APIHost) func(context.Context) error {
+		return func(ctx context.Context) error {
+			_, err := svc.Stats(ctx)
+			return err
+		}
+	}
+	return map[string]func(context.Context) error{
+		"userbase":   check(b.Session.svc),
+		"logbase":    check(b.Logbase.svc),
+		"walletbase": check(b.Walletbase.svc),
+	}
+}
+
 type SuccessResponse[T any] struct {
 	Result T `json:"result" cbor:"result"`
 }
@@ -54,6 +73,25 @@ func (i *UpdateUserInput) Validate() error {
 	return nil
 }
 
+// CheckPicture checks the picture with the current picture of the user. The new picture should be saved
+// in the object store, other services may fetch it, it can not be set without the url_base of the object store.
+// The unchanged picture, such as the legacy IdP URL, is accepted and removed from the input.
+func (i *UpdateUserInput) CheckPicture(current string) error {
+	if i.Picture == "" {
+		return nil
+	}
+	if i.Picture == current {
+		i.Picture = ""
+		return nil
+	}
+
+	base := conf.Config.OSS.UrlBase
+	if base == "" || !strings.HasPrefix(i.Picture, base) {
+		return gear.ErrBadRequest.WithMsgf("invalid picture %q", i.Picture)
+	}
+	return nil
+}
+
 type UserInfo struct {
 	ID      *util.ID `json:"id,omitempty" cbor:"id,omitempty"` // should not return to client
 	CN      string   `json:"cn" cbor:"cn"`
@@ -91,13 +129,21 @@ type AuthNSessionOutput struct {
 	Name          string    `json:"name" cbor:"name"`
 	Picture       string    `json:"picture" cbor:"picture"`
 	UserCreatedAt int64     `json:"user_created_at" cbor:"user_created_at"`
+	MFARequired   bool      `json:"mfa_required,omitempty" cbor:"-"`
+	// SyncProfile of the identity logged in, userbase responds it in /v1/authn/login_or_new,
+	// it is nil if userbase does not support it.
+	SyncProfile *bool `json:"-" cbor:"sync_profile,omitempty"`
 }
 
 type AuthNOutput struct {
-	Idp string   `json:"idp" cbor:"idp"`
-	Aud string   `json:"aud" cbor:"aud"`
-	Sub string   `json:"sub" cbor:"sub"`
-	UID *util.ID `json:"uid,omitempty" cbor:"uid,omitempty"`
+	Idp       string   `json:"idp" cbor:"idp"`
+	Aud       string   `json:"aud" cbor:"aud"`
+	Sub       string   `json:"sub" cbor:"sub"`
+	UID       *util.ID `json:"uid,omitempty" cbor:"uid,omitempty"`
+	CreatedAt int64    `json:"created_at,omitempty" cbor:"created_at,omitempty"`
+	// The name and the picture of the user are synced from the identity on login.
+	// userbase responds it in /v1/authn/list, and updates it by PATCH /v1/authn with UpdateAuthNInput.
+	SyncProfile bool `json:"sync_profile" cbor:"sync_profile"`
 }
 
 type SessionInput struct {
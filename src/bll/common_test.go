@@ -0,0 +1,48 @@
+package bll
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+func TestUpdateUserInputPicture(t *testing.T) {
+	base := conf.Config.OSS.UrlBase
+	t.Cleanup(func() { conf.Config.OSS.UrlBase = base })
+
+	for _, c := range []struct {
+		name    string
+		urlBase string
+		input   UpdateUserInput
+		current string
+		ok      bool
+	}{
+		{"name only", "", UpdateUserInput{Name: "alice"}, "", true},
+		{"invalid name", "", UpdateUserInput{Name: "a"}, "", false},
+		{"invalid picture", "", UpdateUserInput{Picture: "picture"}, "", false},
+		{"picture in the object store", "https://cdn.yiwen.pub/dev/", UpdateUserInput{Picture: "https://cdn.yiwen.pub/dev/pic/1/400.jpg"}, "", true},
+		{"external picture", "https://cdn.yiwen.pub/dev/", UpdateUserInput{Picture: "https://example.com/a.jpg"}, "", false},
+		{"prefix of the host", "https://cdn.yiwen.pub/dev/", UpdateUserInput{Picture: "https://cdn.yiwen.pub.evil.com/a.jpg"}, "", false},
+		{"missing url_base", "", UpdateUserInput{Picture: "https://example.com/a.jpg"}, "", false},
+		{"unchanged external picture", "https://cdn.yiwen.pub/dev/", UpdateUserInput{Picture: "https://example.com/a.jpg"}, "https://example.com/a.jpg", true},
+		{"another external picture", "https://cdn.yiwen.pub/dev/", UpdateUserInput{Picture: "https://example.com/b.jpg"}, "https://example.com/a.jpg", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conf.Config.OSS.UrlBase = c.urlBase
+			err := c.input.Validate()
+			if err == nil {
+				err = c.input.CheckPicture(c.current)
+			}
+			if c.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+			if c.current != "" && c.ok {
+				assert.Equal(t, "", c.input.Picture, "the unchanged picture is not updated")
+			}
+		})
+	}
+}
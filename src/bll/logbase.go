@@ -15,11 +15,20 @@ const (
 	LogActionSysUpdateUser     = "sys.update.user"
 	LogActionSysUpdateGroup    = "sys.update.group"
 	LogActionSysUpdateCreation = "sys.update.creation"
+	LogActionSysReplayToken    = "sys.replay.token"
 	LogActionUserLogin         = "user.login"
 	LogActionUserAuthz         = "user.authz"
 	LogActionUserUpdate        = "user.update"
 	LogActionUserUpdateCN      = "user.update.cn"
 	LogActionUserLogout        = "user.logout"
+	LogActionUserRevokeSession = "user.revoke.session"
+	LogActionUserUpdatePassKey = "user.update.passkey"
+	LogActionUserDeletePassKey = "user.delete.passkey"
+	LogActionUserLinkAuthN     = "user.link.authn"
+	LogActionUserUnlinkAuthN   = "user.unlink.authn"
+	LogActionUserEnableMFA     = "user.enable.mfa"
+	LogActionUserDisableMFA    = "user.disable.mfa"
+	LogActionUserVerifyMFA     = "user.verify.mfa"
 	LogActionUserCollect       = "user.collect"
 	LogActionUserFollow        = "user.follow"
 	LogActionUserSubscribe     = "user.subscribe"
@@ -80,8 +89,11 @@ type CreateLogInput struct {
 }
 
 type LogPayload struct {
-	Idp *string `json:"idp,omitempty" cbor:"idp,omitempty"`
-	Sub *string `json:"sub,omitempty" cbor:"sub,omitempty"`
+	Idp  *string `json:"idp,omitempty" cbor:"idp,omitempty"`
+	Sub  *string `json:"sub,omitempty" cbor:"sub,omitempty"`
+	Aud  *string `json:"aud,omitempty" cbor:"aud,omitempty"`
+	Kind *string `json:"kind,omitempty" cbor:"kind,omitempty"`
+	SID  *string `json:"sid,omitempty" cbor:"sid,omitempty"`
 }
 
 func (b *Logbase) Log(ctx *gear.Context, action string, status int8, uid, gid util.ID, payload any) (*LogOutput, error) {
@@ -0,0 +1,62 @@
+package bll
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// MFAInfo is the second factor of the user stored in userbase,
+// the TOTP secret is encrypted by the KEK and the recovery codes are hashed.
+type MFAInfo struct {
+	UID           util.ID    `json:"uid" cbor:"uid"`
+	TOTPSecret    util.Bytes `json:"totp_secret" cbor:"totp_secret"`
+	Enabled       bool       `json:"enabled" cbor:"enabled"`
+	RecoveryCodes []string   `json:"recovery_codes" cbor:"recovery_codes"`
+	UpdatedAt     int64      `json:"updated_at" cbor:"updated_at"`
+}
+
+// GetMFA returns nil if the user has not enrolled the second factor.
+func (b *Session) GetMFA(ctx context.Context, uid util.ID) (*MFAInfo, error) {
+	output := SuccessResponse[MFAInfo]{}
+	if err := b.svc.Get(ctx, "/v1/user/mfa?uid="+uid.String(), &output); err != nil {
+		if gear.ParseError(err).Status() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &output.Result, nil
+}
+
+func (b *Session) UpsertMFA(ctx context.Context, input *MFAInfo) (*MFAInfo, error) {
+	output := SuccessResponse[MFAInfo]{}
+	if err := b.svc.Put(ctx, "/v1/user/mfa", input, &output); err != nil {
+		return nil, err
+	}
+	return &output.Result, nil
+}
+
+func (b *Session) DeleteMFA(ctx context.Context, uid util.ID) (*SuccessResponse[bool], error) {
+	output := SuccessResponse[bool]{}
+	if err := b.svc.Delete(ctx, "/v1/user/mfa?uid="+uid.String(), &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+type UseRecoveryCodeInput struct {
+	UID  util.ID `json:"uid" cbor:"uid"`
+	Hash string  `json:"hash" cbor:"hash"`
+}
+
+// UseRecoveryCode removes the recovery code atomically, it returns false if the code is not found.
+func (b *Session) UseRecoveryCode(ctx context.Context, uid util.ID, hash string) (bool, error) {
+	output := SuccessResponse[bool]{}
+	if err := b.svc.Post(ctx, "/v1/user/mfa/use_recovery_code", &UseRecoveryCodeInput{UID: uid, Hash: hash}, &output); err != nil {
+		return false, err
+	}
+	return output.Result, nil
+}
@@ -2,7 +2,9 @@ package bll
 
 import (
 	"context"
+	"net/url"
 
+	"github.com/teambition/gear"
 	"github.com/yiwen-ai/auth-api/src/util"
 )
 
@@ -69,3 +71,57 @@ func (b *AuthN) PassKeyVerifyAuthentication(ctx context.Context, input *Authenti
 
 	return &output.Result, nil
 }
+
+type PassKeyInfo struct {
+	ID            string    `json:"id" cbor:"id"`
+	DisplayName   string    `json:"display_name" cbor:"display_name"`
+	AAGUID        util.UUID `json:"aaguid" cbor:"aaguid"`
+	Authenticator string    `json:"authenticator" cbor:"authenticator"` // authenticator name from the AAGUID
+	CreatedAt     int64     `json:"created_at" cbor:"created_at"`
+	LastUsedAt    int64     `json:"last_used_at" cbor:"last_used_at"`
+}
+
+// PassKeyList returns the registered passkeys of the user.
+func (b *AuthN) PassKeyList(ctx context.Context, uid util.ID) ([]PassKeyInfo, error) {
+	output := SuccessResponse[[]PassKeyInfo]{}
+	if err := b.svc.Get(ctx, "/v1/passkey/list?uid="+uid.String(), &output); err != nil {
+		return nil, err
+	}
+
+	return output.Result, nil
+}
+
+type UpdatePassKeyInput struct {
+	UID         util.ID `json:"uid" cbor:"uid"`
+	ID          string  `json:"id" cbor:"id"`
+	DisplayName string  `json:"display_name" cbor:"display_name" validate:"gte=1,lte=64"`
+}
+
+func (i *UpdatePassKeyInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+func (b *AuthN) PassKeyUpdate(ctx context.Context, input *UpdatePassKeyInput) (*PassKeyInfo, error) {
+	output := SuccessResponse[PassKeyInfo]{}
+	if err := b.svc.Patch(ctx, "/v1/passkey", input, &output); err != nil {
+		return nil, err
+	}
+
+	return &output.Result, nil
+}
+
+func (b *AuthN) PassKeyDelete(ctx context.Context, uid util.ID, id string) (*SuccessResponse[bool], error) {
+	output := SuccessResponse[bool]{}
+	query := url.Values{}
+	query.Add("uid", uid.String())
+	query.Add("id", id)
+	if err := b.svc.Delete(ctx, "/v1/passkey?"+query.Encode(), &output); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
@@ -27,6 +27,25 @@ func (b *Session) AccessToken(ctx context.Context, input *SessionInput) (*Sessio
 	return &output.Result, nil
 }
 
+type AuthorizeInput struct {
+	UID       util.ID  `json:"uid" cbor:"uid"`
+	Aud       util.ID  `json:"aud" cbor:"aud"`
+	Scope     []string `json:"scope" cbor:"scope"`
+	ExpiresIn uint     `json:"expires_in" cbor:"expires_in"`
+	Ip        string   `json:"ip" cbor:"ip"`
+	// The OIDC nonce of the authorization request, userbase emits it in the id_token.
+	Nonce string `json:"nonce,omitempty" cbor:"nonce,omitempty"`
+}
+
+// Authorize creates a session of the user for the third-party app (aud).
+func (b *Session) Authorize(ctx context.Context, input *AuthorizeInput) (*SessionOutput, error) {
+	output := SuccessResponse[SessionOutput]{}
+	if err := b.svc.Post(ctx, "/v1/session/authorize", input, &output); err != nil {
+		return nil, err
+	}
+	return &output.Result, nil
+}
+
 func (b *Session) UserInfo(ctx context.Context, id *util.ID, cn string) (*UserInfo, error) {
 	output := SuccessResponse[UserInfo]{}
 	api := "/v1/user?fields=cn,name,locale,picture,status"
@@ -71,6 +90,39 @@ func (b *Session) Delete(ctx context.Context, sid util.ID) (*SuccessResponse[boo
 	return &output, nil
 }
 
+type SessionInfo struct {
+	ID         util.ID `json:"id" cbor:"id"`
+	DeviceID   string  `json:"device_id" cbor:"device_id"`
+	DeviceDesc string  `json:"device_desc" cbor:"device_desc"`
+	IP         string  `json:"ip" cbor:"ip"`
+	CreatedAt  int64   `json:"created_at" cbor:"created_at"`
+	LastSeenAt int64   `json:"last_seen_at" cbor:"last_seen_at"`
+	Current    bool    `json:"current" cbor:"current,omitempty"`
+}
+
+// ListSessions returns the active sessions of the user.
+func (b *Session) ListSessions(ctx context.Context, uid util.ID) ([]SessionInfo, error) {
+	output := SuccessResponse[[]SessionInfo]{}
+	if err := b.svc.Get(ctx, "/v1/session/list?uid="+uid.String(), &output); err != nil {
+		return nil, err
+	}
+	return output.Result, nil
+}
+
+type RevokeOthersInput struct {
+	UID util.ID `json:"uid" cbor:"uid"`
+	SID util.ID `json:"sid" cbor:"sid"`
+}
+
+// RevokeOthers deletes all sessions of the user except the sid, it returns the number of revoked sessions.
+func (b *Session) RevokeOthers(ctx context.Context, uid, sid util.ID) (*SuccessResponse[uint], error) {
+	output := SuccessResponse[uint]{}
+	if err := b.svc.Post(ctx, "/v1/session/revoke_others", &RevokeOthersInput{UID: uid, SID: sid}, &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
 type UpdateSpecialFieldInput struct {
 	ID        util.ID `json:"id" cbor:"id"`
 	UpdatedAt int64   `json:"updated_at" cbor:"updated_at"`
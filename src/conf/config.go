@@ -2,7 +2,10 @@ package conf
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"math/rand"
 	"net/url"
@@ -16,6 +19,8 @@ import (
 	"github.com/fxamacker/cbor/v2"
 	"github.com/ldclabs/cose/key"
 	"github.com/teambition/gear"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/yiwen-ai/auth-api/src/util"
 )
 
@@ -38,11 +43,15 @@ func init() {
 	p.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	p.GlobalSignal = gear.ContextWithSignal(context.Background())
 
-	var cancel context.CancelFunc
+	var cancel, stopListen context.CancelFunc
 	p.GlobalShutdown, cancel = context.WithCancel(context.Background())
+	p.ListenContext, stopListen = context.WithCancel(context.Background())
 	go func() {
 		<-p.GlobalSignal.Done()
-		time.AfterFunc(time.Duration(p.Server.GracefulShutdown)*time.Second, cancel)
+		// /readyz reports "draining" in the drain delay, then the server stops accepting new requests
+		drain := time.Duration(p.Server.DrainDelay) * time.Second
+		time.AfterFunc(drain, stopListen)
+		time.AfterFunc(drain+time.Duration(p.Server.GracefulShutdown)*time.Second, cancel)
 	}()
 }
 
@@ -53,6 +62,9 @@ type Logger struct {
 type Server struct {
 	Addr             string `json:"addr" toml:"addr"`
 	GracefulShutdown uint   `json:"graceful_shutdown" toml:"graceful_shutdown"`
+	DrainDelay       uint   `json:"drain_delay" toml:"drain_delay"`
+	// The internal address to serve /metrics, such as ":9090", the metrics are not served if empty.
+	MetricsAddr string `json:"metrics_addr" toml:"metrics_addr"`
 }
 
 type Cookie struct {
@@ -114,6 +126,7 @@ type Base struct {
 type Keys struct {
 	CWTPub      string `json:"cwt_pub" toml:"cwt_pub"`
 	Oauth2State string `json:"oauth2_state" toml:"oauth2_state"`
+	TOTPKEK     string `json:"totp_kek" toml:"totp_kek"`
 }
 
 type Provider struct {
@@ -121,15 +134,177 @@ type Provider struct {
 	ClientSecret string   `json:"client_secret" toml:"client_secret"`
 	RedirectURL  string   `json:"redirect_uri" toml:"redirect_uri"`
 	Scopes       []string `json:"scopes" toml:"scopes"`
+	// "oidc" for the generic OpenID Connect provider, it is discovered from the issuer.
+	Kind   string         `json:"kind" toml:"kind"`
+	Issuer string         `json:"issuer" toml:"issuer"`
+	Claims ProviderClaims `json:"claims" toml:"claims"`
+	// Sign in with Apple, the client secret is a JWT signed by the .p8 private key.
+	TeamID         string            `json:"team_id" toml:"team_id"`
+	KeyID          string            `json:"key_id" toml:"key_id"`
+	PrivateKeyFile string            `json:"private_key_file" toml:"private_key_file"`
+	PrivateKey     *ecdsa.PrivateKey `json:"-" toml:"-"`
+	// The hosts of the user pictures, such as "*.googleusercontent.com", empty to allow any public host.
+	PictureHosts []string `json:"picture_hosts" toml:"picture_hosts"`
+}
+
+// ProviderClaims maps the id_token (or userinfo) claims of the OpenID Connect provider to the user.
+type ProviderClaims struct {
+	Sub     string `json:"sub" toml:"sub"`
+	Name    string `json:"name" toml:"name"`
+	Picture string `json:"picture" toml:"picture"`
 }
 
 type OSS struct {
+	// The object store, "aliyun" (default), "s3" (S3 compatible, such as MinIO) or "local".
+	Kind            string `json:"kind" toml:"kind"`
 	Bucket          string `json:"bucket" toml:"bucket"`
 	Endpoint        string `json:"endpoint" toml:"endpoint"`
 	AccessKeyId     string `json:"access_key_id" toml:"access_key_id"`
 	AccessKeySecret string `json:"access_key_secret" toml:"access_key_secret"`
-	Prefix          string `json:"prefix" toml:"prefix"`
-	UrlBase         string `json:"url_base" toml:"url_base"`
+	// The region of the s3 store, and whether to connect to the endpoint over plain HTTP.
+	Region   string `json:"region" toml:"region"`
+	Insecure bool   `json:"insecure" toml:"insecure"`
+	// The directory of the local store, the objects are served on /files/ for development.
+	Dir     string `json:"dir" toml:"dir"`
+	Prefix  string `json:"prefix" toml:"prefix"`
+	UrlBase string `json:"url_base" toml:"url_base"`
+}
+
+// Picture is the ingestion policy of the pictures of users.
+type Picture struct {
+	// The max bytes of the original picture, and the max width × height in pixels.
+	MaxBytes  int `json:"max_bytes" toml:"max_bytes"`
+	MaxPixels int `json:"max_pixels" toml:"max_pixels"`
+	// The sizes of the square JPEG variants, the first one is the picture URL of the user.
+	Sizes   []int `json:"sizes" toml:"sizes"`
+	Quality int   `json:"quality" toml:"quality"`
+}
+
+type OAuth2Client struct {
+	ClientID     util.ID  `json:"client_id" toml:"client_id"`
+	ClientSecret string   `json:"client_secret" toml:"client_secret"`
+	Name         string   `json:"name" toml:"name"`
+	RedirectURIs []string `json:"redirect_uris" toml:"redirect_uris"`
+	Scopes       []string `json:"scopes" toml:"scopes"`
+}
+
+type OAuth2 struct {
+	Issuer         string                  `json:"issuer" toml:"issuer"`
+	LoginURL       string                  `json:"login_url" toml:"login_url"`
+	ConsentURL     string                  `json:"consent_url" toml:"consent_url"`
+	CodeExpiresIn  uint                    `json:"code_expires_in" toml:"code_expires_in"`
+	TokenExpiresIn uint                    `json:"token_expires_in" toml:"token_expires_in"`
+	Clients        map[string]OAuth2Client `json:"clients" toml:"clients"`
+}
+
+type ForwardAuth struct {
+	Idp string `json:"idp" toml:"idp"`
+}
+
+type MFA struct {
+	// The issuer name shown in the authenticator apps.
+	Issuer string `json:"issuer" toml:"issuer"`
+	// The page to enter the second factor, it will receive the `next_url` query parameter.
+	VerifyURL string `json:"verify_url" toml:"verify_url"`
+	// The pending login should be verified in the time (seconds).
+	ExpiresIn uint `json:"expires_in" toml:"expires_in"`
+}
+
+type StepUp struct {
+	// The sensitive operations require the authentication in max_age seconds.
+	MaxAge uint `json:"max_age" toml:"max_age"`
+	// The minimum assurance level, 1: OAuth IdP, 2: passkey or 2FA.
+	Level int `json:"level" toml:"level"`
+}
+
+type Email struct {
+	// The mail sender, "smtp", or "log" to write the mails to the file (or the log if empty) for development.
+	// The email login is disabled if it is empty.
+	Kind     string `json:"kind" toml:"kind"`
+	From     string `json:"from" toml:"from"`
+	SMTPHost string `json:"smtp_host" toml:"smtp_host"`
+	SMTPPort int    `json:"smtp_port" toml:"smtp_port"`
+	Username string `json:"username" toml:"username"`
+	Password string `json:"password" toml:"password"`
+	File     string `json:"file" toml:"file"`
+	Subject  string `json:"subject" toml:"subject"`
+	// The magic link in the mail, it will receive the `token` query parameter.
+	VerifyURL string `json:"verify_url" toml:"verify_url"`
+	// The link and the code should be used in the time (seconds).
+	ExpiresIn uint `json:"expires_in" toml:"expires_in"`
+}
+
+type SMS struct {
+	// The SMS gateway, "aliyun", or "log" to write the codes to the log for development.
+	// The SMS login is disabled if it is empty.
+	Kind            string `json:"kind" toml:"kind"`
+	Endpoint        string `json:"endpoint" toml:"endpoint"`
+	AccessKeyId     string `json:"access_key_id" toml:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret" toml:"access_key_secret"`
+	SignName        string `json:"sign_name" toml:"sign_name"`
+	// The template should have the `code` parameter.
+	TemplateCode string `json:"template_code" toml:"template_code"`
+	// The code should be used in the time (seconds).
+	ExpiresIn uint `json:"expires_in" toml:"expires_in"`
+}
+
+type RateLimit struct {
+	Enabled  bool                       `json:"enabled" toml:"enabled"`
+	Policies map[string]RateLimitPolicy `json:"policies" toml:"policies"`
+}
+
+// RateLimitPolicy is the token bucket of the routes, each key ("ip", "device" or "uid") has its own bucket.
+type RateLimitPolicy struct {
+	// Limit requests in period seconds, and allow bursts up to burst requests.
+	Limit  uint     `json:"limit" toml:"limit"`
+	Period uint     `json:"period" toml:"period"`
+	Burst  uint     `json:"burst" toml:"burst"`
+	Keys   []string `json:"keys" toml:"keys"`
+	// The keys are locked for lockout_duration seconds after lockout_failures failed attempts, such as the invalid codes,
+	// in lockout_window seconds, 0 to disable the lockout.
+	LockoutFailures uint `json:"lockout_failures" toml:"lockout_failures"`
+	LockoutWindow   uint `json:"lockout_window" toml:"lockout_window"`
+	LockoutDuration uint `json:"lockout_duration" toml:"lockout_duration"`
+}
+
+type Tracing struct {
+	// The span exporter, "otlp" (OTLP over HTTP), "stdout", or empty to disable tracing.
+	Exporter string `json:"exporter" toml:"exporter"`
+	// The OTLP endpoint, such as "localhost:4318".
+	Endpoint string `json:"endpoint" toml:"endpoint"`
+	Insecure bool   `json:"insecure" toml:"insecure"`
+	// The ratio of the sampled root spans, the sampling decision of the parent is respected.
+	SampleRatio float64 `json:"sample_ratio" toml:"sample_ratio"`
+}
+
+// Upstream is the resilience policy of the base services (userbase, logbase and walletbase).
+type Upstream struct {
+	// The timeout (milliseconds) of each attempt, the deadline of the request context is respected.
+	Timeout uint `json:"timeout" toml:"timeout"`
+	// Retries of the idempotent methods (GET, PUT and DELETE) on the transport errors and 429, 502, 503, 504,
+	// with jittered exponential backoff (milliseconds) from retry_backoff up to retry_max_backoff.
+	Retries         uint `json:"retries" toml:"retries"`
+	RetryBackoff    uint `json:"retry_backoff" toml:"retry_backoff"`
+	RetryMaxBackoff uint `json:"retry_max_backoff" toml:"retry_max_backoff"`
+	// The breaker of the host opens after breaker_failures consecutive transient errors,
+	// and lets one probe through after breaker_cooldown seconds, 0 to disable the breaker.
+	BreakerFailures uint `json:"breaker_failures" toml:"breaker_failures"`
+	BreakerCooldown uint `json:"breaker_cooldown" toml:"breaker_cooldown"`
+	// A GET request is hedged by a second request if it has not finished in hedge_delay milliseconds,
+	// 0 to disable hedging.
+	HedgeDelay uint `json:"hedge_delay" toml:"hedge_delay"`
+}
+
+type Outbound struct {
+	// The outbound requests to the external hosts can not reach the non-public networks,
+	// except the CIDRs, such as an IdP in the intranet.
+	AllowCIDRs []string `json:"allow_cidrs" toml:"allow_cidrs"`
+}
+
+type Store struct {
+	Kind       string `json:"kind" toml:"kind"`
+	RedisURL   string `json:"redis_url" toml:"redis_url"`
+	MemorySize int    `json:"memory_size" toml:"memory_size"`
 }
 
 // ConfigTpl ...
@@ -137,6 +312,7 @@ type ConfigTpl struct {
 	Rand           *rand.Rand
 	GlobalSignal   context.Context
 	GlobalShutdown context.Context
+	ListenContext  context.Context     // canceled after the drain delay of GlobalSignal
 	Env            string              `json:"env" toml:"env"`
 	Home           string              `json:"home" toml:"home"`
 	Logger         Logger              `json:"log" toml:"log"`
@@ -144,12 +320,25 @@ type ConfigTpl struct {
 	Cookie         Cookie              `json:"cookie" toml:"cookie"`
 	AuthURL        AuthURL             `json:"auth_url" toml:"auth_url"`
 	Base           Base                `json:"base" toml:"base"`
+	Upstream       Upstream            `json:"upstream" toml:"upstream"`
 	Keys           Keys                `json:"keys" toml:"keys"`
 	Providers      map[string]Provider `json:"providers" toml:"providers"`
 	OSS            OSS                 `json:"oss" toml:"oss"`
+	Picture        Picture             `json:"picture" toml:"picture"`
+	OAuth2         OAuth2              `json:"oauth2" toml:"oauth2"`
+	ForwardAuth    ForwardAuth         `json:"forward_auth" toml:"forward_auth"`
+	Store          Store               `json:"store" toml:"store"`
+	MFA            MFA                 `json:"mfa" toml:"mfa"`
+	StepUp         StepUp              `json:"step_up" toml:"step_up"`
+	Email          Email               `json:"email" toml:"email"`
+	SMS            SMS                 `json:"sms" toml:"sms"`
+	RateLimit      RateLimit           `json:"rate_limit" toml:"rate_limit"`
+	Tracing        Tracing             `json:"tracing" toml:"tracing"`
+	Outbound       Outbound            `json:"outbound" toml:"outbound"`
 	COSEKeys       struct {
 		CWTPub      key.Key
 		Oauth2State key.Key
+		TOTPKEK     key.Key // optional, 2FA is disabled without it
 	}
 
 	globalJobs int64 // global async jobs counter for graceful shutdown
@@ -163,6 +352,116 @@ func (c *ConfigTpl) Validate() error {
 	if c.COSEKeys.Oauth2State, err = readKey(c.Keys.Oauth2State); err != nil {
 		return err
 	}
+	if c.Keys.TOTPKEK != "" {
+		if c.COSEKeys.TOTPKEK, err = readKey(c.Keys.TOTPKEK); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range c.Providers {
+		if k == "apple" {
+			// https://developer.apple.com/documentation/sign_in_with_apple/sign_in_with_apple_rest_api
+			v.Kind = "oidc"
+			if v.Issuer == "" {
+				v.Issuer = "https://appleid.apple.com"
+			}
+			if v.TeamID == "" || v.KeyID == "" {
+				return fmt.Errorf("missing team_id or key_id for provider %q", k)
+			}
+			if v.PrivateKey, err = readECKey(v.PrivateKeyFile); err != nil {
+				return fmt.Errorf("invalid private_key_file for provider %q: %v", k, err)
+			}
+		}
+
+		if v.Kind == "oidc" {
+			if v.Issuer == "" {
+				return fmt.Errorf("missing issuer for oidc provider %q", k)
+			}
+			if !util.SliceHas(v.Scopes, "openid") {
+				v.Scopes = append([]string{"openid"}, v.Scopes...)
+			}
+			if v.Claims.Sub == "" {
+				v.Claims.Sub = "sub"
+			}
+			if v.Claims.Name == "" {
+				v.Claims.Name = "name"
+			}
+			if v.Claims.Picture == "" {
+				v.Claims.Picture = "picture"
+			}
+			c.Providers[k] = v
+		}
+	}
+
+	if c.StepUp.MaxAge == 0 {
+		c.StepUp.MaxAge = 600
+	}
+	if c.StepUp.Level == 0 {
+		c.StepUp.Level = 1
+	}
+
+	if c.Email.ExpiresIn == 0 {
+		c.Email.ExpiresIn = 900
+	}
+	if c.Email.Subject == "" {
+		c.Email.Subject = "Sign-in code"
+	}
+	if c.SMS.ExpiresIn == 0 {
+		c.SMS.ExpiresIn = 300
+	}
+	if c.Picture.MaxBytes <= 0 {
+		c.Picture.MaxBytes = 5 << 20
+	}
+	if c.Picture.MaxPixels <= 0 {
+		c.Picture.MaxPixels = 4096 * 4096
+	}
+	if len(c.Picture.Sizes) == 0 {
+		c.Picture.Sizes = []int{400, 160, 64}
+	}
+	for _, size := range c.Picture.Sizes {
+		if size <= 0 {
+			return fmt.Errorf("invalid picture size %d", size)
+		}
+	}
+	if c.Picture.Quality <= 0 || c.Picture.Quality > 100 {
+		c.Picture.Quality = 85
+	}
+	if c.Upstream.BreakerFailures > 0 && c.Upstream.BreakerCooldown == 0 {
+		c.Upstream.BreakerCooldown = 10
+	}
+	if c.Upstream.RetryMaxBackoff < c.Upstream.RetryBackoff {
+		c.Upstream.RetryMaxBackoff = c.Upstream.RetryBackoff
+	}
+
+	for k, v := range c.RateLimit.Policies {
+		if v.Limit == 0 || v.Period == 0 {
+			return fmt.Errorf("invalid limit or period for rate limit policy %q", k)
+		}
+		if v.Burst == 0 {
+			v.Burst = v.Limit
+		}
+		if len(v.Keys) == 0 {
+			v.Keys = []string{"ip"}
+		}
+		for _, key := range v.Keys {
+			if !util.SliceHas([]string{"ip", "device", "uid"}, key) {
+				return fmt.Errorf("invalid key %q for rate limit policy %q", key, k)
+			}
+		}
+		if v.LockoutFailures > 0 && (v.LockoutWindow == 0 || v.LockoutDuration == 0) {
+			return fmt.Errorf("invalid lockout for rate limit policy %q", k)
+		}
+		c.RateLimit.Policies[k] = v
+	}
+
+	for k, v := range c.OAuth2.Clients {
+		if v.ClientID == util.ZeroID {
+			return fmt.Errorf("invalid client_id for oauth2 client %q", k)
+		}
+		if len(v.RedirectURIs) == 0 {
+			return fmt.Errorf("missing redirect_uris for oauth2 client %q", k)
+		}
+	}
 
 	c.AuthURL.DefaultURL = url.URL{
 		Scheme: "https",
@@ -189,6 +488,10 @@ func WithGlobalCtx(ctx context.Context) context.Context {
 	if h := gear.CtxValue[util.ContextHTTPHeader](ctx); h != nil {
 		gctx = gear.CtxWith[util.ContextHTTPHeader](gctx, h)
 	}
+	// the background job will be linked to the request span
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		gctx = trace.ContextWithSpanContext(gctx, sc)
+	}
 
 	return gctx
 }
@@ -207,6 +510,27 @@ func readKey(filePath string) (k key.Key, err error) {
 	return
 }
 
+// readECKey reads the PKCS #8 EC private key in PEM format, such as Apple's .p8 key.
+func readECKey(filePath string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %q", filePath)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pk, ok := k.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an EC private key in %q", filePath)
+	}
+	return pk, nil
+}
+
 func readConfig(v interface{}, path ...string) {
 	once.Do(func() {
 		filePath, err := getConfigFilePath(path...)
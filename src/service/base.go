@@ -3,8 +3,6 @@ package service
 import (
 	"context"
 	"net/http"
-
-	"github.com/yiwen-ai/auth-api/src/util"
 )
 
 type APIHost string
@@ -16,21 +14,21 @@ func (h APIHost) Stats(ctx context.Context) (map[string]any, error) {
 }
 
 func (h APIHost) Get(ctx context.Context, api string, output any) error {
-	return util.RequestCBOR(ctx, util.HTTPClient, http.MethodGet, string(h)+api, nil, output)
+	return h.request(ctx, http.MethodGet, api, nil, output)
 }
 
 func (h APIHost) Delete(ctx context.Context, api string, output any) error {
-	return util.RequestCBOR(ctx, util.HTTPClient, http.MethodDelete, string(h)+api, nil, output)
+	return h.request(ctx, http.MethodDelete, api, nil, output)
 }
 
 func (h APIHost) Post(ctx context.Context, api string, input, output any) error {
-	return util.RequestCBOR(ctx, util.HTTPClient, http.MethodPost, string(h)+api, input, output)
+	return h.request(ctx, http.MethodPost, api, input, output)
 }
 
 func (h APIHost) Put(ctx context.Context, api string, input, output any) error {
-	return util.RequestCBOR(ctx, util.HTTPClient, http.MethodPut, string(h)+api, input, output)
+	return h.request(ctx, http.MethodPut, api, input, output)
 }
 
 func (h APIHost) Patch(ctx context.Context, api string, input, output any) error {
-	return util.RequestCBOR(ctx, util.HTTPClient, http.MethodPatch, string(h)+api, input, output)
+	return h.request(ctx, http.MethodPatch, api, input, output)
 }
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func init() {
+	util.DigProvide(NewMailer)
+}
+
+type Mail struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer sends the mails, such as the login link.
+type Mailer interface {
+	Send(ctx context.Context, m *Mail) error
+}
+
+// NewMailer creates the mailer of the config, it returns nil if the kind is empty, so the email login is disabled.
+func NewMailer() Mailer {
+	cfg := conf.Config.Email
+	switch cfg.Kind {
+	case "":
+		return nil
+	case "smtp":
+		from, err := mail.ParseAddress(cfg.From)
+		if err != nil {
+			panic(fmt.Errorf("invalid email.from: %v", err))
+		}
+		return &SMTPMailer{
+			from: from,
+			addr: net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+			host: cfg.SMTPHost,
+			auth: smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.SMTPHost),
+		}
+	case "log":
+		if conf.Config.Env == "prod" {
+			panic(fmt.Errorf("email.kind %q is not allowed in prod", cfg.Kind))
+		}
+		return &LogMailer{file: cfg.File}
+	default:
+		panic(fmt.Errorf("unknown email.kind %q", cfg.Kind))
+	}
+}
+
+// SMTPMailer sends the mails by the SMTP server, port 465 uses the implicit TLS, others use STARTTLS.
+type SMTPMailer struct {
+	from *mail.Address
+	addr string
+	host string
+	auth smtp.Auth
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, m *Mail) error {
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if _, port, _ := net.SplitHostPort(s.addr); port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.host}}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		if err = c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(s.from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(encodeMail(s.from, to, m)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// LogMailer writes the mails to the file, or the log if the file is empty. It is for development only.
+type LogMailer struct {
+	mu   sync.Mutex
+	file string
+}
+
+func (s *LogMailer) Send(ctx context.Context, m *Mail) error {
+	if s.file == "" {
+		logging.Infof("mail to %s: %s\n%s", m.To, m.Subject, m.Text)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "To: %s\nSubject: %s\nDate: %s\n\n%s\n\n", m.To, m.Subject, time.Now().Format(time.RFC1123Z), m.Text)
+	return err
+}
+
+func encodeMail(from, to *mail.Address, m *Mail) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(m.Text)
+	return buf.Bytes()
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+func TestNewMailer(t *testing.T) {
+	assert := assert.New(t)
+
+	env, cfg := conf.Config.Env, conf.Config.Email
+	defer func() {
+		conf.Config.Env, conf.Config.Email = env, cfg
+	}()
+
+	conf.Config.Env = "dev"
+	conf.Config.Email.Kind = ""
+	assert.Nil(NewMailer())
+
+	conf.Config.Email.Kind = "log"
+	assert.IsType(&LogMailer{}, NewMailer())
+
+	conf.Config.Email.Kind = "sendgrid"
+	assert.Panics(func() { NewMailer() })
+
+	conf.Config.Env = "prod"
+	conf.Config.Email.Kind = "log"
+	assert.Panics(func() { NewMailer() })
+}
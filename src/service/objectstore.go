@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+// ObjectStore saves the public objects, such as the pictures of users.
+type ObjectStore interface {
+	// PutObject saves the object, size is -1 if unknown.
+	PutObject(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Ping checks the bucket and the credentials, the object does not need to exist.
+	Ping(ctx context.Context) error
+}
+
+// NewObjectStore creates the object store of the kind in the config.
+func NewObjectStore(cfg conf.OSS) (ObjectStore, error) {
+	switch cfg.Kind {
+	case "", "aliyun":
+		return NewAliyunStore(cfg)
+	case "s3":
+		return NewS3Store(cfg)
+	case "local":
+		return NewLocalStore(cfg.Dir)
+	default:
+		return nil, fmt.Errorf("unknown object store %q", cfg.Kind)
+	}
+}
+
+type AliyunStore struct {
+	prefix string
+	bucket *oss.Bucket
+}
+
+func NewAliyunStore(cfg conf.OSS) (*AliyunStore, error) {
+	client, err := oss.New(cfg.Endpoint, cfg.AccessKeyId, cfg.AccessKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := client.Bucket(cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &AliyunStore{prefix: cfg.Prefix, bucket: bucket}, nil
+}
+
+func (s *AliyunStore) PutObject(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	return s.bucket.PutObject(key, r, oss.WithContext(ctx), oss.ContentType(contentType),
+		oss.CacheControl("public"), oss.ContentDisposition("inline"))
+}
+
+func (s *AliyunStore) Ping(ctx context.Context) error {
+	// the credentials may be limited to the prefix
+	_, err := s.bucket.IsObjectExist(s.prefix+".readyz", oss.WithContext(ctx))
+	return err
+}
+
+type S3Store struct {
+	bucket string
+	client *minio.Client
+}
+
+func NewS3Store(cfg conf.OSS) (*S3Store, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyId, cfg.AccessKeySecret, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{bucket: cfg.Bucket, client: client}, nil
+}
+
+func (s *S3Store) PutObject(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType:        contentType,
+		CacheControl:       "public",
+		ContentDisposition: "inline",
+		PartSize:           5 << 20, // bounds the buffer of the objects in unknown size
+	})
+	return err
+}
+
+func (s *S3Store) Ping(ctx context.Context) error {
+	ok, err := s.client.BucketExists(ctx, s.bucket)
+	if err == nil && !ok {
+		err = fmt.Errorf("bucket %q not found", s.bucket)
+	}
+	return err
+}
+
+// LocalStore saves the objects in a directory, it is for development and self-hosting.
+type LocalStore struct {
+	Dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("missing dir for local object store")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{Dir: dir}, nil
+}
+
+// Path returns the file path of the key, the key should not escape the directory.
+func (s *LocalStore) Path(key string) (string, error) {
+	p := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, s.Dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return p, nil
+}
+
+func (s *LocalStore) PutObject(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.Path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it, so a reader never sees a partial object
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *LocalStore) Ping(ctx context.Context) error {
+	_, err := os.Stat(s.Dir)
+	return err
+}
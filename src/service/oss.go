@@ -1,17 +1,20 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/teambition/gear"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/yiwen-ai/auth-api/src/conf"
 	"github.com/yiwen-ai/auth-api/src/util"
@@ -24,16 +27,13 @@ func init() {
 type OSS struct {
 	UrlBase string
 	Prefix  string
-	bucket  *oss.Bucket
+	kind    string
+	store   ObjectStore
 }
 
 func NewOSS() *OSS {
 	cfg := conf.Config.OSS
-	client, err := oss.New(cfg.Endpoint, cfg.AccessKeyId, cfg.AccessKeySecret)
-	if err != nil {
-		panic(err)
-	}
-	bucket, err := client.Bucket(cfg.Bucket)
+	store, err := NewObjectStore(cfg)
 	if err != nil {
 		panic(err)
 	}
@@ -41,61 +41,141 @@ func NewOSS() *OSS {
 	return &OSS{
 		UrlBase: cfg.UrlBase,
 		Prefix:  cfg.Prefix,
-		bucket:  bucket,
+		kind:    cfg.Kind,
+		store:   store,
+	}
+}
+
+// LocalDir returns the directory of the local object store, or empty for the other stores.
+func (s *OSS) LocalDir() string {
+	if ls, ok := s.store.(*LocalStore); ok {
+		return ls.Dir
 	}
+	return ""
 }
 
-func (s *OSS) SavePicture(ctx context.Context, imgPath, imgUrl string) (string, error) {
-	ctype, reader, err := GetPicture(ctx, imgUrl)
+// SavePicture fetches the picture from the URL and saves it with PutPicture,
+// the URL and its redirects should match the hosts if not empty.
+// The current URL of the picture is returned without uploading if the content is not changed.
+func (s *OSS) SavePicture(ctx context.Context, imgUrl string, hosts []string, current string) (string, error) {
+	data, err := GetPicture(ctx, imgUrl, hosts, conf.Config.Picture.MaxBytes)
 	if err != nil {
 		return "", err
 	}
+	return s.savePicture(ctx, data, current)
+}
+
+// PutPicture normalizes the picture and saves the variants under the content-hashed keys,
+// it returns the URL of the first variant.
+func (s *OSS) PutPicture(ctx context.Context, data []byte) (string, error) {
+	return s.savePicture(ctx, data, "")
+}
 
-	objectKey := s.Prefix + imgPath
-	if err := s.bucket.PutObject(objectKey, reader, oss.ContentType(ctype),
-		oss.CacheControl("public"), oss.ContentDisposition("inline")); err != nil {
+func (s *OSS) savePicture(ctx context.Context, data []byte, current string) (string, error) {
+	cfg := conf.Config.Picture
+	hash, variants, err := util.NormalizeImage(data, cfg.MaxPixels, cfg.Sizes, cfg.Quality)
+	if err != nil {
 		return "", err
 	}
 
-	return s.UrlBase + objectKey, nil
+	url := s.UrlBase + s.pictureKey(hash, variants[0].Size)
+	if url == current {
+		return current, nil
+	}
+
+	for _, v := range variants {
+		if err := s.putObject(ctx, s.pictureKey(hash, v.Size), v.Data, "image/jpeg"); err != nil {
+			return "", err
+		}
+	}
+	return url, nil
+}
+
+func (s *OSS) pictureKey(hash string, size int) string {
+	return fmt.Sprintf("%s%s/%d.jpg", s.Prefix, hash, size)
 }
 
-func GetPicture(ctx context.Context, imgUrl string) (string, io.ReadCloser, error) {
+func (s *OSS) putObject(ctx context.Context, objectKey string, data []byte, ctype string) error {
+	ctx, span := util.Tracer.Start(ctx, "oss.PutObject", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("oss.kind", s.kind), attribute.String("oss.key", objectKey)))
+	defer span.End()
+	if err := s.store.PutObject(ctx, objectKey, bytes.NewReader(data), int64(len(data)), ctype); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// Ping checks the object store.
+func (s *OSS) Ping(ctx context.Context) error {
+	return s.store.Ping(ctx)
+}
+
+// GetPicture fetches the picture, it is not trusted until decoded.
+func GetPicture(ctx context.Context, imgUrl string, hosts []string, maxBytes int) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", imgUrl, nil)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	resp, err := fileHTTPClient.Do(req)
+	cli := fileHTTPClient
+	if len(hosts) > 0 {
+		checkHost := func(req *http.Request) error {
+			if !util.MatchHost(req.URL.Host, hosts) {
+				return gear.ErrForbidden.WithMsgf("picture host %q is not allowed", req.URL.Host)
+			}
+			return nil
+		}
+		if err := checkHost(req); err != nil {
+			return nil, err
+		}
+
+		c := *fileHTTPClient
+		c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if err := util.CheckRedirect(req, via); err != nil {
+				return err
+			}
+			return checkHost(req)
+		}
+		cli = &c
+	}
+
+	resp, err := cli.Do(req)
 	if err != nil {
 		if err.(*url.Error).Unwrap() == context.Canceled {
-			return "", nil, gear.ErrClientClosedRequest
+			return nil, gear.ErrClientClosedRequest
 		}
 
-		return "", nil, err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return "", nil, gear.Err.WithCode(resp.StatusCode).WithMsg(string(data))
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, gear.Err.WithCode(resp.StatusCode).WithMsg(string(data))
 	}
 
 	ct := strings.ToLower(resp.Header.Get(gear.HeaderContentType))
 	if !strings.Contains(ct, "image") {
-		resp.Body.Close()
-		return "", nil, gear.ErrUnsupportedMediaType.WithMsg(ct)
+		return nil, gear.ErrUnsupportedMediaType.WithMsg(ct)
+	}
+	if resp.ContentLength > int64(maxBytes) {
+		return nil, gear.ErrRequestEntityTooLarge.WithMsgf("picture is too large: %d bytes", resp.ContentLength)
 	}
 
-	return ct, resp.Body, nil
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBytes {
+		return nil, gear.ErrRequestEntityTooLarge.WithMsgf("picture is too large: over %d bytes", maxBytes)
+	}
+	return data, nil
 }
 
 var tr = &http.Transport{
-	TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
-	DialContext: (&net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 15 * time.Second,
-	}).DialContext,
+	TLSClientConfig:       &tls.Config{InsecureSkipVerify: false},
+	DialContext:           util.NewGuardedDialer(10*time.Second, 15*time.Second).DialContext,
 	ForceAttemptHTTP2:     true,
 	MaxIdleConns:          100,
 	MaxIdleConnsPerHost:   20,
@@ -106,6 +186,7 @@ var tr = &http.Transport{
 }
 
 var fileHTTPClient = &http.Client{
-	Transport: tr,
-	Timeout:   time.Second * 60,
+	Transport:     util.NewExternalTracingTransport(tr),
+	CheckRedirect: util.CheckRedirect,
+	Timeout:       time.Second * 60,
 }
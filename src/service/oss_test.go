@@ -0,0 +1,50 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+func TestPutPicture(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	cfg, picture := conf.Config.OSS, conf.Config.Picture
+	t.Cleanup(func() { conf.Config.OSS, conf.Config.Picture = cfg, picture })
+	conf.Config.OSS = conf.OSS{Kind: "local", Dir: dir, UrlBase: "http://localhost/files/", Prefix: "pic/"}
+	conf.Config.Picture.Sizes = []int{400, 160, 64}
+	s := NewOSS()
+
+	var buf bytes.Buffer
+	assert.NoError(png.Encode(&buf, image.NewGray(image.Rect(0, 0, 100, 120))))
+
+	url, err := s.PutPicture(context.Background(), buf.Bytes())
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(url, "http://localhost/files/pic/"))
+	assert.True(strings.HasSuffix(url, "/100.jpg"), "keyed by the size of the variant")
+
+	files, err := filepath.Glob(filepath.Join(dir, "pic", "*", "*.jpg"))
+	assert.NoError(err)
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	assert.ElementsMatch([]string{"100.jpg", "64.jpg"}, names)
+
+	data, err := os.ReadFile(filepath.Join(dir, strings.TrimPrefix(url, "http://localhost/files/")))
+	assert.NoError(err)
+	img, format, err := image.DecodeConfig(bytes.NewReader(data))
+	assert.NoError(err)
+	assert.Equal("jpeg", format)
+	assert.Equal(100, img.Width)
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+// RateLimitStore keeps the token buckets and the lockouts of the rate limiter.
+// The token bucket is implemented with GCRA, so a bucket is a single timestamp.
+type RateLimitStore interface {
+	// Allow takes a token from the bucket that refills `rate` tokens per second up to `burst`,
+	// it returns the time to wait if the bucket is empty, or 0 if allowed.
+	Allow(ctx context.Context, key string, rate float64, burst int) (time.Duration, error)
+	// Fail records a failure, the key is locked for the lockout duration
+	// when the failures reach max in the window.
+	Fail(ctx context.Context, key string, max int64, window, lockout time.Duration) error
+	// Locked returns the remaining lockout time, or 0 if not locked.
+	Locked(ctx context.Context, key string) (time.Duration, error)
+}
+
+func NewRateLimitStore() RateLimitStore {
+	cfg := conf.Config.Store
+	switch cfg.Kind {
+	case "redis":
+		return &RedisStore{cli: sharedRedisClient(cfg.RedisURL), prefix: conf.AppName + ":"}
+	default:
+		return NewMemoryStore(cfg.MemorySize)
+	}
+}
+
+func gcraParams(rate float64, burst int) (interval, tolerance time.Duration) {
+	interval = time.Duration(float64(time.Second) / rate)
+	if burst < 1 {
+		burst = 1
+	}
+	return interval, interval * time.Duration(burst)
+}
+
+func (s *MemoryStore) Allow(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	interval, tolerance := gcraParams(rate, burst)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tat := now
+	if entry := s.get("rl:"+key, now); entry != nil && entry.tat.After(now) {
+		tat = entry.tat
+	}
+	tat = tat.Add(interval)
+	if allowAt := tat.Add(-tolerance); allowAt.After(now) {
+		return allowAt.Sub(now), nil
+	}
+
+	s.put(&memoryEntry{key: "rl:" + key, tat: tat, expiresAt: tat})
+	return 0, nil
+}
+
+func (s *MemoryStore) Fail(ctx context.Context, key string, max int64, window, lockout time.Duration) error {
+	n, _ := s.Incr(ctx, "rl_fail:"+key, window)
+	if n < max {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(&memoryEntry{key: "rl_lock:" + key, expiresAt: time.Now().Add(lockout)})
+	s.put(&memoryEntry{key: "rl_fail:" + key}) // reset the failures
+	return nil
+}
+
+func (s *MemoryStore) Locked(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry := s.get("rl_lock:"+key, now); entry != nil {
+		return entry.expiresAt.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// KEYS[1]: bucket key, ARGV: now (ms), interval (ms), tolerance (ms).
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+tat = tat + interval
+local wait = tat - tolerance - now
+if wait > 0 then
+	return wait
+end
+redis.call("SET", KEYS[1], tat, "PX", tat - now)
+return 0
+`)
+
+// KEYS[1]: failures key, KEYS[2]: lock key, ARGV: max, window (ms), lockout (ms).
+var failScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if n >= tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[2], 1, "PX", ARGV[3])
+	redis.call("DEL", KEYS[1])
+end
+return n
+`)
+
+func (s *RedisStore) Allow(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	interval, tolerance := gcraParams(rate, burst)
+	wait, err := gcraScript.Run(ctx, s.cli, []string{s.prefix + "rl:" + key},
+		time.Now().UnixMilli(), interval.Milliseconds(), tolerance.Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+func (s *RedisStore) Fail(ctx context.Context, key string, max int64, window, lockout time.Duration) error {
+	return failScript.Run(ctx, s.cli, []string{s.prefix + "rl_fail:" + key, s.prefix + "rl_lock:" + key},
+		max, window.Milliseconds(), lockout.Milliseconds()).Err()
+}
+
+func (s *RedisStore) Locked(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.cli.PTTL(ctx, s.prefix+"rl_lock:"+key).Result()
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return ttl, nil
+}
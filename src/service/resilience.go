@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+// Breaker states of the upstream hosts.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// request calls the upstream with the resilience policy of conf.Config.Upstream.
+func (h APIHost) request(ctx context.Context, method, api string, input, output any) error {
+	cfg := &conf.Config.Upstream
+	b := hostBreaker(string(h))
+
+	var err error
+	for i := uint(0); ; i++ {
+		probe, ok := b.allow(cfg)
+		if !ok {
+			return gear.ErrServiceUnavailable.WithMsgf("circuit breaker of %s is open", h)
+		}
+
+		if method == http.MethodGet && cfg.HedgeDelay > 0 && output != nil && reflect.TypeOf(output).Kind() == reflect.Pointer {
+			err = h.hedge(ctx, cfg, api, output)
+		} else {
+			err = h.attempt(ctx, cfg, method, api, input, output)
+		}
+
+		switch {
+		case err == nil:
+			b.record(cfg, probe, BreakerClosed)
+			return nil
+		case ctx.Err() != nil:
+			// the caller has gone, the upstream is not to blame
+			b.record(cfg, probe, "")
+			return err
+		case !isTransient(err):
+			b.record(cfg, probe, BreakerClosed)
+			return err
+		}
+
+		b.record(cfg, probe, BreakerOpen)
+		if i >= cfg.Retries || !isIdempotent(method) {
+			return err
+		}
+		if !sleepBackoff(ctx, cfg, i) {
+			return err
+		}
+	}
+}
+
+func (h APIHost) attempt(ctx context.Context, cfg *conf.Upstream, method, api string, input, output any) error {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+	return util.RequestCBOR(ctx, util.HTTPClient, method, string(h)+api, input, output)
+}
+
+// hedge sends a second GET request if the first one has not finished in the hedge delay,
+// the first success wins and the other one is canceled.
+func (h APIHost) hedge(ctx context.Context, cfg *conf.Upstream, api string, output any) error {
+	type result struct {
+		output any
+		err    error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan result, 2)
+	send := func() {
+		out := reflect.New(reflect.TypeOf(output).Elem()).Interface()
+		go func() {
+			ch <- result{out, h.attempt(ctx, cfg, http.MethodGet, api, nil, out)}
+		}()
+	}
+
+	send()
+	pending := 1
+	timer := time.NewTimer(time.Duration(cfg.HedgeDelay) * time.Millisecond)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			send()
+			pending++
+
+		case r := <-ch:
+			if r.err == nil {
+				reflect.ValueOf(output).Elem().Set(reflect.ValueOf(r.output).Elem())
+				return nil
+			}
+
+			pending--
+			if pending == 0 {
+				return r.err
+			}
+		}
+	}
+}
+
+// isTransient reports whether the error may not happen again, such as a timeout or an overloaded upstream.
+// The transport errors are 502 or 504 (see util.RequestCBOR), a 500 response is a bug of the upstream.
+func isTransient(err error) bool {
+	switch gear.ParseError(err).Status() {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// sleepBackoff sleeps a full jittered exponential backoff, it returns false if the context
+// is done or its deadline is too close for another attempt.
+func sleepBackoff(ctx context.Context, cfg *conf.Upstream, i uint) bool {
+	backoff := time.Duration(cfg.RetryBackoff) * time.Millisecond << min(i, 16)
+	if limit := time.Duration(cfg.RetryMaxBackoff) * time.Millisecond; backoff > limit {
+		backoff = limit
+	}
+	if backoff > 0 {
+		backoff = time.Duration(rand.Int63n(int64(backoff))) + 1
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+		return false
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+type breaker struct {
+	mu       sync.Mutex
+	host     string
+	state    string
+	failures uint
+	openedAt time.Time
+	gen      uint64 // the generation of the probes
+	probe    uint64 // the in-flight probe in the half-open state, 0 if none
+}
+
+var breakers sync.Map // host -> *breaker
+
+func hostBreaker(host string) *breaker {
+	if b, ok := breakers.Load(host); ok {
+		return b.(*breaker)
+	}
+	b, _ := breakers.LoadOrStore(host, &breaker{host: host, state: BreakerClosed})
+	return b.(*breaker)
+}
+
+// BreakerStates returns the breaker state of the upstreams by name, such as "userbase",
+// the internal addresses are not exposed. A breaker not closed wins for the same name.
+func BreakerStates() map[string]string {
+	states := make(map[string]string)
+	breakers.Range(func(k, v any) bool {
+		b := v.(*breaker)
+		name := util.UpstreamName(k.(string))
+		b.mu.Lock()
+		if s, ok := states[name]; !ok || s == BreakerClosed {
+			states[name] = b.state
+		}
+		b.mu.Unlock()
+		return true
+	})
+	return states
+}
+
+// allow lets the request through unless the breaker is open, only one probe is allowed
+// in the half-open state. It returns the token of the probe, or 0 for a request in the closed state.
+func (b *breaker) allow(cfg *conf.Upstream) (uint64, bool) {
+	if cfg.BreakerFailures == 0 {
+		return 0, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < time.Duration(cfg.BreakerCooldown)*time.Second {
+			return 0, false
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probe != 0 {
+			return 0, false
+		}
+		b.gen++
+		b.probe = b.gen
+		return b.probe, true
+	}
+	return 0, true
+}
+
+// record updates the breaker with the outcome of the request, BreakerClosed for a healthy response,
+// BreakerOpen for a transient error, or empty if the outcome says nothing about the upstream.
+// When the breaker is not closed, only the outcome of the current probe counts, the requests
+// started before the breaker opened can not close it or release the probe.
+func (b *breaker) record(cfg *conf.Upstream, probe uint64, outcome string) {
+	if cfg.BreakerFailures == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerClosed {
+		if probe == 0 || probe != b.probe {
+			return
+		}
+		b.probe = 0
+	}
+	switch outcome {
+	case BreakerClosed:
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.setState(BreakerClosed)
+		}
+	case BreakerOpen:
+		b.failures++
+		if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= cfg.BreakerFailures) {
+			b.openedAt = time.Now()
+			b.setState(BreakerOpen)
+		}
+	}
+}
+
+func (b *breaker) setState(state string) {
+	logging.Warningf("circuit breaker of %s: %s -> %s", b.host, b.state, state)
+	b.state = state
+}
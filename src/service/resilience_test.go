@@ -0,0 +1,256 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+type testResult struct {
+	Result string `cbor:"result"`
+}
+
+func withUpstream(t *testing.T, cfg conf.Upstream) {
+	old := conf.Config.Upstream
+	conf.Config.Upstream = cfg
+	t.Cleanup(func() { conf.Config.Upstream = old })
+}
+
+// newStatusServer responds the statuses in order, the last one is repeated.
+func newStatusServer(t *testing.T, statuses ...int) (APIHost, *atomic.Int32) {
+	calls := &atomic.Int32{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(calls.Add(1)) - 1
+		status := statuses[min(i, len(statuses)-1)]
+		data, _ := cbor.Marshal(testResult{Result: http.StatusText(status)})
+		w.Header().Set(gear.HeaderContentType, gear.MIMEApplicationCBOR)
+		w.WriteHeader(status)
+		w.Write(data)
+	}))
+	t.Cleanup(ts.Close)
+	return APIHost(ts.URL), calls
+}
+
+func TestAPIHostRetry(t *testing.T) {
+	withUpstream(t, conf.Upstream{Timeout: 1000, Retries: 2, RetryBackoff: 1, RetryMaxBackoff: 5})
+
+	for _, c := range []struct {
+		name     string
+		method   string
+		statuses []int
+		calls    int32
+		status   int
+	}{
+		{"retry 503", http.MethodGet, []int{503, 503, 200}, 3, 200},
+		{"retry 429", http.MethodDelete, []int{429, 200}, 2, 200},
+		{"retry 502 and 504", http.MethodPut, []int{502, 504, 200}, 3, 200},
+		{"give up", http.MethodGet, []int{503, 503, 503, 200}, 3, 503},
+		{"no retry for 500", http.MethodGet, []int{500, 200}, 1, 500},
+		{"no retry for 404", http.MethodGet, []int{404, 200}, 1, 404},
+		{"no retry for POST", http.MethodPost, []int{503, 200}, 1, 503},
+		{"no retry for PATCH", http.MethodPatch, []int{503, 200}, 1, 503},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			h, calls := newStatusServer(t, c.statuses...)
+
+			output := &testResult{}
+			err := h.request(context.Background(), c.method, "/", nil, output)
+			assert.Equal(c.calls, calls.Load())
+			if c.status == 200 {
+				assert.NoError(err)
+				assert.Equal("OK", output.Result)
+			} else {
+				assert.Equal(c.status, gear.ParseError(err).Status())
+			}
+		})
+	}
+
+	t.Run("retry transport errors", func(t *testing.T) {
+		assert := assert.New(t)
+		ts := httptest.NewServer(http.NotFoundHandler())
+		h := APIHost(ts.URL)
+		ts.Close()
+
+		err := h.request(context.Background(), http.MethodGet, "/", nil, &testResult{})
+		assert.Equal(http.StatusBadGateway, gear.ParseError(err).Status())
+		assert.True(isTransient(err))
+	})
+
+	t.Run("nil output", func(t *testing.T) {
+		assert := assert.New(t)
+		withUpstream(t, conf.Upstream{Timeout: 1000, HedgeDelay: 10})
+		h, _ := newStatusServer(t, 404)
+		assert.NotPanics(func() {
+			h.request(context.Background(), http.MethodGet, "/", nil, nil)
+		})
+	})
+}
+
+func TestAPIHostBreaker(t *testing.T) {
+	assert := assert.New(t)
+	withUpstream(t, conf.Upstream{Timeout: 1000, BreakerFailures: 2, BreakerCooldown: 60})
+
+	status := &atomic.Int32{}
+	status.Store(http.StatusServiceUnavailable)
+	calls := &atomic.Int32{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		data, _ := cbor.Marshal(testResult{Result: "ok"})
+		w.Header().Set(gear.HeaderContentType, gear.MIMEApplicationCBOR)
+		w.WriteHeader(int(status.Load()))
+		w.Write(data)
+	}))
+	defer ts.Close()
+	util.RegisterUpstream(ts.URL, "testbase")
+	h := APIHost(ts.URL)
+	b := hostBreaker(ts.URL)
+	cooldown := func() {
+		b.mu.Lock()
+		b.openedAt = time.Now().Add(-time.Hour)
+		b.mu.Unlock()
+	}
+
+	// the 500 responses do not open the breaker
+	status.Store(http.StatusInternalServerError)
+	for i := 0; i < 3; i++ {
+		assert.Error(h.request(context.Background(), http.MethodPost, "/", nil, &testResult{}))
+	}
+	assert.Equal(BreakerClosed, BreakerStates()["testbase"])
+
+	status.Store(http.StatusServiceUnavailable)
+	for i := 0; i < 2; i++ {
+		assert.Error(h.request(context.Background(), http.MethodPost, "/", nil, &testResult{}))
+	}
+	assert.Equal(BreakerOpen, BreakerStates()["testbase"])
+
+	calls.Store(0)
+	err := h.request(context.Background(), http.MethodPost, "/", nil, &testResult{})
+	assert.Equal(http.StatusServiceUnavailable, gear.ParseError(err).Status())
+	assert.Contains(err.Error(), "circuit breaker")
+	assert.Equal(int32(0), calls.Load())
+
+	// the failed probe opens the breaker again
+	cooldown()
+	assert.Error(h.request(context.Background(), http.MethodPost, "/", nil, &testResult{}))
+	assert.Equal(int32(1), calls.Load())
+	assert.Equal(BreakerOpen, BreakerStates()["testbase"])
+
+	// the successful probe closes the breaker
+	cooldown()
+	status.Store(http.StatusOK)
+	assert.NoError(h.request(context.Background(), http.MethodPost, "/", nil, &testResult{}))
+	assert.Equal(BreakerClosed, BreakerStates()["testbase"])
+}
+
+func TestBreakerProbe(t *testing.T) {
+	assert := assert.New(t)
+	cfg := &conf.Upstream{BreakerFailures: 1, BreakerCooldown: 60}
+	b := &breaker{host: "probe", state: BreakerClosed}
+
+	// a request in flight before the breaker opens
+	stale, ok := b.allow(cfg)
+	assert.True(ok)
+	assert.Equal(uint64(0), stale)
+
+	b.record(cfg, 0, BreakerOpen)
+	assert.Equal(BreakerOpen, b.state)
+	_, ok = b.allow(cfg)
+	assert.False(ok, "cooling down")
+
+	b.openedAt = time.Now().Add(-time.Hour)
+	probe, ok := b.allow(cfg)
+	assert.True(ok)
+	assert.NotEqual(uint64(0), probe)
+	assert.Equal(BreakerHalfOpen, b.state)
+
+	// the stale request can not close the breaker or release the probe
+	b.record(cfg, stale, BreakerClosed)
+	assert.Equal(BreakerHalfOpen, b.state)
+	_, ok = b.allow(cfg)
+	assert.False(ok, "one probe only")
+
+	// the probe canceled by the caller is released
+	b.record(cfg, probe, "")
+	assert.Equal(BreakerHalfOpen, b.state)
+	probe2, ok := b.allow(cfg)
+	assert.True(ok)
+	assert.NotEqual(probe, probe2)
+
+	// the outcome of the previous probe does not count
+	b.record(cfg, probe, BreakerOpen)
+	assert.Equal(BreakerHalfOpen, b.state)
+
+	b.record(cfg, probe2, BreakerClosed)
+	assert.Equal(BreakerClosed, b.state)
+	_, ok = b.allow(cfg)
+	assert.True(ok)
+}
+
+func TestAPIHostHedge(t *testing.T) {
+	withUpstream(t, conf.Upstream{Timeout: 2000, HedgeDelay: 20})
+
+	// the first request is slow, the second one responds the status at once
+	newServer := func(t *testing.T, second int) (APIHost, *atomic.Bool) {
+		calls := &atomic.Int32{}
+		canceled := &atomic.Bool{}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, status := "fast", second
+			if calls.Add(1) == 1 {
+				select {
+				case <-r.Context().Done():
+					canceled.Store(true)
+					return
+				case <-time.After(300 * time.Millisecond):
+				}
+				result, status = "slow", http.StatusOK
+			}
+			data, _ := cbor.Marshal(testResult{Result: result})
+			w.Header().Set(gear.HeaderContentType, gear.MIMEApplicationCBOR)
+			w.WriteHeader(status)
+			w.Write(data)
+		}))
+		t.Cleanup(ts.Close)
+		return APIHost(ts.URL), canceled
+	}
+
+	t.Run("hedge wins", func(t *testing.T) {
+		assert := assert.New(t)
+		h, canceled := newServer(t, http.StatusOK)
+
+		output := &testResult{}
+		start := time.Now()
+		assert.NoError(h.request(context.Background(), http.MethodGet, "/", nil, output))
+		assert.Equal("fast", output.Result)
+		assert.Less(time.Since(start), 250*time.Millisecond)
+		assert.Eventually(canceled.Load, time.Second, 10*time.Millisecond, "the loser is canceled")
+	})
+
+	t.Run("hedge loses", func(t *testing.T) {
+		assert := assert.New(t)
+		h, _ := newServer(t, http.StatusNotFound)
+
+		output := &testResult{}
+		assert.NoError(h.request(context.Background(), http.MethodGet, "/", nil, output))
+		assert.Equal("slow", output.Result)
+	})
+
+	t.Run("no hedge for POST", func(t *testing.T) {
+		assert := assert.New(t)
+		h, _ := newServer(t, http.StatusOK)
+
+		output := &testResult{}
+		assert.NoError(h.request(context.Background(), http.MethodPost, "/", nil, output))
+		assert.Equal("slow", output.Result)
+	})
+}
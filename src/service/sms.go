@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ldclabs/cose/key"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/logging"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func init() {
+	util.DigProvide(NewSMSSender)
+}
+
+// SMSSender sends the verification code to the E.164 phone number.
+type SMSSender interface {
+	SendCode(ctx context.Context, phone, code string) error
+}
+
+// NewSMSSender creates the sender of the config, it returns nil if the kind is empty, so the SMS login is disabled.
+func NewSMSSender() SMSSender {
+	cfg := conf.Config.SMS
+	switch cfg.Kind {
+	case "":
+		return nil
+	case "aliyun":
+		return &AliyunSMS{
+			endpoint:        cfg.Endpoint,
+			accessKeyId:     cfg.AccessKeyId,
+			accessKeySecret: cfg.AccessKeySecret,
+			signName:        cfg.SignName,
+			templateCode:    cfg.TemplateCode,
+		}
+	case "log":
+		if conf.Config.Env == "prod" {
+			panic(fmt.Errorf("sms.kind %q is not allowed in prod", cfg.Kind))
+		}
+		return &LogSMS{}
+	default:
+		panic(fmt.Errorf("unknown sms.kind %q", cfg.Kind))
+	}
+}
+
+// LogSMS writes the codes to the log, it is for development and tests.
+type LogSMS struct{}
+
+func (s *LogSMS) SendCode(ctx context.Context, phone, code string) error {
+	logging.Infof("sms to %s: %s", phone, code)
+	return nil
+}
+
+// AliyunSMS sends the code by the Aliyun SMS service.
+// https://help.aliyun.com/document_detail/419273.html
+type AliyunSMS struct {
+	endpoint        string
+	accessKeyId     string
+	accessKeySecret string
+	signName        string
+	templateCode    string
+}
+
+type aliyunSMSOutput struct {
+	Code      string `json:"Code"`
+	Message   string `json:"Message"`
+	RequestId string `json:"RequestId"`
+}
+
+func (s *AliyunSMS) SendCode(ctx context.Context, phone, code string) error {
+	param, _ := json.Marshal(map[string]string{"code": code})
+	params := url.Values{
+		"AccessKeyId":      {s.accessKeyId},
+		"Action":           {"SendSms"},
+		"Format":           {"JSON"},
+		"PhoneNumbers":     {strings.TrimPrefix(phone, "+86")},
+		"RegionId":         {"cn-hangzhou"},
+		"SignName":         {s.signName},
+		"SignatureMethod":  {"HMAC-SHA1"},
+		"SignatureNonce":   {util.Bytes(key.GetRandomBytes(16)).String()},
+		"SignatureVersion": {"1.0"},
+		"TemplateCode":     {s.templateCode},
+		"TemplateParam":    {string(param)},
+		"Timestamp":        {time.Now().UTC().Format("2006-01-02T15:04:05Z")},
+		"Version":          {"2017-05-25"},
+	}
+	params.Set("Signature", s.sign(http.MethodGet, params))
+
+	output := &aliyunSMSOutput{}
+	if err := util.RequestJSON(ctx, util.ExternalHTTPClient, http.MethodGet,
+		s.endpoint+"/?"+params.Encode(), nil, output); err != nil {
+		return err
+	}
+	if output.Code != "OK" {
+		return gear.ErrBadGateway.WithMsgf("aliyun sms failed, code: %s, message: %s, rid: %s",
+			output.Code, output.Message, output.RequestId)
+	}
+	return nil
+}
+
+// sign computes the RPC signature of the Aliyun API.
+func (s *AliyunSMS) sign(method string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, aliyunEncode(k)+"="+aliyunEncode(params.Get(k)))
+	}
+
+	str := method + "&" + aliyunEncode("/") + "&" + aliyunEncode(strings.Join(pairs, "&"))
+	mac := hmac.New(sha1.New, []byte(s.accessKeySecret+"&"))
+	mac.Write([]byte(str))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func aliyunEncode(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.ReplaceAll(s, "+", "%20")
+	s = strings.ReplaceAll(s, "*", "%2A")
+	return strings.ReplaceAll(s, "%7E", "~")
+}
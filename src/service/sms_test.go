@@ -0,0 +1,32 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+)
+
+func TestNewSMSSender(t *testing.T) {
+	assert := assert.New(t)
+
+	env, cfg := conf.Config.Env, conf.Config.SMS
+	defer func() {
+		conf.Config.Env, conf.Config.SMS = env, cfg
+	}()
+
+	conf.Config.Env = "dev"
+	conf.Config.SMS.Kind = ""
+	assert.Nil(NewSMSSender())
+
+	conf.Config.SMS.Kind = "log"
+	assert.IsType(&LogSMS{}, NewSMSSender())
+
+	conf.Config.SMS.Kind = "twilio"
+	assert.Panics(func() { NewSMSSender() })
+
+	conf.Config.Env = "prod"
+	conf.Config.SMS.Kind = "log"
+	assert.Panics(func() { NewSMSSender() })
+}
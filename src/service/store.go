@@ -0,0 +1,291 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/yiwen-ai/auth-api/src/conf"
+	"github.com/yiwen-ai/auth-api/src/util"
+)
+
+func init() {
+	util.DigProvide(NewNonceStore)
+	util.DigProvide(NewRateLimitStore)
+}
+
+// ErrStoreFull is returned by MemoryStore.Consume when the unexpired used tokens fill the store.
+var ErrStoreFull = errors.New("nonce store is full")
+
+// NonceStore records the single-use tokens, such as the OAuth state, and the attempt counters.
+type NonceStore interface {
+	// Consume marks the key as used for the ttl, it returns false if the key has been used.
+	// The used keys are kept until they expire, the ttl should be positive.
+	Consume(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Incr increases the counter of the key and returns the new value, the ttl is set when the key is created
+	// and should be positive.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// Set saves the value of the key for the ttl, the ttl should be positive.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Get returns the value of the key, or nil if not found.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes the consumed key, the value or the counter of the key, it does nothing if not found.
+	Delete(ctx context.Context, key string) error
+	// Ping checks the connection of the store.
+	Ping(ctx context.Context) error
+}
+
+func NewNonceStore() NonceStore {
+	cfg := conf.Config.Store
+	switch cfg.Kind {
+	case "redis":
+		return &RedisStore{cli: sharedRedisClient(cfg.RedisURL), prefix: conf.AppName + ":"}
+	default:
+		return NewMemoryStore(cfg.MemorySize)
+	}
+}
+
+var (
+	redisOnce   sync.Once
+	redisClient *redis.Client
+)
+
+// sharedRedisClient returns the client shared by the stores.
+func sharedRedisClient(redisURL string) *redis.Client {
+	redisOnce.Do(func() {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			panic(err)
+		}
+		redisClient = redis.NewClient(opts)
+	})
+	return redisClient
+}
+
+// MemoryStore is a nonce store for single instance deployment.
+// The counters and values are kept in a LRU, the oldest keys are evicted when it is full.
+// The used keys of Consume are kept apart and never evicted before they expire, or a replay would pass,
+// new keys are rejected with ErrStoreFull if the unexpired ones fill the store.
+type MemoryStore struct {
+	mu       sync.Mutex
+	size     int
+	ll       *list.List
+	items    map[string]*list.Element
+	consumed map[string]time.Time // the expiry of the used keys
+	sweptAt  time.Time
+}
+
+type memoryEntry struct {
+	key       string
+	count     int64
+	value     []byte
+	tat       time.Time // the theoretical arrival time of the rate limiter
+	expiresAt time.Time
+}
+
+func NewMemoryStore(size int) *MemoryStore {
+	if size <= 0 {
+		size = 100000
+	}
+	return &MemoryStore{
+		size:     size,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		consumed: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryStore) Consume(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	if err := checkTTL(ttl); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if expiresAt, ok := s.consumed[key]; ok {
+		if expiresAt.After(now) {
+			return false, nil
+		}
+	} else if len(s.consumed) >= s.size {
+		s.sweep(now)
+		if len(s.consumed) >= s.size {
+			return false, ErrStoreFull
+		}
+	}
+
+	s.consumed[key] = now.Add(ttl)
+	return true, nil
+}
+
+// sweep removes the expired used keys at most once a second, it should be called with the lock.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.sweptAt) < time.Second {
+		return
+	}
+	s.sweptAt = now
+	for key, expiresAt := range s.consumed {
+		if !expiresAt.After(now) {
+			delete(s.consumed, key)
+		}
+	}
+}
+
+func (s *MemoryStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	if err := checkTTL(ttl); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if e, ok := s.items[key]; ok {
+		entry := e.Value.(*memoryEntry)
+		if entry.expiresAt.After(now) {
+			entry.count++
+			return entry.count, nil
+		}
+		entry.count = 1
+		entry.expiresAt = now.Add(ttl)
+		s.ll.MoveToFront(e)
+		return 1, nil
+	}
+
+	s.put(&memoryEntry{key: key, count: 1, expiresAt: now.Add(ttl)})
+	return 1, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(&memoryEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry := s.get(key, time.Now()); entry != nil {
+		return entry.value, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.consumed, key)
+	if e, ok := s.items[key]; ok {
+		s.ll.Remove(e)
+		delete(s.items, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// get returns the unexpired entry, it should be called with the lock.
+func (s *MemoryStore) get(key string, now time.Time) *memoryEntry {
+	if e, ok := s.items[key]; ok {
+		entry := e.Value.(*memoryEntry)
+		if entry.expiresAt.After(now) {
+			return entry
+		}
+		s.ll.Remove(e)
+		delete(s.items, key)
+	}
+	return nil
+}
+
+// put adds or replaces the entry, it should be called with the lock.
+func (s *MemoryStore) put(entry *memoryEntry) {
+	if e, ok := s.items[entry.key]; ok {
+		e.Value = entry
+		s.ll.MoveToFront(e)
+		return
+	}
+
+	s.items[entry.key] = s.ll.PushFront(entry)
+	for s.ll.Len() > s.size {
+		e := s.ll.Back()
+		s.ll.Remove(e)
+		delete(s.items, e.Value.(*memoryEntry).key)
+	}
+}
+
+// checkTTL rejects the keys without expiry, they would never be removed.
+func checkTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl %v, should be positive", ttl)
+	}
+	return nil
+}
+
+// RedisStore is a nonce store for multiple instances, it works with Redis compatible services.
+type RedisStore struct {
+	cli    *redis.Client
+	prefix string
+}
+
+func (s *RedisStore) Consume(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	if err := checkTTL(ttl); err != nil {
+		return false, err
+	}
+	return s.cli.SetNX(ctx, s.prefix+key, 1, ttl).Result()
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+	return s.cli.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.cli.Get(ctx, s.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	return s.cli.Del(ctx, s.prefix+key).Err()
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.cli.Ping(ctx).Err()
+}
+
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	if err := checkTTL(ttl); err != nil {
+		return 0, err
+	}
+	return incrScript.Run(ctx, s.cli, []string{s.prefix + key}, ttl.Milliseconds()).Int64()
+}
+
+// KEYS[1]: counter key, ARGV: ttl (ms).
+// The counter and its expiry are set atomically, or a crash between them would leave a counter without expiry.
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
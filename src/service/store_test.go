@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("consumed keys are not evicted", func(t *testing.T) {
+		assert := assert.New(t)
+		s := NewMemoryStore(3)
+
+		ok, err := s.Consume(ctx, "state:1", time.Minute)
+		assert.NoError(err)
+		assert.True(ok)
+
+		// the attacker-driven counters and values fill the LRU
+		for i := 0; i < 10; i++ {
+			_, err = s.Incr(ctx, fmt.Sprintf("email_send:%d", i), time.Minute)
+			assert.NoError(err)
+			assert.NoError(s.Set(ctx, fmt.Sprintf("access_token:%d", i), []byte("v"), time.Minute))
+		}
+
+		ok, err = s.Consume(ctx, "state:1", time.Minute)
+		assert.NoError(err)
+		assert.False(ok, "replay is rejected")
+	})
+
+	t.Run("reject new keys when full", func(t *testing.T) {
+		assert := assert.New(t)
+		s := NewMemoryStore(2)
+
+		for _, key := range []string{"a", "b"} {
+			ok, err := s.Consume(ctx, key, time.Minute)
+			assert.NoError(err)
+			assert.True(ok)
+		}
+		ok, err := s.Consume(ctx, "c", time.Minute)
+		assert.ErrorIs(err, ErrStoreFull)
+		assert.False(ok)
+
+		ok, err = s.Consume(ctx, "a", time.Minute)
+		assert.NoError(err)
+		assert.False(ok, "still used")
+
+		// the expired keys are swept, at most once a second
+		s.mu.Lock()
+		s.consumed["a"] = time.Now().Add(-time.Second)
+		s.mu.Unlock()
+		_, err = s.Consume(ctx, "c", time.Minute)
+		assert.ErrorIs(err, ErrStoreFull)
+
+		s.mu.Lock()
+		s.sweptAt = time.Now().Add(-time.Second)
+		s.mu.Unlock()
+		ok, err = s.Consume(ctx, "c", time.Minute)
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Len(s.consumed, 2)
+	})
+
+	t.Run("expired keys can be consumed again", func(t *testing.T) {
+		assert := assert.New(t)
+		s := NewMemoryStore(0)
+
+		ok, _ := s.Consume(ctx, "a", 10*time.Millisecond)
+		assert.True(ok)
+		time.Sleep(20 * time.Millisecond)
+		ok, _ = s.Consume(ctx, "a", time.Minute)
+		assert.True(ok)
+	})
+
+	t.Run("reject ttl <= 0", func(t *testing.T) {
+		assert := assert.New(t)
+		s := NewMemoryStore(0)
+
+		for _, ttl := range []time.Duration{0, -time.Second} {
+			_, err := s.Consume(ctx, "a", ttl)
+			assert.Error(err)
+			_, err = s.Incr(ctx, "b", ttl)
+			assert.Error(err)
+			assert.Error(s.Set(ctx, "c", []byte("v"), ttl))
+		}
+		assert.Empty(s.consumed)
+		assert.Empty(s.items)
+
+		rs := &RedisStore{}
+		_, err := rs.Consume(ctx, "a", 0)
+		assert.Error(err)
+		_, err = rs.Incr(ctx, "b", 0)
+		assert.Error(err)
+		assert.Error(rs.Set(ctx, "c", []byte("v"), 0))
+	})
+
+	t.Run("counters and values", func(t *testing.T) {
+		assert := assert.New(t)
+		s := NewMemoryStore(0)
+
+		n, _ := s.Incr(ctx, "a", time.Minute)
+		assert.Equal(int64(1), n)
+		n, _ = s.Incr(ctx, "a", time.Minute)
+		assert.Equal(int64(2), n)
+
+		assert.NoError(s.Set(ctx, "b", []byte("v"), time.Minute))
+		v, err := s.Get(ctx, "b")
+		assert.NoError(err)
+		assert.Equal([]byte("v"), v)
+		v, err = s.Get(ctx, "c")
+		assert.NoError(err)
+		assert.Nil(v)
+
+		assert.NoError(s.Delete(ctx, "a"))
+		assert.NoError(s.Delete(ctx, "b"))
+		assert.NoError(s.Delete(ctx, "c"))
+		v, _ = s.Get(ctx, "b")
+		assert.Nil(v)
+		n, _ = s.Incr(ctx, "a", time.Minute)
+		assert.Equal(int64(1), n, "the counter is reset")
+
+		ok, _ := s.Consume(ctx, "d", time.Minute)
+		assert.True(ok)
+		assert.NoError(s.Delete(ctx, "d"))
+		ok, _ = s.Consume(ctx, "d", time.Minute)
+		assert.True(ok, "the consumed key is deleted")
+	})
+}
@@ -5,11 +5,11 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"runtime"
 	"strings"
 	"time"
@@ -26,11 +26,8 @@ func init() {
 var userAgent string
 
 var externalTr = &http.Transport{
-	TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
-	DialContext: (&net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 15 * time.Second,
-	}).DialContext,
+	TLSClientConfig:       &tls.Config{InsecureSkipVerify: false},
+	DialContext:           NewGuardedDialer(10*time.Second, 15*time.Second).DialContext,
 	ForceAttemptHTTP2:     true,
 	MaxIdleConns:          100,
 	MaxIdleConnsPerHost:   20,
@@ -41,8 +38,9 @@ var externalTr = &http.Transport{
 }
 
 var ExternalHTTPClient = &http.Client{
-	Transport: gzhttp.Transport(externalTr),
-	Timeout:   time.Second * 15,
+	Transport:     NewExternalTracingTransport(&metricsTransport{gzhttp.Transport(externalTr)}),
+	CheckRedirect: CheckRedirect,
+	Timeout:       time.Second * 15,
 }
 
 var internalTr = &http.Transport{
@@ -60,7 +58,7 @@ var internalTr = &http.Transport{
 }
 
 var HTTPClient = &http.Client{
-	Transport: gzhttp.Transport(internalTr),
+	Transport: NewTracingTransport(&metricsTransport{gzhttp.Transport(internalTr)}),
 	Timeout:   time.Second * 5,
 }
 
@@ -101,11 +99,7 @@ func RequestJSON(ctx context.Context, cli *http.Client, method, api string, inpu
 	rid := req.Header.Get(gear.HeaderXRequestID)
 	resp, err := cli.Do(req)
 	if err != nil {
-		if err.(*url.Error).Unwrap() == context.Canceled {
-			return gear.ErrClientClosedRequest
-		}
-
-		return gear.ErrInternalServerError.From(err)
+		return transportError(err)
 	}
 
 	defer resp.Body.Close()
@@ -162,11 +156,7 @@ func RequestCBOR(ctx context.Context, cli *http.Client, method, api string, inpu
 	rid := req.Header.Get(gear.HeaderXRequestID)
 	resp, err := cli.Do(req)
 	if err != nil {
-		if err.(*url.Error).Unwrap() == context.Canceled {
-			return gear.ErrClientClosedRequest
-		}
-
-		return gear.ErrInternalServerError.From(err)
+		return transportError(err)
 	}
 
 	defer resp.Body.Close()
@@ -196,6 +186,19 @@ func RequestCBOR(ctx context.Context, cli *http.Client, method, api string, inpu
 	return nil
 }
 
+// transportError maps the error of the round trip, so the unreachable upstream is told from its 500 responses.
+func transportError(err error) error {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return gear.ErrClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()):
+		return gear.ErrGatewayTimeout.From(err)
+	default:
+		return gear.ErrBadGateway.From(err)
+	}
+}
+
 func CopyHeader(dst http.Header, src http.Header, names ...string) {
 	for k, vv := range src {
 		if len(names) > 0 && !SliceHas(names, strings.ToLower(k)) {
@@ -27,6 +27,14 @@ func ParseID(s string) (ID, error) {
 	return ID(id), nil
 }
 
+func IDFromBytes(b []byte) (ID, error) {
+	id, err := xid.FromBytes(b)
+	if err != nil {
+		return ZeroID, err
+	}
+	return ID(id), nil
+}
+
 func TryParseID(s string) *ID {
 	id, err := xid.FromString(s)
 	if err != nil {
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"image"
+	"image/color"
+	_ "image/gif" // register decoders
+	"image/jpeg"
+	_ "image/png"
+	"slices"
+
+	"github.com/teambition/gear"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ImageVariant is a normalized JPEG of the image, Size is the width and height in pixels.
+type ImageVariant struct {
+	Size int
+	Data []byte
+}
+
+// NormalizeImage decodes the image (JPEG, PNG, GIF or WebP), crops it to a square at the center,
+// and encodes the JPEG variants in the sizes, the metadata is dropped. Smaller images are not upscaled,
+// so a size is reduced to the side of the image, and the duplicate sizes are skipped.
+// It returns the hash of the decoded pixels, which identifies the content of the image regardless of
+// the metadata and the sizes or quality of the variants.
+func NormalizeImage(data []byte, maxPixels int, sizes []int, quality int) (string, []ImageVariant, error) {
+	// check the dimensions before decoding, to reject decompression bombs
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, gear.ErrUnsupportedMediaType.WithMsgf("invalid image: %v", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxPixels {
+		return "", nil, gear.ErrRequestEntityTooLarge.WithMsgf("image is too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, gear.ErrUnsupportedMediaType.WithMsgf("invalid image: %v", err)
+	}
+
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+
+	variants := make([]ImageVariant, 0, len(sizes))
+	for _, size := range sizes {
+		size = min(size, side)
+		if slices.ContainsFunc(variants, func(v ImageVariant) bool { return v.Size == size }) {
+			continue
+		}
+
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		// JPEG has no alpha channel
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Over, nil)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+			return "", nil, gear.ErrInternalServerError.From(err)
+		}
+		variants = append(variants, ImageVariant{Size: size, Data: buf.Bytes()})
+	}
+
+	if len(variants) == 0 {
+		return "", nil, gear.ErrInternalServerError.WithMsg("no image sizes")
+	}
+	return hashImage(src), variants, nil
+}
+
+// hashImage hashes the bounds and the pixels of the decoded image.
+func hashImage(img image.Image) string {
+	h := sha256.New()
+	b := img.Bounds()
+	binary.Write(h, binary.BigEndian, [4]int64{int64(b.Min.X), int64(b.Min.Y), int64(b.Max.X), int64(b.Max.Y)})
+	switch m := img.(type) {
+	case *image.YCbCr:
+		binary.Write(h, binary.BigEndian, int64(m.SubsampleRatio))
+		h.Write(m.Y)
+		h.Write(m.Cb)
+		h.Write(m.Cr)
+	case *image.NRGBA:
+		h.Write(m.Pix)
+	case *image.RGBA:
+		h.Write(m.Pix)
+	case *image.Gray:
+		h.Write(m.Pix)
+	default:
+		dst := image.NewNRGBA(b)
+		draw.Draw(dst, b, img, b.Min, draw.Src)
+		h.Write(dst.Pix)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
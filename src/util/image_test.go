@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeImage(t *testing.T) {
+	assert := assert.New(t)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			src.Set(x, y, color.NRGBA{uint8(x), uint8(y), 0, 128})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(png.Encode(&buf, src))
+
+	hash, variants, err := NormalizeImage(buf.Bytes(), 1000*1000, []int{400, 100}, 85)
+	assert.NoError(err)
+	assert.Len(hash, 32)
+	assert.Len(variants, 2)
+	assert.Equal(200, variants[0].Size, "not upscaled")
+	assert.Equal(100, variants[1].Size)
+	for _, v := range variants {
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(v.Data))
+		assert.NoError(err)
+		assert.Equal("jpeg", format)
+		assert.Equal(v.Size, cfg.Width)
+		assert.Equal(v.Size, cfg.Height)
+	}
+
+	hash2, variants, err := NormalizeImage(buf.Bytes(), 1000*1000, []int{400, 300, 200, 100, 100}, 85)
+	assert.NoError(err)
+	assert.Equal(hash, hash2)
+	assert.Len(variants, 2, "the duplicate sizes are skipped")
+	assert.Equal(200, variants[0].Size)
+	assert.Equal(100, variants[1].Size)
+
+	hash2, _, err = NormalizeImage(buf.Bytes(), 1000*1000, []int{64}, 50)
+	assert.NoError(err)
+	assert.Equal(hash, hash2, "not changed by the sizes and quality")
+
+	src.Set(0, 0, color.NRGBA{0, 0, 255, 255})
+	var buf2 bytes.Buffer
+	assert.NoError(png.Encode(&buf2, src))
+	hash2, _, err = NormalizeImage(buf2.Bytes(), 1000*1000, []int{400, 100}, 85)
+	assert.NoError(err)
+	assert.NotEqual(hash, hash2)
+
+	_, _, err = NormalizeImage(buf.Bytes(), 100*100, []int{400}, 85)
+	assert.Error(err)
+
+	_, _, err = NormalizeImage([]byte("<svg></svg>"), 1000*1000, []int{400}, 85)
+	assert.Error(err)
+
+	buf.Reset()
+	assert.NoError(jpeg.Encode(&buf, src, nil))
+	_, _, err = NormalizeImage(buf.Bytes()[:buf.Len()/2], 1000*1000, []int{400}, 85)
+	assert.Error(err, "truncated")
+}
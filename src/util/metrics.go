@@ -0,0 +1,131 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics of the login funnels, they are exposed on /metrics.
+var (
+	MetricLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "auth_api",
+		Name:      "logins_total",
+		Help:      "Logins by IdP and outcome (success or failure), the second factor is not included.",
+	}, []string{"idp", "outcome"})
+
+	MetricRegistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "auth_api",
+		Name:      "registrations_total",
+		Help:      "New users by IdP.",
+	}, []string{"idp"})
+
+	MetricStateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "auth_api",
+		Name:      "state_failures_total",
+		Help:      "Failed verifications of the login state by reason (invalid, replay or binding).",
+	}, []string{"idp", "reason"})
+
+	MetricPassKeyVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "auth_api",
+		Name:      "passkey_verifications_total",
+		Help:      "Passkey verifications by kind (registration or authentication) and outcome.",
+	}, []string{"kind", "outcome"})
+
+	MetricKEKRenewals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "auth_api",
+		Name:      "kek_renewals_total",
+		Help:      "KEK renewals by outcome.",
+	}, []string{"outcome"})
+
+	MetricUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "auth_api",
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of the outbound requests by upstream and status class.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"upstream", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		MetricLogins,
+		MetricRegistrations,
+		MetricStateFailures,
+		MetricPassKeyVerifications,
+		MetricKEKRenewals,
+		MetricUpstreamDuration,
+	)
+}
+
+// Outcome returns "success" or "failure" for the metric label.
+func Outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+var upstreams = struct {
+	sync.RWMutex
+	hosts map[string]string
+}{hosts: map[string]string{
+	"github.com":                   "github",
+	"api.github.com":               "github",
+	"oauth2.googleapis.com":        "google",
+	"www.googleapis.com":           "google",
+	"accounts.google.com":          "google",
+	"openidconnect.googleapis.com": "google",
+	"api.weixin.qq.com":            "wechat",
+	"appleid.apple.com":            "apple",
+	"dysmsapi.aliyuncs.com":        "aliyun_sms",
+}}
+
+// RegisterUpstream names the host of the upstream URL for the metrics, such as "userbase".
+func RegisterUpstream(rawURL, name string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return
+	}
+
+	upstreams.Lock()
+	upstreams.hosts[u.Host] = name
+	upstreams.Unlock()
+}
+
+// UpstreamName returns the name of the upstream URL, or "other" if it is not registered.
+func UpstreamName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "other"
+	}
+	return upstreamName(u.Host)
+}
+
+func upstreamName(host string) string {
+	upstreams.RLock()
+	defer upstreams.RUnlock()
+	if name, ok := upstreams.hosts[host]; ok {
+		return name
+	}
+	return "other"
+}
+
+// metricsTransport observes the latency of the requests by upstream.
+type metricsTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.inner.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode/100) + "xx"
+	}
+	MetricUpstreamDuration.WithLabelValues(upstreamName(req.URL.Host), status).Observe(time.Since(start).Seconds())
+	return resp, err
+}
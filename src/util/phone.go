@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NormalizePhone normalizes the mainland China mobile number to E.164, such as "+8613812345678".
+// It accepts the number with or without the country code ("+86", "0086" or "86"),
+// spaces, dashes and parentheses are ignored.
+func NormalizePhone(phone string) (string, error) {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && b.Len() == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '(' || r == ')':
+		default:
+			return "", fmt.Errorf("invalid phone number %q", phone)
+		}
+	}
+
+	s := b.String()
+	switch {
+	case strings.HasPrefix(s, "+"):
+		if !strings.HasPrefix(s, "+86") {
+			return "", fmt.Errorf("unsupported country code in %q", phone)
+		}
+		s = s[3:]
+	case strings.HasPrefix(s, "0086"):
+		s = s[4:]
+	case len(s) == 13 && strings.HasPrefix(s, "86"):
+		s = s[2:]
+	}
+
+	if len(s) != 11 || s[0] != '1' || s[1] < '3' {
+		return "", fmt.Errorf("invalid mainland China mobile number %q", phone)
+	}
+	return "+86" + s, nil
+}
+
+// MaskPhone masks the middle digits of the E.164 phone number, such as "138****5678".
+func MaskPhone(phone string) string {
+	s := strings.TrimPrefix(phone, "+86")
+	if len(s) != 11 {
+		return phone
+	}
+	return s[:3] + "****" + s[7:]
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []string{
+		"13812345678",
+		"+8613812345678",
+		"+86 138-1234-5678",
+		"008613812345678",
+		"8613812345678",
+		" (+86) 138 1234 5678 ",
+	} {
+		phone, err := NormalizePhone(s)
+		assert.NoError(err, s)
+		assert.Equal("+8613812345678", phone, s)
+	}
+
+	for _, s := range []string{
+		"",
+		"1381234567",
+		"138123456789",
+		"12812345678",
+		"23812345678",
+		"+14155552671",
+		"138.1234.5678",
+		"86+13812345678",
+	} {
+		_, err := NormalizePhone(s)
+		assert.Error(err, s)
+	}
+
+	assert.Equal("138****5678", MaskPhone("+8613812345678"))
+}
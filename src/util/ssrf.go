@@ -0,0 +1,141 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MaxRedirects of the outbound requests to the external hosts.
+const MaxRedirects = 5
+
+// ErrForbiddenAddress is returned when an outbound request resolves to a non-public address.
+var ErrForbiddenAddress = errors.New("forbidden address")
+
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT, Aliyun metadata 100.100.100.200
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local, cloud metadata 169.254.169.254
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/128"),          // unspecified
+	netip.MustParsePrefix("::1/128"),         // loopback
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, it may reach the IPv4 above
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, it may reach the IPv4 above
+	netip.MustParsePrefix("fc00::/7"),        // unique local, AWS metadata fd00:ec2::254
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+var allowedPrefixes struct {
+	sync.RWMutex
+	prefixes []netip.Prefix
+}
+
+// AllowOutboundCIDRs allows the outbound requests to the non-public networks, such as an IdP in the intranet.
+func AllowOutboundCIDRs(cidrs []string) error {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q: %v", s, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+
+	allowedPrefixes.Lock()
+	allowedPrefixes.prefixes = prefixes
+	allowedPrefixes.Unlock()
+	return nil
+}
+
+// IsPublicAddr reports whether the outbound requests can connect to the address.
+func IsPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return false
+	}
+
+	allowedPrefixes.RLock()
+	defer allowedPrefixes.RUnlock()
+	for _, p := range allowedPrefixes.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewGuardedDialer creates the dialer that refuses to connect to the non-public addresses.
+// The address is checked after the DNS resolution, so a hostname can not rebind to an internal address.
+func NewGuardedDialer(timeout, keepAlive time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: keepAlive,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+			}
+			if !IsPublicAddr(ap.Addr()) {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, ap.Addr())
+			}
+			return nil
+		},
+	}
+}
+
+// CheckRedirect limits the redirects to MaxRedirects and to the http(s) URLs.
+func CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", MaxRedirects)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("unsupported redirect to %q", req.URL.Scheme)
+	}
+	return nil
+}
+
+// MatchHost reports whether the host matches one of the patterns, such as "example.com"
+// or "*.example.com" (subdomains only). The port of the host is ignored.
+func MatchHost(host string, patterns []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			if strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []string{
+		"127.0.0.1",
+		"10.1.2.3",
+		"172.20.0.1",
+		"192.168.1.1",
+		"169.254.169.254",
+		"100.100.100.200",
+		"0.0.0.0",
+		"255.255.255.255",
+		"::1",
+		"::",
+		"fe80::1",
+		"fd00:ec2::254",
+		"::ffff:127.0.0.1",
+		"::ffff:10.0.0.1",
+		"64:ff9b::a9fe:a9fe",
+	} {
+		assert.False(IsPublicAddr(netip.MustParseAddr(s)), s)
+	}
+
+	for _, s := range []string{
+		"8.8.8.8",
+		"140.82.112.3",
+		"2606:4700:4700::1111",
+		"::ffff:8.8.8.8",
+	} {
+		assert.True(IsPublicAddr(netip.MustParseAddr(s)), s)
+	}
+
+	assert.NoError(AllowOutboundCIDRs([]string{"10.1.0.0/16"}))
+	defer AllowOutboundCIDRs(nil)
+	assert.True(IsPublicAddr(netip.MustParseAddr("10.1.2.3")))
+	assert.False(IsPublicAddr(netip.MustParseAddr("10.2.0.1")))
+	assert.Error(AllowOutboundCIDRs([]string{"10.1.0.0"}))
+}
+
+func TestGuardedDialer(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	cli := &http.Client{
+		Transport: &http.Transport{DialContext: NewGuardedDialer(time.Second, 0).DialContext},
+	}
+	_, err := cli.Get(ts.URL)
+	assert.True(errors.Is(err, ErrForbiddenAddress), err)
+
+	_, err = NewGuardedDialer(time.Second, 0).DialContext(context.Background(), "tcp", "localhost:80")
+	assert.True(errors.Is(err, ErrForbiddenAddress), err)
+
+	var nerr net.Error
+	assert.True(errors.As(err, &nerr))
+}
+
+func TestMatchHost(t *testing.T) {
+	assert := assert.New(t)
+
+	patterns := []string{"avatars.githubusercontent.com", "*.googleusercontent.com"}
+	assert.True(MatchHost("avatars.githubusercontent.com", patterns))
+	assert.True(MatchHost("Avatars.GitHubUserContent.com:443", patterns))
+	assert.True(MatchHost("lh3.googleusercontent.com", patterns))
+	assert.False(MatchHost("googleusercontent.com", patterns))
+	assert.False(MatchHost("evilgoogleusercontent.com", patterns))
+	assert.False(MatchHost("avatars.githubusercontent.com.evil.com", patterns))
+	assert.False(MatchHost("example.com", nil))
+}
@@ -0,0 +1,123 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP with HMAC-SHA1, 6 digits and 30 seconds period, the defaults of the authenticator apps.
+// https://datatracker.ietf.org/doc/html/rfc6238
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30
+)
+
+var b32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a 160 bits random secret.
+func NewTOTPSecret() []byte {
+	return randBytes(20)
+}
+
+// TOTPSecretString returns the secret in base32 encoding for the manual entry.
+func TOTPSecretString(secret []byte) string {
+	return b32NoPadding.EncodeToString(secret)
+}
+
+// TOTPURI returns the otpauth:// URI, it is the payload of the QR code.
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func TOTPURI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", TOTPSecretString(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(TOTPDigits))
+	q.Set("period", strconv.Itoa(TOTPPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// HOTP returns the HMAC-based one-time password for the counter.
+// https://datatracker.ietf.org/doc/html/rfc4226
+func HOTP(secret []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	s := strconv.FormatUint(uint64(code%mod), 10)
+	if n := digits - len(s); n > 0 {
+		s = strings.Repeat("0", n) + s
+	}
+	return s
+}
+
+// TOTPCounter returns the time step of the time.
+func TOTPCounter(t time.Time) uint64 {
+	return uint64(t.Unix()) / TOTPPeriod
+}
+
+// VerifyTOTP verifies the code in the time step of now, and one step before or after for the clock skew.
+// It returns the matched time step, the caller should reject the reused time step.
+func VerifyTOTP(secret []byte, code string, now time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	counter := TOTPCounter(now)
+	for _, c := range []uint64{counter, counter - 1, counter + 1} {
+		if subtle.ConstantTimeCompare([]byte(HOTP(secret, c, TOTPDigits)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns n single-use recovery codes in "xxxxx-xxxxx" format.
+func NewRecoveryCodes(n int) []string {
+	codes := make([]string, n)
+	for i := range codes {
+		s := strings.ToLower(b32NoPadding.EncodeToString(randBytes(7)))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes
+}
+
+// HashRecoveryCode returns the hash of the recovery code to store, the code is case and "-" insensitive.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
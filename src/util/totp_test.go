@@ -0,0 +1,72 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	t.Run("RFC 6238", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// https://datatracker.ietf.org/doc/html/rfc6238#appendix-B
+		secret := []byte("12345678901234567890")
+		cases := []struct {
+			unix int64
+			code string
+		}{
+			{59, "94287082"},
+			{1111111109, "07081804"},
+			{1111111111, "14050471"},
+			{1234567890, "89005924"},
+			{2000000000, "69279037"},
+			{20000000000, "65353130"},
+		}
+		for _, c := range cases {
+			assert.Equal(c.code, HOTP(secret, TOTPCounter(time.Unix(c.unix, 0)), 8))
+		}
+	})
+
+	t.Run("VerifyTOTP", func(t *testing.T) {
+		assert := assert.New(t)
+
+		secret := NewTOTPSecret()
+		now := time.Now()
+		counter := TOTPCounter(now)
+
+		c, ok := VerifyTOTP(secret, HOTP(secret, counter, TOTPDigits), now)
+		assert.True(ok)
+		assert.Equal(counter, c)
+
+		c, ok = VerifyTOTP(secret, HOTP(secret, counter-1, TOTPDigits), now)
+		assert.True(ok)
+		assert.Equal(counter-1, c)
+
+		_, ok = VerifyTOTP(secret, HOTP(secret, counter-2, TOTPDigits), now)
+		assert.False(ok)
+		_, ok = VerifyTOTP(secret, "12345", now)
+		assert.False(ok)
+	})
+
+	t.Run("TOTPURI", func(t *testing.T) {
+		assert := assert.New(t)
+
+		uri := TOTPURI("Yiwen", "alice", []byte("12345678901234567890"))
+		assert.True(strings.HasPrefix(uri, "otpauth://totp/Yiwen:alice?"))
+		assert.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+		assert.Contains(uri, "issuer=Yiwen")
+	})
+
+	t.Run("RecoveryCodes", func(t *testing.T) {
+		assert := assert.New(t)
+
+		codes := NewRecoveryCodes(10)
+		assert.Len(codes, 10)
+		assert.Len(codes[0], 11)
+		assert.NotEqual(codes[0], codes[1])
+		assert.Equal(HashRecoveryCode(codes[0]), HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))))
+	})
+}
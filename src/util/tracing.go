@@ -0,0 +1,83 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer creates the spans of the app, it is a no-op tracer until InitTracing.
+var Tracer = otel.Tracer("github.com/yiwen-ai/auth-api")
+
+// InitTracing sets the global tracer provider with the exporter ("otlp" or "stdout")
+// and the W3C trace context propagator, it returns the function to flush and stop the exporter.
+func InitTracing(ctx context.Context, name, version, exporter, endpoint string, insecure bool, ratio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		err = fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(name),
+			semconv.ServiceVersion(version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// StartBackgroundSpan starts a root span for the background job, it is linked to the span in the ctx
+// (the originating request), so the job will not extend the request trace.
+func StartBackgroundSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return Tracer.Start(ctx, name, trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(ctx)))
+}
+
+// NewTracingTransport creates the client spans and propagates the trace context to the upstream.
+// It should be used only for the base services, see NewExternalTracingTransport.
+func NewTracingTransport(inner http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(inner, otelhttp.WithSpanNameFormatter(clientSpanName))
+}
+
+// NewExternalTracingTransport creates the client spans without propagation,
+// the trace context and the baggage should not be leaked to the third parties.
+func NewExternalTracingTransport(inner http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(inner,
+		otelhttp.WithSpanNameFormatter(clientSpanName),
+		otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()))
+}
+
+func clientSpanName(_ string, r *http.Request) string {
+	return r.Method + " " + upstreamName(r.URL.Host)
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTracingTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	member, err := baggage.NewMember("uid", "alice")
+	assert.NoError(err)
+	bag, err := baggage.New(member)
+	assert.NoError(err)
+	ctx, span := tp.Tracer("test").Start(baggage.ContextWithBaggage(context.Background(), bag), "request")
+	defer span.End()
+
+	do := func(tr http.RoundTripper) http.Header {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		res, err := (&http.Client{Transport: tr}).Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return header
+	}
+
+	h := do(NewTracingTransport(http.DefaultTransport))
+	assert.Contains(h.Get("Traceparent"), span.SpanContext().TraceID().String())
+	assert.Equal("uid=alice", h.Get("Baggage"))
+
+	// the trace context and the baggage are not sent to the third parties
+	h = do(NewExternalTracingTransport(http.DefaultTransport))
+	assert.Equal("", h.Get("Traceparent"))
+	assert.Equal("", h.Get("Baggage"))
+
+	// the client spans are recorded in the trace of the request for both
+	spans := sr.Ended()
+	assert.Len(spans, 2)
+	for _, s := range spans {
+		assert.Equal("GET "+upstreamName(u.Host), s.Name())
+		assert.Equal(trace.SpanKindClient, s.SpanKind())
+		assert.Equal(span.SpanContext().TraceID(), s.SpanContext().TraceID())
+	}
+}